@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost/server/public/model"
@@ -17,9 +23,34 @@ func (p *Plugin) initAPI() {
 	p.router.HandleFunc("/api/v1/stickers/bulk", p.handleBulkUpload).Methods(http.MethodPost)
 	p.router.HandleFunc("/api/v1/stickers/from-url", p.handleCreateStickerFromURL).Methods(http.MethodPost)
 	p.router.HandleFunc("/api/v1/stickers/send", p.handleSendSticker).Methods(http.MethodPost)
+	p.router.HandleFunc("/api/v1/stickers/trash", p.handleGetTrash).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/stickers/trash/{id}", p.handlePurgeSticker).Methods(http.MethodDelete)
+	p.router.HandleFunc("/api/v1/stickers/trash/{id}/restore", p.handleRestoreSticker).Methods(http.MethodPost)
+	p.router.HandleFunc("/api/v1/stickers/pending", p.handleGetPendingStickers).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/stickers/{id}/approve", p.handleApproveSticker).Methods(http.MethodPost)
+	p.router.HandleFunc("/api/v1/stickers/{id}/reject", p.handleRejectSticker).Methods(http.MethodPost)
+	p.router.HandleFunc(moderationActionPath, p.handleModerationAction).Methods(http.MethodPost)
+	p.router.HandleFunc("/api/v1/stickers/{id}", p.handleUpdateSticker).Methods(http.MethodPatch)
 	p.router.HandleFunc("/api/v1/stickers/{id}", p.handleDeleteSticker).Methods(http.MethodDelete)
 	p.router.HandleFunc("/api/v1/stickers/{id}/image", p.handleGetStickerImage).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/stickers/{id}/image", p.handleReplaceStickerImage).Methods(http.MethodPut)
+	p.router.HandleFunc("/api/v1/stickers/{id}/thumbnail", p.handleGetStickerThumbnail).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/stickers/{id}/preview", p.handleGetStickerPreview).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/stickers/{id}/tags", p.handleSetStickerTags).Methods(http.MethodPut)
+	p.router.HandleFunc("/api/v1/stickers/{id}/aliases", p.handleSetStickerAliases).Methods(http.MethodPut)
+	p.router.HandleFunc("/api/v1/stickers/{id}/versions", p.handleGetStickerVersions).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/stickers/{id}/versions/{version:[0-9]+}/rollback", p.handleRollbackSticker).Methods(http.MethodPost)
 	p.router.HandleFunc("/api/v1/stickers/search", p.handleSearchStickers).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/packs", p.handleGetPacks).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/packs", p.handleCreatePack).Methods(http.MethodPost)
+	p.router.HandleFunc("/api/v1/packs/{id}", p.handleGetPack).Methods(http.MethodGet)
+	p.router.HandleFunc("/api/v1/packs/{id}", p.handleUpdatePack).Methods(http.MethodPatch)
+	p.router.HandleFunc("/api/v1/packs/{id}", p.handleDeletePack).Methods(http.MethodDelete)
+	p.router.HandleFunc("/api/v1/packs/{id}/stickers", p.handleAddStickerToPack).Methods(http.MethodPost)
+	p.router.HandleFunc("/api/v1/packs/{id}/stickers/{sticker_id}", p.handleRemoveStickerFromPack).Methods(http.MethodDelete)
+	p.router.HandleFunc("/api/v1/admin/fsck", p.handleFsck).Methods(http.MethodGet, http.MethodPost)
+	p.router.HandleFunc("/api/v1/admin/gc", p.handleImageGC).Methods(http.MethodGet, http.MethodPost)
+	p.router.HandleFunc("/api/v1/admin/duplicates", p.handleDuplicates).Methods(http.MethodGet, http.MethodPost)
 }
 
 func (p *Plugin) handleGetStickers(w http.ResponseWriter, r *http.Request) {
@@ -29,7 +60,21 @@ func (p *Plugin) handleGetStickers(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	list, err := p.GetAllStickers()
+	p.writeStickerQuery(w, r, userID)
+}
+
+// writeStickerQuery answers a list or search request using the filter, sort
+// and paging parameters from the URL, returning the stickers visible from
+// the team_id and channel_id parameters
+func (p *Plugin) writeStickerQuery(w http.ResponseWriter, r *http.Request, userID string) {
+	query, err := ParseStickerQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query.Viewer = p.viewerFromRequest(r, userID)
+
+	list, err := p.QueryStickers(query)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -57,139 +102,129 @@ func (p *Plugin) handleCreateSticker(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := checkStickerName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	if p.IsStickerNameTaken(name) {
 		http.Error(w, "Sticker name already exists", http.StatusConflict)
 		return
 	}
 
-	file, header, err := r.FormFile("image")
+	onDuplicate, err := parseDuplicatePolicy(r.FormValue("on_duplicate"))
 	if err != nil {
-		http.Error(w, "Image file is required", http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
 
-	ext := strings.ToLower(filepath.Ext(header.Filename))
-	allowedExts := strings.Split(p.getConfiguration().AllowedFormats, ",")
-	isAllowed := false
-	for _, allowed := range allowedExts {
-		if "."+strings.TrimSpace(allowed) == ext {
-			isAllowed = true
-			break
-		}
-	}
-	if !isAllowed {
-		http.Error(w, "File format not allowed", http.StatusBadRequest)
+	scope, err := p.checkScope(userID, scopeFromForm(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	maxSize := int64(p.getConfiguration().MaxStickerSize * 1024)
-	if header.Size > maxSize {
-		http.Error(w, "File size exceeds limit", http.StatusBadRequest)
+	visibility, err := parseVisibility(r.FormValue("visibility"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	fileData, err := io.ReadAll(file)
-	if err != nil {
-		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+	if err := p.Authorize(userID, ActionCreate, Target{Scope: scope}); err != nil {
+		writePermissionError(w, err)
 		return
 	}
 
-	// Save to local filesystem
-	filename, err := p.SaveStickerImageToLocal(fileData, header.Filename)
+	tags := SplitTerms(r.FormValue("tags"))
+	aliases, err := p.validateAliases(SplitTerms(r.FormValue("aliases")), name, "")
 	if err != nil {
-		http.Error(w, "Failed to save sticker image: "+err.Error(), http.StatusInternalServerError)
+		writeStickerRequestError(w, err)
 		return
 	}
 
-	sticker := NewSticker(name, "", filename, userID)
-	if err := p.SaveSticker(sticker); err != nil {
-		http.Error(w, "Failed to save sticker: "+err.Error(), http.StatusInternalServerError)
+	file, header, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, "Image file is required", http.StatusBadRequest)
 		return
 	}
+	defer file.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(sticker)
-}
-
-func (p *Plugin) handleDeleteSticker(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("Mattermost-User-Id")
-	if userID == "" {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if header.Size > p.maxUploadSize() {
+		http.Error(w, "File size exceeds limit", http.StatusBadRequest)
 		return
 	}
 
-	vars := mux.Vars(r)
-	stickerID := vars["id"]
-
-	canDelete, err := p.CanDeleteSticker(userID, stickerID)
+	fileData, err := io.ReadAll(file)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
 		return
 	}
 
-	if !canDelete {
-		http.Error(w, "Permission denied: you can only delete your own stickers", http.StatusForbidden)
+	viewer := p.NewViewer(userID, r.FormValue("team_id"), r.FormValue("channel_id"))
+	sticker, err := p.NewStickerFromImage(name, fileData, header.Filename, userID, onDuplicate == duplicateAllow)
+	var duplicate *DuplicateImageError
+	if errors.As(err, &duplicate) {
+		p.writeDuplicateImage(w, r, userID, viewer, duplicate, name, onDuplicate)
 		return
 	}
-
-	// Get sticker to delete local file
-	sticker, err := p.GetSticker(stickerID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	if errors.Is(err, ErrInvalidImage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Delete local file
-	if sticker.Filename != "" {
-		p.DeleteStickerImageFromLocal(sticker.Filename)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	if err := p.DeleteSticker(stickerID); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	sticker.Tags = tags
+	sticker.Aliases = aliases
+	sticker.Scope = scope
+	sticker.Visibility = visibility
+	if err := p.SubmitSticker(sticker); err != nil {
+		http.Error(w, "Failed to save sticker: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.WriteHeader(http.StatusNoContent)
+	p.writeCreatedSticker(w, sticker, viewer)
 }
 
-func (p *Plugin) handleGetStickerImage(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	stickerID := vars["id"]
-
-	sticker, err := p.GetSticker(stickerID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+func (p *Plugin) handleDeleteSticker(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	fileInfo, appErr := p.API.GetFileInfo(sticker.FileID)
-	if appErr != nil {
-		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
+	vars := mux.Vars(r)
+	stickerID := vars["id"]
+
+	if _, err := p.AuthorizeSticker(userID, ActionDelete, stickerID); err != nil {
+		writePermissionError(w, err)
 		return
 	}
 
-	fileData, appErr := p.API.GetFile(sticker.FileID)
-	if appErr != nil {
-		http.Error(w, "Failed to get file", http.StatusInternalServerError)
+	if _, err := p.TrashSticker(stickerID, userID); err != nil {
+		if errors.Is(err, ErrStickerTrashed) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", fileInfo.MimeType)
-	w.Header().Set("Cache-Control", "public, max-age=31536000")
-	w.Write(fileData)
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (p *Plugin) handleSearchStickers(w http.ResponseWriter, r *http.Request) {
+// handleGetTrash lists the stickers in the trash that the user created,
+// deleted or may delete
+func (p *Plugin) handleGetTrash(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("Mattermost-User-Id")
 	if userID == "" {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	query := r.URL.Query().Get("q")
-	list, err := p.SearchStickers(query)
+	list, err := p.GetTrashedStickers(userID)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -199,258 +234,1663 @@ func (p *Plugin) handleSearchStickers(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(list)
 }
 
-func (p *Plugin) handleCreateStickerFromURL(w http.ResponseWriter, r *http.Request) {
+func (p *Plugin) handleRestoreSticker(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("Mattermost-User-Id")
 	if userID == "" {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
+	stickerID := mux.Vars(r)["id"]
+	if _, err := p.AuthorizeSticker(userID, ActionDelete, stickerID); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	// The body is optional; a name restores the sticker under a new name
 	var req struct {
-		Name      string `json:"name"`
-		URL       string `json:"url"`
-		ChannelID string `json:"channel_id"`
+		Name string `json:"name"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	sticker, err := p.RestoreSticker(stickerID, userID, strings.TrimSpace(req.Name))
+	if errors.Is(err, ErrStickerNotTrashed) {
+		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-
-	if req.Name == "" || req.URL == "" {
-		http.Error(w, "Name and URL are required", http.StatusBadRequest)
+	if errors.Is(err, ErrRestoreNameTaken) {
+		http.Error(w, err.Error()+"; restore it under another name", http.StatusConflict)
 		return
 	}
-
-	if p.IsStickerNameTaken(req.Name) {
-		http.Error(w, "Sticker name already exists", http.StatusConflict)
+	if errors.Is(err, ErrNameReserved) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	// Download image from URL
-	resp, err := http.Get(req.URL)
 	if err != nil {
-		http.Error(w, "Failed to download image: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, "Failed to restore sticker: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, "Failed to download image: status "+resp.Status, http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sticker)
+}
+
+func (p *Plugin) handlePurgeSticker(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	contentType := resp.Header.Get("Content-Type")
-	if !strings.HasPrefix(contentType, "image/") {
-		http.Error(w, "URL does not point to an image", http.StatusBadRequest)
+	stickerID := mux.Vars(r)["id"]
+	if _, err := p.AuthorizeSticker(userID, ActionDelete, stickerID); err != nil {
+		writePermissionError(w, err)
 		return
 	}
 
-	maxSize := int64(p.getConfiguration().MaxStickerSize * 1024)
-	fileData, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
-	if err != nil {
-		http.Error(w, "Failed to read image: "+err.Error(), http.StatusInternalServerError)
+	if err := p.PurgeSticker(stickerID); err != nil {
+		if errors.Is(err, ErrStickerNotTrashed) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if int64(len(fileData)) > maxSize {
-		http.Error(w, "Image size exceeds limit", http.StatusBadRequest)
-		return
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// stickerRequest is the body of a sticker update; fields left out are not
+// changed. PackIDs lists every pack the sticker should belong to.
+type stickerRequest struct {
+	Name        *string   `json:"name"`
+	Description *string   `json:"description"`
+	Tags        *[]string `json:"tags"`
+	Aliases     *[]string `json:"aliases"`
+	Scope       *Scope    `json:"scope"`
+	Visibility  *string   `json:"visibility"`
+	PackIDs     *[]string `json:"pack_ids"`
+}
+
+// ErrNameTaken is returned when a sticker name or alias is already used as
+// the name or alias of another sticker
+var ErrNameTaken = errors.New("already used by another sticker")
+
+// writeStickerRequestError answers an edit rejected by applyStickerRequest or
+// validateAliases: a conflict when a name or alias is taken, and a bad
+// request for anything else
+func writeStickerRequestError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if errors.Is(err, ErrNameTaken) {
+		status = http.StatusConflict
 	}
+	http.Error(w, err.Error(), status)
+}
 
-	// Determine extension from content type
-	ext := ".png"
-	switch contentType {
-	case "image/gif":
-		ext = ".gif"
-	case "image/jpeg":
-		ext = ".jpg"
-	case "image/webp":
-		ext = ".webp"
+// applyStickerRequest validates the fields set in req and copies them to
+// sticker, with the same name and alias checks as creation
+func (p *Plugin) applyStickerRequest(sticker *Sticker, req *stickerRequest) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return fmt.Errorf("name is required")
+		}
+		if err := checkStickerName(name); err != nil {
+			return err
+		}
+		if p.isStickerNameTakenBy(name, sticker.ID) {
+			return fmt.Errorf("sticker name '%s' is %w", name, ErrNameTaken)
+		}
+		sticker.Name = name
 	}
 
-	// Save to local filesystem
-	filename, err := p.SaveStickerImageToLocal(fileData, "sticker_"+req.Name+ext)
-	if err != nil {
-		http.Error(w, "Failed to save sticker image: "+err.Error(), http.StatusInternalServerError)
-		return
+	if req.Description != nil {
+		sticker.Description = strings.TrimSpace(*req.Description)
 	}
 
-	sticker := NewSticker(req.Name, "", filename, userID)
-	if err := p.SaveSticker(sticker); err != nil {
-		http.Error(w, "Failed to save sticker: "+err.Error(), http.StatusInternalServerError)
-		return
+	if req.Tags != nil {
+		sticker.Tags = NormalizeTerms(*req.Tags)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(sticker)
+	// The caller checks a new scope with checkScope, which needs the user
+	if req.Scope != nil {
+		sticker.Scope = *req.Scope
+	}
+
+	// A private sticker can be published, but a public one may already be
+	// in use by others and cannot be taken back
+	if req.Visibility != nil {
+		visibility, err := parseVisibility(*req.Visibility)
+		if err != nil {
+			return err
+		}
+		if visibility == VisibilityPrivate && !sticker.IsPrivate() {
+			return fmt.Errorf("a public sticker cannot be made private")
+		}
+		sticker.Visibility = visibility
+	}
+
+	aliases := sticker.Aliases
+	if req.Aliases != nil {
+		aliases = NormalizeTerms(*req.Aliases)
+	}
+	if req.Aliases != nil || req.Name != nil {
+		// A new name drops the alias it may have been
+		var err error
+		sticker.Aliases, err = p.validateAliases(aliases, sticker.Name, sticker.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-type BulkUploadResult struct {
-	Success []string          `json:"success"`
-	Failed  map[string]string `json:"failed"`
+// stickerPackChanges works out which packs a sticker must be added to and
+// removed from to belong to exactly packIDs
+func (p *Plugin) stickerPackChanges(stickerID string, packIDs []string) (add, remove []string, err error) {
+	wanted := make(map[string]bool, len(packIDs))
+	for _, id := range packIDs {
+		if _, err := p.GetPack(id); err != nil {
+			return nil, nil, fmt.Errorf("pack %s not found", id)
+		}
+		wanted[id] = true
+	}
+
+	packs, err := p.GetAllPacks(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, pack := range packs.Packs {
+		has := pack.HasSticker(stickerID)
+		switch {
+		case wanted[pack.ID] && !has:
+			add = append(add, pack.ID)
+		case !wanted[pack.ID] && has:
+			remove = append(remove, pack.ID)
+		}
+	}
+
+	return add, remove, nil
 }
 
-func (p *Plugin) handleBulkUpload(w http.ResponseWriter, r *http.Request) {
+func (p *Plugin) handleUpdateSticker(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("Mattermost-User-Id")
 	if userID == "" {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// 32MB max for bulk upload
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+	stickerID := mux.Vars(r)["id"]
+	if !p.checkStickerEditPermission(w, r, userID, stickerID) {
 		return
 	}
 
-	allowedExts := strings.Split(p.getConfiguration().AllowedFormats, ",")
-	maxSize := int64(p.getConfiguration().MaxStickerSize * 1024)
-
-	result := BulkUploadResult{
-		Success: []string{},
-		Failed:  make(map[string]string),
-	}
-
-	files := r.MultipartForm.File["images"]
-	if len(files) == 0 {
-		http.Error(w, "No files provided", http.StatusBadRequest)
+	var req stickerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	for _, fileHeader := range files {
-		filename := fileHeader.Filename
-		ext := strings.ToLower(filepath.Ext(filename))
-		name := strings.TrimSuffix(filename, ext)
-
-		// Validate extension
-		isAllowed := false
-		for _, allowed := range allowedExts {
-			if "."+strings.TrimSpace(allowed) == ext {
-				isAllowed = true
-				break
-			}
-		}
-		if !isAllowed {
-			result.Failed[filename] = "File format not allowed"
-			continue
+	if req.Scope != nil {
+		scope, err := p.checkScope(userID, *req.Scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-
-		// Validate size
-		if fileHeader.Size > maxSize {
-			result.Failed[filename] = "File size exceeds limit"
-			continue
+		current, err := p.GetLiveSticker(stickerID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
 		}
-
-		// Check duplicate name
-		if p.IsStickerNameTaken(name) {
-			result.Failed[filename] = "Sticker name already exists"
-			continue
+		if err := p.AuthorizeScopeChange(userID, current.Scope, scope); err != nil {
+			writePermissionError(w, err)
+			return
 		}
+		req.Scope = &scope
+	}
 
-		// Read file
-		file, err := fileHeader.Open()
+	// Check every pack change before changing anything
+	var addPacks, removePacks []string
+	if req.PackIDs != nil {
+		var err error
+		addPacks, removePacks, err = p.stickerPackChanges(stickerID, *req.PackIDs)
 		if err != nil {
-			result.Failed[filename] = "Failed to open file"
-			continue
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
-
-		fileData, err := io.ReadAll(file)
-		file.Close()
-		if err != nil {
-			result.Failed[filename] = "Failed to read file"
-			continue
+		for _, packID := range append(append([]string{}, addPacks...), removePacks...) {
+			if !p.checkPackPermission(w, r, userID, packID) {
+				return
+			}
 		}
+	}
 
-		// Save to local filesystem
-		savedFilename, err := p.SaveStickerImageToLocal(fileData, "sticker_"+name+ext)
-		if err != nil {
-			result.Failed[filename] = "Failed to save: " + err.Error()
-			continue
-		}
+	// Packs are changed first and changed back if the edit fails, so that
+	// the request either applies completely or not at all
+	if err := p.ChangeStickerPacks(stickerID, addPacks, removePacks); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-		// Save sticker metadata
-		sticker := NewSticker(name, "", savedFilename, userID)
-		if err := p.SaveSticker(sticker); err != nil {
-			result.Failed[filename] = "Failed to save: " + err.Error()
-			continue
+	var validationErr error
+	sticker, err := p.EditSticker(stickerID, userID, versionActionUpdate, func(sticker *Sticker) error {
+		validationErr = p.applyStickerRequest(sticker, &req)
+		return validationErr
+	})
+	if err != nil {
+		if undoErr := p.ChangeStickerPacks(stickerID, removePacks, addPacks); undoErr != nil {
+			p.API.LogWarn("Failed to undo pack changes of a failed sticker update", "sticker_id", stickerID, "error", undoErr.Error())
 		}
-
-		result.Success = append(result.Success, name)
+		if validationErr != nil {
+			writeStickerRequestError(w, validationErr)
+			return
+		}
+		http.Error(w, "Failed to update sticker: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	if len(result.Failed) > 0 && len(result.Success) == 0 {
-		w.WriteHeader(http.StatusBadRequest)
-	} else if len(result.Failed) > 0 {
-		w.WriteHeader(http.StatusPartialContent)
-	} else {
-		w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sticker)
+}
+
+func (p *Plugin) handleGetStickerImage(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	stickerID := vars["id"]
+
+	sticker, err := p.GetSticker(stickerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
 	}
-	json.NewEncoder(w).Encode(result)
+
+	// The image of an edit awaiting approval is only shown to the creator
+	// and the moderators
+	if r.URL.Query().Get("revision") == "pending" {
+		userID := r.Header.Get("Mattermost-User-Id")
+		if sticker.PendingRevision == nil || (userID != sticker.CreatorID && p.Authorize(userID, ActionModerate, Target{}) != nil) {
+			http.Error(w, "sticker not found", http.StatusNotFound)
+			return
+		}
+		sticker = sticker.withPendingRevision()
+	}
+
+	p.serveStickerImage(w, r, sticker, sticker.Filename)
 }
 
-func (p *Plugin) handleSendSticker(w http.ResponseWriter, r *http.Request) {
+// handleReplaceStickerImage swaps the image of a sticker for an uploaded one.
+// Posts reference stickers by ID, so they show the new image.
+func (p *Plugin) handleReplaceStickerImage(w http.ResponseWriter, r *http.Request) {
 	userID := r.Header.Get("Mattermost-User-Id")
 	if userID == "" {
 		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	var req struct {
-		ChannelID string `json:"channel_id"`
-		StickerID string `json:"sticker_id"`
-		RootID    string `json:"root_id,omitempty"`
+	stickerID := mux.Vars(r)["id"]
+	if !p.checkStickerEditPermission(w, r, userID, stickerID) {
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
 		return
 	}
 
-	if req.ChannelID == "" || req.StickerID == "" {
-		http.Error(w, "channel_id and sticker_id are required", http.StatusBadRequest)
+	onDuplicate, err := parseDuplicatePolicy(r.FormValue("on_duplicate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	sticker, err := p.GetSticker(req.StickerID)
+	file, header, err := r.FormFile("image")
 	if err != nil {
-		http.Error(w, "Sticker not found", http.StatusNotFound)
+		http.Error(w, "Image file is required", http.StatusBadRequest)
 		return
 	}
+	defer file.Close()
 
-	// Verify user has access to the channel
-	if _, appErr := p.API.GetChannelMember(req.ChannelID, userID); appErr != nil {
-		http.Error(w, "You don't have access to this channel", http.StatusForbidden)
+	if header.Size > p.maxUploadSize() {
+		http.Error(w, "File size exceeds limit", http.StatusBadRequest)
 		return
 	}
 
-	// Get public URL for sticker image
-	imageURL := p.GetStickerPublicURL(sticker.Filename)
-	if imageURL == "" {
-		http.Error(w, "Sticker server not configured", http.StatusInternalServerError)
+	fileData, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
 		return
 	}
 
-	// Create post with markdown image (works on all platforms)
-	post := &model.Post{
-		UserId:    userID,
-		ChannelId: req.ChannelID,
-		Message:   "![" + sticker.Name + "](" + imageURL + ")",
+	stored, err := p.PrepareStickerImage(fileData, header.Filename, onDuplicate == duplicateAllow)
+	var duplicate *DuplicateImageError
+	if errors.As(err, &duplicate) {
+		if duplicate.Sticker.ID == stickerID {
+			http.Error(w, "The image is identical to the current image", http.StatusConflict)
+			return
+		}
+		if !p.NewViewer(userID, r.FormValue("team_id"), r.FormValue("channel_id")).CanSeeSticker(duplicate.Sticker) {
+			http.Error(w, fmt.Sprintf("%s; set on_duplicate to %s to use it anyway", ErrHiddenDuplicateImage.Error(), duplicateAllow), http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf("%s (id %s); set on_duplicate to %s to use it anyway",
+			duplicate.Error(), duplicate.Sticker.ID, duplicateAllow), http.StatusConflict)
+		return
 	}
-
-	if req.RootID != "" {
-		post.RootId = req.RootID
+	if errors.Is(err, ErrInvalidImage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	createdPost, appErr := p.API.CreatePost(post)
-	if appErr != nil {
-		http.Error(w, "Failed to create post: "+appErr.Message, http.StatusInternalServerError)
+	sticker, err := p.ReplaceStickerImage(stickerID, userID, stored)
+	if err != nil {
+		http.Error(w, "Failed to update sticker: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sticker)
+}
+
+// handleGetStickerThumbnail serves the smallest thumbnail covering the
+// requested size, falling back to the original for stickers without one
+func (p *Plugin) handleGetStickerThumbnail(w http.ResponseWriter, r *http.Request) {
+	sticker, err := p.GetSticker(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	size := thumbnailSizes[len(thumbnailSizes)/2]
+	if v := r.URL.Query().Get("size"); v != "" {
+		size, err = strconv.Atoi(v)
+		if err != nil || size <= 0 {
+			http.Error(w, "Invalid size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	key := sticker.ThumbnailKey(size)
+	if key == "" {
+		key = sticker.Filename
+	}
+
+	p.serveStickerImage(w, r, sticker, key)
+}
+
+// handleGetStickerPreview serves a still of the first frame of animated
+// stickers, and the original image of still ones
+func (p *Plugin) handleGetStickerPreview(w http.ResponseWriter, r *http.Request) {
+	sticker, err := p.GetSticker(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	key := sticker.Preview
+	if key == "" {
+		key = sticker.Filename
+	}
+
+	p.serveStickerImage(w, r, sticker, key)
+}
+
+// serveStickerImage serves one of the sticker's stored images to users who
+// can see the sticker. An empty key serves the file of stickers created
+// before the image store existed, which only have a file ID.
+func (p *Plugin) serveStickerImage(w http.ResponseWriter, r *http.Request, sticker *Sticker, key string) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !p.checkStickerVisible(w, r, userID, sticker, true) {
+		return
+	}
+
+	if key == "" {
+		fileData, appErr := p.API.GetFile(sticker.FileID)
+		if appErr != nil {
+			http.Error(w, "Failed to get file", http.StatusInternalServerError)
+			return
+		}
+		serveImage(w, r, sticker.FileID, sticker.CreatedAt, fileData)
+		return
+	}
+
+	fileData, err := p.ReadStickerImage(key)
+	if err != nil {
+		http.Error(w, "Failed to get file", http.StatusInternalServerError)
+		return
+	}
+
+	// Replacing the image must not leave clients with a stale copy
+	serveImage(w, r, key, max(sticker.CreatedAt, sticker.UploadedAt), fileData)
+}
+
+// serveImage writes image data with caching headers and support for
+// conditional and range requests. Image keys are never reused, so the key is
+// a stable validator for the content.
+func serveImage(w http.ResponseWriter, r *http.Request, key string, modifiedAt int64, data []byte) {
+	w.Header().Set("Content-Type", stickerContentType(key, data))
+	w.Header().Set("ETag", `"`+key+`"`)
+	http.ServeContent(w, r, "", time.UnixMilli(modifiedAt), bytes.NewReader(data))
+}
+
+// stickerContentType picks the Content-Type from the file extension, falling
+// back to sniffing the data for keys without one.
+func stickerContentType(filename string, data []byte) string {
+	if contentType := mime.TypeByExtension(strings.ToLower(filepath.Ext(filename))); strings.HasPrefix(contentType, "image/") {
+		return contentType
+	}
+	return http.DetectContentType(data)
+}
+
+func (p *Plugin) handleSearchStickers(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	p.writeStickerQuery(w, r, userID)
+}
+
+func (p *Plugin) handleCreateStickerFromURL(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		Name      string   `json:"name"`
+		URL       string   `json:"url"`
+		ChannelID string   `json:"channel_id"`
+		Tags      []string `json:"tags"`
+		Aliases   []string `json:"aliases"`
+		Scope     Scope    `json:"scope"`
+		// Visibility is public or private, public by default
+		Visibility string `json:"visibility"`
+		// OnDuplicate is reject, alias or allow
+		OnDuplicate string `json:"on_duplicate"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == "" || req.URL == "" {
+		http.Error(w, "Name and URL are required", http.StatusBadRequest)
+		return
+	}
+
+	if err := checkStickerName(req.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	onDuplicate, err := parseDuplicatePolicy(req.OnDuplicate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scope, err := p.checkScope(userID, req.Scope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	visibility, err := parseVisibility(req.Visibility)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := p.Authorize(userID, ActionCreate, Target{Scope: scope}); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	if p.IsStickerNameTaken(req.Name) {
+		http.Error(w, "Sticker name already exists", http.StatusConflict)
+		return
+	}
+
+	aliases, err := p.validateAliases(NormalizeTerms(req.Aliases), req.Name, "")
+	if err != nil {
+		writeStickerRequestError(w, err)
+		return
+	}
+
+	fileData, contentType, err := newURLFetcher(p.allowedUntrustedInternalConnections(), p.maxUploadSize()).Fetch(req.URL)
+	if errors.Is(err, ErrInvalidImage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to download image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The remote Content-Type is only a hint; the format is detected from
+	// the content, and a declared image type must agree with it
+	declared, err := declaredImageFormat(contentType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if info, err := DetectImage(fileData); err == nil && declared != "" && declared != info.Format {
+		http.Error(w, "Image content does not match its Content-Type", http.StatusBadRequest)
+		return
+	}
+
+	viewer := p.NewViewer(userID, r.URL.Query().Get("team_id"), req.ChannelID)
+	sticker, err := p.NewStickerFromImage(req.Name, fileData, "", userID, onDuplicate == duplicateAllow)
+	var duplicate *DuplicateImageError
+	if errors.As(err, &duplicate) {
+		p.writeDuplicateImage(w, r, userID, viewer, duplicate, req.Name, onDuplicate)
+		return
+	}
+	if errors.Is(err, ErrInvalidImage) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	sticker.Tags = NormalizeTerms(req.Tags)
+	sticker.Aliases = aliases
+	sticker.Scope = scope
+	sticker.Visibility = visibility
+	if err := p.SubmitSticker(sticker); err != nil {
+		http.Error(w, "Failed to save sticker: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	p.writeCreatedSticker(w, sticker, viewer)
+}
+
+// createdStickerResponse is a newly created sticker together with the
+// existing stickers it looks nearly identical to
+type createdStickerResponse struct {
+	*Sticker
+	NearDuplicates []NearDuplicate `json:"near_duplicates,omitempty"`
+	Warning        string          `json:"warning,omitempty"`
+}
+
+func (p *Plugin) writeCreatedSticker(w http.ResponseWriter, sticker *Sticker, viewer *Viewer) {
+	response := createdStickerResponse{Sticker: sticker}
+
+	nearDuplicates, err := p.FindNearDuplicates(sticker, viewer)
+	if err != nil {
+		p.API.LogWarn("Failed to look for near-duplicate stickers", "sticker_id", sticker.ID, "error", err.Error())
+	}
+	if len(nearDuplicates) > 0 {
+		response.NearDuplicates = nearDuplicates
+		response.Warning = nearDuplicateWarning(nearDuplicates)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func nearDuplicateWarning(nearDuplicates []NearDuplicate) string {
+	names := make([]string, 0, len(nearDuplicates))
+	for _, d := range nearDuplicates {
+		names = append(names, "'"+d.Sticker.Name+"'")
+	}
+	return "This image looks nearly identical to existing stickers: " + strings.Join(names, ", ")
+}
+
+// declaredImageFormat returns the normalized format of an image Content-Type,
+// or "" when the type is missing or generic
+func declaredImageFormat(contentType string) (string, error) {
+	if contentType == "" {
+		return "", nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+
+	switch {
+	case mediaType == "application/octet-stream":
+		return "", nil
+	case strings.HasPrefix(mediaType, "image/"):
+		return normalizeFormat(strings.TrimPrefix(mediaType, "image/")), nil
+	default:
+		return "", fmt.Errorf("URL does not point to an image")
+	}
+}
+
+type BulkUploadResult struct {
+	Success []string          `json:"success"`
+	Failed  map[string]string `json:"failed"`
+	// Warnings flags created stickers that look like existing ones
+	Warnings map[string]string `json:"warnings,omitempty"`
+}
+
+func (p *Plugin) handleBulkUpload(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// 32MB max for bulk upload
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	onDuplicate, err := parseDuplicatePolicy(r.FormValue("on_duplicate"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	scope, err := p.checkScope(userID, scopeFromForm(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	visibility, err := parseVisibility(r.FormValue("visibility"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := p.Authorize(userID, ActionCreate, Target{Scope: scope}); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	viewer := p.NewViewer(userID, r.FormValue("team_id"), r.FormValue("channel_id"))
+	maxSize := p.maxUploadSize()
+
+	result := BulkUploadResult{
+		Success:  []string{},
+		Failed:   make(map[string]string),
+		Warnings: make(map[string]string),
+	}
+
+	files := r.MultipartForm.File["images"]
+	if len(files) == 0 {
+		http.Error(w, "No files provided", http.StatusBadRequest)
+		return
+	}
+
+	for _, fileHeader := range files {
+		filename := fileHeader.Filename
+		ext := strings.ToLower(filepath.Ext(filename))
+		name := strings.TrimSuffix(filename, ext)
+
+		// Validate size
+		if fileHeader.Size > maxSize {
+			result.Failed[filename] = "File size exceeds limit"
+			continue
+		}
+
+		if err := checkStickerName(name); err != nil {
+			result.Failed[filename] = err.Error()
+			continue
+		}
+
+		// Check duplicate name
+		if p.IsStickerNameTaken(name) {
+			result.Failed[filename] = "Sticker name already exists"
+			continue
+		}
+
+		// Read file
+		file, err := fileHeader.Open()
+		if err != nil {
+			result.Failed[filename] = "Failed to open file"
+			continue
+		}
+
+		fileData, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			result.Failed[filename] = "Failed to read file"
+			continue
+		}
+
+		// Validate and store image
+		sticker, err := p.NewStickerFromImage(name, fileData, filename, userID, onDuplicate == duplicateAllow)
+		var duplicate *DuplicateImageError
+		if errors.As(err, &duplicate) {
+			if !viewer.CanSeeSticker(duplicate.Sticker) {
+				result.Failed[filename] = ErrHiddenDuplicateImage.Error()
+				continue
+			}
+			if onDuplicate != duplicateAlias {
+				result.Failed[filename] = duplicate.Error()
+				continue
+			}
+			if _, err := p.AuthorizeSticker(userID, ActionEdit, duplicate.Sticker.ID); err != nil {
+				result.Failed[filename] = duplicate.Error() + "; " + err.Error()
+				continue
+			}
+			if _, err := p.AddStickerAlias(duplicate.Sticker.ID, userID, name); err != nil {
+				result.Failed[filename] = err.Error()
+				continue
+			}
+			result.Success = append(result.Success, name)
+			continue
+		}
+		if errors.Is(err, ErrInvalidImage) {
+			result.Failed[filename] = err.Error()
+			continue
+		}
+		if err != nil {
+			result.Failed[filename] = "Failed to save: " + err.Error()
+			continue
+		}
+
+		// Save sticker metadata
+		sticker.Scope = scope
+		sticker.Visibility = visibility
+		if err := p.SubmitSticker(sticker); err != nil {
+			result.Failed[filename] = "Failed to save: " + err.Error()
+			continue
+		}
+
+		if nearDuplicates, err := p.FindNearDuplicates(sticker, viewer); err == nil && len(nearDuplicates) > 0 {
+			result.Warnings[filename] = nearDuplicateWarning(nearDuplicates)
+		}
+
+		result.Success = append(result.Success, name)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if len(result.Failed) > 0 && len(result.Success) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if len(result.Failed) > 0 {
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func (p *Plugin) handleSendSticker(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		ChannelID string `json:"channel_id"`
+		StickerID string `json:"sticker_id"`
+		RootID    string `json:"root_id,omitempty"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.ChannelID == "" || req.StickerID == "" {
+		http.Error(w, "channel_id and sticker_id are required", http.StatusBadRequest)
+		return
+	}
+
+	sticker, err := p.GetLiveSticker(req.StickerID)
+	if err != nil {
+		http.Error(w, "Sticker not found", http.StatusNotFound)
+		return
+	}
+
+	createdPost, err := p.SendSticker(userID, req.ChannelID, req.RootID, sticker)
+	if errors.Is(err, ErrNoChannelAccess) {
+		http.Error(w, "You don't have access to this channel", http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, ErrOutOfScope) || errors.Is(err, ErrPrivateSticker) || errors.Is(err, ErrStickerPending) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to send sticker: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(createdPost)
 }
+
+// Policies for uploads whose image is identical to an existing sticker's
+const (
+	duplicateReject = "reject"
+	duplicateAlias  = "alias"
+	duplicateAllow  = "allow"
+)
+
+func parseDuplicatePolicy(value string) (string, error) {
+	switch value {
+	case "", duplicateReject:
+		return duplicateReject, nil
+	case duplicateAlias, duplicateAllow:
+		return value, nil
+	default:
+		return "", fmt.Errorf("on_duplicate must be one of %s, %s or %s", duplicateReject, duplicateAlias, duplicateAllow)
+	}
+}
+
+// writeDuplicateImage answers a create request whose image already exists,
+// either with a conflict naming the existing sticker or, for the alias
+// policy, by adding the requested name as an alias of that sticker. A sticker
+// the viewer cannot see is neither named nor aliased.
+func (p *Plugin) writeDuplicateImage(w http.ResponseWriter, r *http.Request, userID string, viewer *Viewer, duplicate *DuplicateImageError, name, policy string) {
+	if !viewer.CanSeeSticker(duplicate.Sticker) {
+		http.Error(w, fmt.Sprintf("%s; set on_duplicate to %s to use it anyway", ErrHiddenDuplicateImage.Error(), duplicateAllow), http.StatusConflict)
+		return
+	}
+
+	if policy != duplicateAlias {
+		http.Error(w, fmt.Sprintf("%s (id %s); set on_duplicate to %s to add '%s' as its alias instead",
+			duplicate.Error(), duplicate.Sticker.ID, duplicateAlias, name), http.StatusConflict)
+		return
+	}
+
+	if !p.checkStickerEditPermission(w, r, userID, duplicate.Sticker.ID) {
+		return
+	}
+
+	sticker, err := p.AddStickerAlias(duplicate.Sticker.ID, userID, name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sticker)
+}
+
+// validateAliases drops aliases equal to the sticker's own name and rejects
+// reserved aliases and aliases already used as the name or alias of another
+// sticker
+func (p *Plugin) validateAliases(aliases []string, name, stickerID string) ([]string, error) {
+	result := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		if alias == strings.ToLower(strings.TrimSpace(name)) {
+			continue
+		}
+		if err := checkStickerName(alias); err != nil {
+			return nil, fmt.Errorf("alias %w", err)
+		}
+		if p.isStickerNameTakenBy(alias, stickerID) {
+			return nil, fmt.Errorf("alias '%s' is %w", alias, ErrNameTaken)
+		}
+		result = append(result, alias)
+	}
+	return result, nil
+}
+
+// checkStickerVisible writes a not found response and returns false unless
+// the user can see the sticker from the team or channel in the request.
+// Creators always see their own stickers and moderators see those awaiting
+// approval or with an edit awaiting approval. The image of a private sticker
+// is also shown to members of a channel its creator sent it to, when the
+// request names that post.
+func (p *Plugin) checkStickerVisible(w http.ResponseWriter, r *http.Request, userID string, sticker *Sticker, image bool) bool {
+	viewer := p.viewerFromRequest(r, userID)
+
+	visible := viewer.CanSeeSticker(sticker) || sticker.CreatorID == userID
+	if !visible && (sticker.IsPending() || sticker.PendingRevision != nil) {
+		visible = p.Authorize(userID, ActionModerate, Target{}) == nil
+	}
+	if !visible && image && sticker.IsApproved() && sticker.IsPrivate() {
+		visible = p.isStickerPostVisible(userID, r.URL.Query().Get("post_id"), sticker)
+	}
+
+	if !visible {
+		http.Error(w, "sticker not found", http.StatusNotFound)
+	}
+	return visible
+}
+
+// isStickerPostVisible reports whether postID is a sticker post of the
+// sticker by its creator, in a channel within the sticker's scope that the
+// user belongs to
+func (p *Plugin) isStickerPostVisible(userID, postID string, sticker *Sticker) bool {
+	if postID == "" {
+		return false
+	}
+
+	post, appErr := p.API.GetPost(postID)
+	if appErr != nil || post.DeleteAt != 0 {
+		return false
+	}
+	// Anyone can post custom props, but only the creator can send a private
+	// sticker
+	if post.Type != stickerPostType || post.UserId != sticker.CreatorID || post.GetProp("sticker_id") != sticker.ID {
+		return false
+	}
+
+	viewer := p.NewViewer(userID, "", post.ChannelId)
+	return viewer.ChannelID != "" && viewer.CanSee(sticker.Scope)
+}
+
+// checkStickerEditPermission writes an error response and returns false
+// unless the user may edit the sticker
+func (p *Plugin) checkStickerEditPermission(w http.ResponseWriter, r *http.Request, userID, stickerID string) bool {
+	if _, err := p.AuthorizeSticker(userID, ActionEdit, stickerID); err != nil {
+		writePermissionError(w, err)
+		return false
+	}
+
+	return true
+}
+
+func (p *Plugin) handleSetStickerTags(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	stickerID := mux.Vars(r)["id"]
+	if !p.checkStickerEditPermission(w, r, userID, stickerID) {
+		return
+	}
+
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	sticker, err := p.EditSticker(stickerID, userID, versionActionUpdate, func(sticker *Sticker) error {
+		sticker.Tags = NormalizeTerms(req.Tags)
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to update sticker: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sticker)
+}
+
+func (p *Plugin) handleSetStickerAliases(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	stickerID := mux.Vars(r)["id"]
+	if !p.checkStickerEditPermission(w, r, userID, stickerID) {
+		return
+	}
+
+	var req struct {
+		Aliases []string `json:"aliases"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var validationErr error
+	sticker, err := p.EditSticker(stickerID, userID, versionActionUpdate, func(sticker *Sticker) error {
+		sticker.Aliases, validationErr = p.validateAliases(NormalizeTerms(req.Aliases), sticker.Name, sticker.ID)
+		return validationErr
+	})
+	if validationErr != nil {
+		writeStickerRequestError(w, validationErr)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update sticker: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sticker)
+}
+
+func (p *Plugin) handleGetStickerVersions(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	stickerID := mux.Vars(r)["id"]
+	sticker, err := p.GetSticker(stickerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if !p.checkStickerVisible(w, r, userID, sticker, false) {
+		return
+	}
+
+	versions, err := p.GetStickerVersions(stickerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&StickerVersionList{
+		StickerID: stickerID,
+		Versions:  versions,
+		Total:     len(versions),
+	})
+}
+
+func (p *Plugin) handleRollbackSticker(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	stickerID := vars["id"]
+	if !p.checkStickerEditPermission(w, r, userID, stickerID) {
+		return
+	}
+
+	version, err := strconv.Atoi(vars["version"])
+	if err != nil {
+		http.Error(w, "Invalid version", http.StatusBadRequest)
+		return
+	}
+
+	sticker, err := p.RollbackSticker(stickerID, userID, version)
+	if errors.Is(err, ErrVersionNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrCannotRollback) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, ErrPermissionDenied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to roll back sticker: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sticker)
+}
+
+// handleGetPendingStickers lists the stickers awaiting approval: all of them
+// for moderators and the user's own uploads for everyone else
+func (p *Plugin) handleGetPendingStickers(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	all := p.Authorize(userID, ActionModerate, Target{}) == nil
+	list, err := p.GetPendingStickers(userID, all)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (p *Plugin) handleApproveSticker(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := p.Authorize(userID, ActionModerate, Target{}); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	sticker, err := p.ApproveSticker(mux.Vars(r)["id"], userID)
+	if errors.Is(err, ErrStickerNotPending) || errors.Is(err, ErrStickerTrashed) || errors.Is(err, ErrNameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sticker)
+}
+
+func (p *Plugin) handleRejectSticker(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := p.Authorize(userID, ActionModerate, Target{}); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	// The body is optional; a reason is passed on to the creator
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := p.RejectSticker(mux.Vars(r)["id"], userID, strings.TrimSpace(req.Reason))
+	if errors.Is(err, ErrStickerNotPending) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleModerationAction receives the approve and reject buttons of the
+// moderator notifications. The outcome replaces the buttons on every
+// moderator's notification, so only errors are answered here.
+func (p *Plugin) handleModerationAction(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req model.PostActionIntegrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	action, _ := req.Context["action"].(string)
+	stickerID, _ := req.Context["sticker_id"].(string)
+
+	var err error
+	if err = p.Authorize(userID, ActionModerate, Target{}); err == nil {
+		switch action {
+		case moderationActionApprove:
+			_, err = p.ApproveSticker(stickerID, userID)
+		case moderationActionReject:
+			err = p.RejectSticker(stickerID, userID, "")
+		default:
+			err = fmt.Errorf("unknown moderation action '%s'", action)
+		}
+	}
+
+	response := &model.PostActionIntegrationResponse{}
+	if err != nil {
+		response.EphemeralText = "Could not moderate the sticker: " + err.Error()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+type packRequest struct {
+	Name           *string   `json:"name"`
+	Description    *string   `json:"description"`
+	CoverStickerID *string   `json:"cover_sticker_id"`
+	Scope          *Scope    `json:"scope"`
+	StickerIDs     *[]string `json:"sticker_ids"`
+}
+
+// StickerPackWithStickers is a pack together with its resolved stickers
+type StickerPackWithStickers struct {
+	*StickerPack
+	Stickers []*Sticker `json:"stickers"`
+}
+
+// checkPackSticker checks that the viewer may add a sticker to a pack: it
+// must be approved and visible to them
+func checkPackSticker(sticker *Sticker, viewer *Viewer) error {
+	if sticker.IsPending() && viewer != nil && sticker.CreatorID == viewer.UserID {
+		return fmt.Errorf("sticker '%s': %w", sticker.Name, ErrStickerPending)
+	}
+	if !viewer.CanSeeSticker(sticker) {
+		return fmt.Errorf("sticker '%s' not found", sticker.ID)
+	}
+	return nil
+}
+
+// validatePackStickers checks that every sticker exists and drops duplicates
+// while keeping the requested order. Stickers new to the pack must also pass
+// checkPackSticker for the viewer.
+func (p *Plugin) validatePackStickers(pack *StickerPack, ids []string, viewer *Viewer) ([]string, error) {
+	seen := make(map[string]bool, len(ids))
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		sticker, err := p.GetLiveSticker(id)
+		if err != nil {
+			return nil, fmt.Errorf("sticker '%s' not found", id)
+		}
+		if !pack.HasSticker(id) {
+			if err := checkPackSticker(sticker, viewer); err != nil {
+				return nil, err
+			}
+		}
+		seen[id] = true
+		result = append(result, id)
+	}
+	return result, nil
+}
+
+// applyPackRequest validates the fields set in req and copies them to pack.
+// Stickers are added as seen by the viewer.
+func (p *Plugin) applyPackRequest(pack *StickerPack, req *packRequest, viewer *Viewer) error {
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return fmt.Errorf("name is required")
+		}
+		if !strings.EqualFold(name, pack.Name) && p.IsPackNameTaken(name) {
+			return fmt.Errorf("pack name already exists")
+		}
+		pack.Name = name
+	}
+
+	// The caller checks a new scope with checkScope, which needs the user
+	if req.Scope != nil {
+		pack.Scope = *req.Scope
+	}
+
+	if req.Description != nil {
+		pack.Description = *req.Description
+	}
+
+	if req.StickerIDs != nil {
+		ids, err := p.validatePackStickers(pack, *req.StickerIDs, viewer)
+		if err != nil {
+			return err
+		}
+		pack.StickerIDs = ids
+	}
+
+	if req.CoverStickerID != nil {
+		if *req.CoverStickerID != "" && !pack.HasSticker(*req.CoverStickerID) {
+			return fmt.Errorf("cover sticker must be part of the pack")
+		}
+		pack.CoverStickerID = *req.CoverStickerID
+	} else if pack.CoverStickerID != "" && !pack.HasSticker(pack.CoverStickerID) {
+		pack.CoverStickerID = ""
+	}
+
+	return nil
+}
+
+func (p *Plugin) handleGetPacks(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	list, err := p.GetAllPacks(p.viewerFromRequest(r, userID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (p *Plugin) handleCreatePack(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req packRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Name == nil || strings.TrimSpace(*req.Name) == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+
+	// Check the name as it is stored, like applyPackRequest does
+	name := strings.TrimSpace(*req.Name)
+	req.Name = &name
+	if p.IsPackNameTaken(name) {
+		http.Error(w, "Pack name already exists", http.StatusConflict)
+		return
+	}
+
+	var scope Scope
+	if req.Scope != nil {
+		scope = *req.Scope
+	}
+	scope, err := p.checkScope(userID, scope)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Scope = &scope
+
+	if err := p.Authorize(userID, ActionCreate, Target{Scope: scope}); err != nil {
+		writePermissionError(w, err)
+		return
+	}
+
+	pack := NewStickerPack("", "", userID)
+	if err := p.applyPackRequest(pack, &req, p.viewerFromRequest(r, userID)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := p.SavePack(pack); err != nil {
+		http.Error(w, "Failed to save pack: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(pack)
+}
+
+func (p *Plugin) handleGetPack(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	viewer := p.viewerFromRequest(r, userID)
+	pack, err := p.GetPack(mux.Vars(r)["id"])
+	if err != nil || !viewer.CanSee(pack.Scope) {
+		http.Error(w, "pack not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StickerPackWithStickers{
+		StickerPack: pack,
+		Stickers:    p.GetPackStickers(pack, viewer).Stickers,
+	})
+}
+
+// checkPackPermission writes an error response and returns false unless the
+// user may modify the pack
+func (p *Plugin) checkPackPermission(w http.ResponseWriter, r *http.Request, userID, packID string) bool {
+	if _, err := p.AuthorizePack(userID, packID); err != nil {
+		writePermissionError(w, err)
+		return false
+	}
+
+	return true
+}
+
+func (p *Plugin) handleUpdatePack(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	packID := mux.Vars(r)["id"]
+	if !p.checkPackPermission(w, r, userID, packID) {
+		return
+	}
+
+	var req packRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if req.Scope != nil {
+		scope, err := p.checkScope(userID, *req.Scope)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		current, err := p.GetPack(packID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err := p.AuthorizeScopeChange(userID, current.Scope, scope); err != nil {
+			writePermissionError(w, err)
+			return
+		}
+		req.Scope = &scope
+	}
+
+	viewer := p.viewerFromRequest(r, userID)
+	var validationErr error
+	pack, err := p.UpdatePack(packID, func(pack *StickerPack) error {
+		validationErr = p.applyPackRequest(pack, &req, viewer)
+		return validationErr
+	})
+	if validationErr != nil {
+		http.Error(w, validationErr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to update pack: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pack)
+}
+
+func (p *Plugin) handleDeletePack(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	packID := mux.Vars(r)["id"]
+	if !p.checkPackPermission(w, r, userID, packID) {
+		return
+	}
+
+	if err := p.DeletePack(packID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *Plugin) handleAddStickerToPack(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	packID := mux.Vars(r)["id"]
+	if !p.checkPackPermission(w, r, userID, packID) {
+		return
+	}
+
+	var req struct {
+		StickerID string `json:"sticker_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.StickerID == "" {
+		http.Error(w, "sticker_id is required", http.StatusBadRequest)
+		return
+	}
+
+	sticker, err := p.GetLiveSticker(req.StickerID)
+	if err != nil {
+		http.Error(w, "Sticker not found", http.StatusNotFound)
+		return
+	}
+	if err := checkPackSticker(sticker, p.viewerFromRequest(r, userID)); err != nil {
+		if errors.Is(err, ErrStickerPending) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "Sticker not found", http.StatusNotFound)
+		return
+	}
+
+	pack, err := p.UpdatePack(packID, func(pack *StickerPack) error {
+		if !pack.HasSticker(req.StickerID) {
+			pack.StickerIDs = append(pack.StickerIDs, req.StickerID)
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to update pack: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pack)
+}
+
+func (p *Plugin) handleRemoveStickerFromPack(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	packID := vars["id"]
+	if !p.checkPackPermission(w, r, userID, packID) {
+		return
+	}
+
+	pack, err := p.UpdatePack(packID, func(pack *StickerPack) error {
+		pack.RemoveSticker(vars["sticker_id"])
+		return nil
+	})
+	if err != nil {
+		http.Error(w, "Failed to update pack: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pack)
+}
+
+// requireSystemAdmin writes an error response and returns false unless the
+// request comes from a system admin
+func (p *Plugin) requireSystemAdmin(w http.ResponseWriter, r *http.Request) bool {
+	userID := r.Header.Get("Mattermost-User-Id")
+	if userID == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	if err := p.Authorize(userID, ActionAdminister, Target{}); err != nil {
+		writePermissionError(w, err)
+		return false
+	}
+
+	return true
+}
+
+// handleFsck reports sticker index inconsistencies; POST also repairs them
+func (p *Plugin) handleFsck(w http.ResponseWriter, r *http.Request) {
+	if !p.requireSystemAdmin(w, r) {
+		return
+	}
+
+	report, err := p.CheckStickerConsistency(r.Method == http.MethodPost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleImageGC lists orphan images as a dry run; POST deletes them
+func (p *Plugin) handleImageGC(w http.ResponseWriter, r *http.Request) {
+	if !p.requireSystemAdmin(w, r) {
+		return
+	}
+
+	report, err := p.CollectOrphanImages(r.Method != http.MethodPost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleDuplicates lists clusters of near-identical stickers; POST first
+// hashes stickers uploaded before perceptual hashing existed
+func (p *Plugin) handleDuplicates(w http.ResponseWriter, r *http.Request) {
+	if !p.requireSystemAdmin(w, r) {
+		return
+	}
+
+	distance := nearDuplicateDistance
+	if v := r.URL.Query().Get("distance"); v != "" {
+		var err error
+		distance, err = strconv.Atoi(v)
+		if err != nil || distance < 0 || distance > maxNearDuplicateDistance {
+			http.Error(w, fmt.Sprintf("distance must be between 0 and %d", maxNearDuplicateDistance), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := p.FindDuplicateClusters(distance, r.Method == http.MethodPost)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func newTestRouter(p *Plugin) {
+	p.router = mux.NewRouter()
+	p.initAPI()
+}
+
+func TestUpdateStickerStatus(t *testing.T) {
+	api := newFakeAPI()
+	api.addUser("creator", "system_user")
+	p := newTestPlugin(api, &configuration{})
+	newTestRouter(p)
+
+	wave := NewSticker("wave", "", "wave.png", "creator")
+	saveTestSticker(t, p, wave)
+	taken := NewSticker("hello", "", "hello.png", "creator")
+	taken.Aliases = []string{"hi"}
+	saveTestSticker(t, p, taken)
+
+	pack := NewStickerPack("greetings", "", "creator")
+	if err := p.SavePack(pack); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "empty name", body: `{"name": " "}`, want: http.StatusBadRequest},
+		{name: "unknown visibility", body: `{"visibility": "secret"}`, want: http.StatusBadRequest},
+		{name: "reserved name", body: `{"name": "List"}`, want: http.StatusBadRequest},
+		{name: "reserved alias", body: `{"aliases": ["help"]}`, want: http.StatusBadRequest},
+		{name: "taken name", body: `{"name": "hello"}`, want: http.StatusConflict},
+		{name: "taken alias", body: `{"aliases": ["hi"]}`, want: http.StatusConflict},
+		{name: "taken name with packs", body: `{"name": "hello", "pack_ids": ["` + pack.ID + `"]}`, want: http.StatusConflict},
+		{name: "valid", body: `{"description": "waving"}`, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPatch, "/api/v1/stickers/"+wave.ID, bytes.NewBufferString(tt.body))
+			r.Header.Set("Mattermost-User-Id", "creator")
+			w := httptest.NewRecorder()
+			p.ServeHTTP(nil, w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+		})
+	}
+
+	// The rejected edit left the packs as they were
+	got, err := p.GetPack(pack.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.HasSticker(wave.ID) {
+		t.Error("sticker added to a pack by a rejected edit")
+	}
+}
+
+func TestRestoreUnderReservedName(t *testing.T) {
+	api := newFakeAPI()
+	api.addUser("creator", "system_user")
+	p := newTestPlugin(api, &configuration{})
+
+	sticker := NewSticker("wave", "", "wave.png", "creator")
+	saveTestSticker(t, p, sticker)
+	if _, err := p.TrashSticker(sticker.ID, "creator"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.RestoreSticker(sticker.ID, "creator", "pack"); !errors.Is(err, ErrNameReserved) {
+		t.Fatalf("restore returned %v", err)
+	}
+	restored, err := p.RestoreSticker(sticker.ID, "creator", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Name != "wave" {
+		t.Errorf("restored as %q", restored.Name)
+	}
+}
+
+func TestCreatePackTrimsNameBeforeCheck(t *testing.T) {
+	api := newFakeAPI()
+	api.addUser("creator", "system_user")
+	p := newTestPlugin(api, &configuration{})
+	newTestRouter(p)
+
+	if err := p.SavePack(NewStickerPack("greetings", "", "creator")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/packs", bytes.NewBufferString(`{"name": " greetings "}`))
+	r.Header.Set("Mattermost-User-Id", "creator")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(nil, w, r)
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusConflict, w.Body.String())
+	}
+}
+
+func TestPrivateStickerImageNeedsItsPost(t *testing.T) {
+	api := newFakeAPI()
+	api.addChannel("channel1", "team1")
+	api.addChannel("channel2", "team1")
+	for _, userID := range []string{"creator", "member"} {
+		api.addUser(userID, "system_user")
+		api.addTeamMember("team1", userID, "team_user")
+		api.addChannelMember("channel1", userID, "channel_user")
+		api.addChannelMember("channel2", userID, "channel_user")
+	}
+	api.addUser("outsider", "system_user")
+	api.addTeamMember("team1", "outsider", "team_user")
+	p := newTestPlugin(api, &configuration{})
+
+	sticker := NewSticker("secret", "", "secret.png", "creator")
+	sticker.Scope = Scope{Type: ScopeTeam, ID: "team1"}
+	sticker.Visibility = VisibilityPrivate
+	saveTestSticker(t, p, sticker)
+
+	for id, post := range map[string]*model.Post{
+		"sent":   {UserId: "creator", ChannelId: "channel1", Type: stickerPostType},
+		"forged": {UserId: "member", ChannelId: "channel2", Type: stickerPostType},
+	} {
+		post.Id = id
+		post.AddProp("sticker_id", sticker.ID)
+		api.posts[id] = post
+	}
+
+	tests := []struct {
+		name   string
+		userID string
+		query  string
+		want   bool
+	}{
+		{name: "creator", userID: "creator", query: "channel_id=channel2", want: true},
+		{name: "channel in scope", userID: "member", query: "channel_id=channel1"},
+		{name: "post by the creator", userID: "member", query: "channel_id=channel1&post_id=sent", want: true},
+		{name: "post by someone else", userID: "member", query: "channel_id=channel2&post_id=forged"},
+		{name: "post in another channel", userID: "outsider", query: "post_id=sent"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/stickers/"+sticker.ID+"/image?"+tt.query, nil)
+			w := httptest.NewRecorder()
+			if got := p.checkStickerVisible(w, r, tt.userID, sticker, true); got != tt.want {
+				t.Errorf("visible %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+const (
+	clusterEventStickerChanged = "sticker_changed"
+	clusterEventIndexChanged   = "stickers_index_changed"
+	clusterEventStickersReset  = "stickers_reset"
+)
+
+// stickerCache keeps sticker metadata and a name/alias to ID map in memory so
+// that listing and name lookups do not hit the KV store. Entries are
+// invalidated locally and on every other node whenever a sticker changes,
+// and the index whenever stickers are added to or removed from it.
+//
+// Stickers handed out by the cache are shared and must not be modified.
+type stickerCache struct {
+	mu sync.Mutex
+
+	// ids mirrors the KV index; indexStale forces it to be reloaded
+	ids        []string
+	indexStale bool
+
+	stickers map[string]*Sticker
+	byName   map[string]string
+
+	// replaced keeps invalidated stickers until they are reloaded, so that
+	// byName is only rebuilt when their name or aliases changed
+	replaced map[string]*Sticker
+}
+
+func newStickerCache() *stickerCache {
+	return &stickerCache{
+		indexStale: true,
+		stickers:   map[string]*Sticker{},
+		replaced:   map[string]*Sticker{},
+	}
+}
+
+// reset drops everything so the next read reloads from the KV store
+func (c *stickerCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ids = nil
+	c.indexStale = true
+	c.stickers = map[string]*Sticker{}
+	c.byName = nil
+	c.replaced = map[string]*Sticker{}
+}
+
+// invalidate drops one sticker so that it is reloaded on the next read
+func (c *stickerCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sticker, ok := c.stickers[id]; ok {
+		c.replaced[id] = sticker
+		delete(c.stickers, id)
+	}
+}
+
+// invalidateIndex forces the index and the name map to be reloaded, for
+// stickers added to or removed from the index
+func (c *stickerCache) invalidateIndex() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.indexStale = true
+	c.byName = nil
+}
+
+// load returns the indexed stickers in index order, fetching the index and
+// any records missing from the cache
+func (c *stickerCache) load(api plugin.API) ([]*Sticker, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.indexStale {
+		data, appErr := api.KVGet(stickersKey)
+		if appErr != nil {
+			return nil, fmt.Errorf("failed to get stickers: %w", appErr)
+		}
+
+		var ids []string
+		if data != nil {
+			if err := json.Unmarshal(data, &ids); err != nil {
+				return nil, fmt.Errorf("failed to unmarshal sticker IDs: %w", err)
+			}
+		}
+
+		c.ids = ids
+		c.indexStale = false
+		c.byName = nil
+	}
+
+	stickers := make([]*Sticker, 0, len(c.ids))
+	for _, id := range c.ids {
+		sticker, ok := c.stickers[id]
+		if !ok {
+			var err error
+			sticker, err = fetchSticker(api, id)
+			if err != nil {
+				api.LogWarn("Skipping indexed sticker without a record; run /sticker admin fsck to repair", "sticker_id", id, "error", err.Error())
+				continue
+			}
+			c.stickers[id] = sticker
+			if previous, ok := c.replaced[id]; !ok || !sameNames(previous, sticker) {
+				c.byName = nil
+			}
+			delete(c.replaced, id)
+		}
+		stickers = append(stickers, sticker)
+	}
+
+	if c.byName == nil {
+		c.byName = make(map[string]string, len(stickers))
+		for i := len(stickers) - 1; i >= 0; i-- {
+			s := stickers[i]
+			for _, alias := range s.Aliases {
+				c.byName[alias] = s.ID
+			}
+		}
+		// Names win over aliases, and earlier stickers over later ones
+		for i := len(stickers) - 1; i >= 0; i-- {
+			c.byName[normalizeName(stickers[i].Name)] = stickers[i].ID
+		}
+	}
+
+	return stickers, nil
+}
+
+// sameNames reports whether two versions of a sticker resolve from the same
+// name and aliases
+func sameNames(a, b *Sticker) bool {
+	return normalizeName(a.Name) == normalizeName(b.Name) && slices.Equal(a.Aliases, b.Aliases)
+}
+
+// get returns a cached sticker, if present
+func (c *stickerCache) get(id string) (*Sticker, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sticker, ok := c.stickers[id]
+	return sticker, ok
+}
+
+// lookup resolves a normalized name or alias to a sticker ID
+func (c *stickerCache) lookup(api plugin.API, name string) (*Sticker, error) {
+	if _, err := c.load(api); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	id, ok := c.byName[name]
+	if !ok {
+		return nil, nil
+	}
+	return c.stickers[id], nil
+}
+
+// notifyStickerChanged invalidates a sticker in this node's cache and on every
+// other node of the cluster
+func (p *Plugin) notifyStickerChanged(id string) {
+	p.stickerCache.invalidate(id)
+
+	if err := p.API.PublishPluginClusterEvent(
+		model.PluginClusterEvent{Id: clusterEventStickerChanged, Data: []byte(id)},
+		model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable},
+	); err != nil {
+		p.API.LogWarn("Failed to publish sticker cache invalidation", "sticker_id", id, "error", err.Error())
+	}
+}
+
+// notifyIndexChanged reloads the sticker index on this node and on every
+// other node of the cluster
+func (p *Plugin) notifyIndexChanged() {
+	p.stickerCache.invalidateIndex()
+
+	if err := p.API.PublishPluginClusterEvent(
+		model.PluginClusterEvent{Id: clusterEventIndexChanged},
+		model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable},
+	); err != nil {
+		p.API.LogWarn("Failed to publish sticker index invalidation", "error", err.Error())
+	}
+}
+
+// notifyStickersReset drops this node's cache and every other node's cache,
+// for bulk changes such as index repairs
+func (p *Plugin) notifyStickersReset() {
+	p.stickerCache.reset()
+
+	if err := p.API.PublishPluginClusterEvent(
+		model.PluginClusterEvent{Id: clusterEventStickersReset},
+		model.PluginClusterEventSendOptions{SendType: model.PluginClusterEventSendTypeReliable},
+	); err != nil {
+		p.API.LogWarn("Failed to publish sticker cache reset", "error", err.Error())
+	}
+}
+
+func (p *Plugin) OnPluginClusterEvent(c *plugin.Context, ev model.PluginClusterEvent) {
+	switch ev.Id {
+	case clusterEventStickerChanged:
+		p.stickerCache.invalidate(string(ev.Data))
+	case clusterEventIndexChanged:
+		p.stickerCache.invalidateIndex()
+	case clusterEventStickersReset:
+		p.stickerCache.reset()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestStickerCacheNames(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{})
+
+	sticker := NewSticker("wave", "", "wave.png", "creator")
+	saveTestSticker(t, p, sticker)
+
+	if got, err := p.GetStickerByName("wave", nil); err != nil || got.ID != sticker.ID {
+		t.Fatalf("lookup by name: %v, %v", got, err)
+	}
+
+	if _, err := p.UpdateSticker(sticker.ID, func(s *Sticker) error {
+		s.Description = "hello"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if p.stickerCache.byName == nil {
+		t.Error("editing the description dropped the name map")
+	}
+	if got, err := p.GetStickerByName("wave", nil); err != nil || got.Description != "hello" {
+		t.Fatalf("lookup after edit: %v, %v", got, err)
+	}
+
+	if _, err := p.UpdateSticker(sticker.ID, func(s *Sticker) error {
+		s.Name = "hi"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetStickerByName("wave", nil); err == nil {
+		t.Error("old name still resolves after a rename")
+	}
+	if got, err := p.GetStickerByName("hi", nil); err != nil || got.ID != sticker.ID {
+		t.Fatalf("lookup by new name: %v, %v", got, err)
+	}
+
+	added := NewSticker("bye", "", "bye.png", "creator")
+	saveTestSticker(t, p, added)
+	if got, err := p.GetStickerByName("bye", nil); err != nil || got.ID != added.ID {
+		t.Fatalf("lookup of a new sticker: %v, %v", got, err)
+	}
+}
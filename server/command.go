@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
@@ -14,29 +16,54 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		return p.showHelp(), nil
 	}
 
+	// Stickers and packs are looked up as seen from where the command runs
+	viewer := p.NewViewer(args.UserId, args.TeamId, args.ChannelId)
+
 	if len(parts) == 1 {
-		return p.listStickers()
+		return p.listStickers(viewer)
 	}
 
 	subcommand := parts[1]
 
 	switch subcommand {
 	case "list":
-		return p.listStickers()
+		return p.listStickers(viewer)
 	case "add":
 		if len(parts) < 3 {
 			return p.respondEphemeral("Usage: /sticker add [name] (attach an image to the message)"), nil
 		}
-		return p.addStickerHelp(parts[2])
+		return p.addStickerHelp(args.UserId, parts[2], viewer)
 	case "delete":
 		if len(parts) < 3 {
 			return p.respondEphemeral("Usage: /sticker delete [name]"), nil
 		}
-		return p.deleteSticker(args.UserId, parts[2])
+		return p.deleteSticker(args.UserId, parts[2], viewer)
+	case "trash":
+		return p.listTrash(args.UserId)
+	case "pending":
+		return p.listPending(args.UserId)
+	case "restore":
+		if len(parts) < 3 {
+			return p.respondEphemeral("Usage: /sticker restore [name] [new name]"), nil
+		}
+		newName := ""
+		if len(parts) > 3 {
+			newName = parts[3]
+		}
+		return p.restoreSticker(args.UserId, parts[2], newName)
+	case "rename":
+		if len(parts) < 4 {
+			return p.respondEphemeral("Usage: /sticker rename [old name] [new name]"), nil
+		}
+		return p.renameSticker(args.UserId, parts[2], parts[3], viewer)
+	case "pack":
+		return p.executePackCommand(args.UserId, parts[2:], viewer)
+	case "admin":
+		return p.executeAdminCommand(args.UserId, parts[2:])
 	case "help":
 		return p.showHelp(), nil
 	default:
-		return p.sendSticker(args.ChannelId, args.UserId, args.RootId, subcommand)
+		return p.sendSticker(args.ChannelId, args.UserId, args.RootId, subcommand, viewer)
 	}
 }
 
@@ -48,7 +75,20 @@ func (p *Plugin) showHelp() *model.CommandResponse {
 | /sticker [name] | Send a sticker |
 | /sticker list | Show all available stickers |
 | /sticker add [name] | Instructions to add a new sticker |
-| /sticker delete [name] | Delete your sticker |
+| /sticker delete [name] | Move your sticker to the trash |
+| /sticker trash | Show your deleted stickers |
+| /sticker pending | Show stickers awaiting moderator approval |
+| /sticker restore [name] [new name] | Restore a sticker from the trash, optionally under a new name |
+| /sticker rename [old] [new] | Rename your sticker; posts that use it keep working |
+| /sticker pack list | Show all sticker packs |
+| /sticker pack show [pack] | Show the stickers in a pack |
+| /sticker pack create [pack] [description] | Create a sticker pack |
+| /sticker pack add [pack] [sticker] | Add a sticker to your pack |
+| /sticker pack remove [pack] [sticker] | Remove a sticker from your pack |
+| /sticker pack delete [pack] | Delete your pack |
+| /sticker admin fsck [repair] | Check (and repair) sticker storage consistency (system admin) |
+| /sticker admin gc [run] | List (or delete) unreferenced sticker images (system admin) |
+| /sticker admin duplicates [backfill] | List near-identical stickers, hashing older ones first with backfill (system admin) |
 | /sticker help | Show this help message |
 
 **Tip**: Use the sticker picker button in the message input area for a visual selection!`
@@ -56,8 +96,8 @@ func (p *Plugin) showHelp() *model.CommandResponse {
 	return p.respondEphemeral(helpText)
 }
 
-func (p *Plugin) listStickers() (*model.CommandResponse, error) {
-	list, err := p.GetAllStickers()
+func (p *Plugin) listStickers(viewer *Viewer) (*model.CommandResponse, error) {
+	list, err := p.GetAllStickers(viewer)
 	if err != nil {
 		return p.respondEphemeral("Failed to get stickers: " + err.Error()), nil
 	}
@@ -78,21 +118,28 @@ func (p *Plugin) listStickers() (*model.CommandResponse, error) {
 	return p.respondEphemeral(sb.String()), nil
 }
 
-func (p *Plugin) sendSticker(channelID, userID, rootID, name string) (*model.CommandResponse, error) {
-	sticker, err := p.GetStickerByName(name)
+func (p *Plugin) sendSticker(channelID, userID, rootID, name string, viewer *Viewer) (*model.CommandResponse, error) {
+	sticker, err := p.GetStickerByName(name, viewer)
 	if err != nil {
 		return p.respondEphemeral(fmt.Sprintf("Sticker '%s' not found. Use `/sticker list` to see available stickers.", name)), nil
 	}
 
-	_, err = p.CreateStickerPost(channelID, userID, sticker.ID, rootID)
-	if err != nil {
+	if _, err := p.SendSticker(userID, channelID, rootID, sticker); err != nil {
 		return p.respondEphemeral("Failed to send sticker: " + err.Error()), nil
 	}
 
 	return &model.CommandResponse{}, nil
 }
 
-func (p *Plugin) addStickerHelp(name string) (*model.CommandResponse, error) {
+func (p *Plugin) addStickerHelp(userID, name string, viewer *Viewer) (*model.CommandResponse, error) {
+	if err := p.Authorize(userID, ActionCreate, Target{Scope: Scope{Type: ScopeServer}}); err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Cannot add sticker: %s.", err.Error())), nil
+	}
+
+	if err := checkStickerName(name); err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Cannot add sticker: %s. Please choose a different name.", err.Error())), nil
+	}
+
 	if p.IsStickerNameTaken(name) {
 		return p.respondEphemeral(fmt.Sprintf("Sticker name '%s' is already taken. Please choose a different name.", name)), nil
 	}
@@ -113,26 +160,427 @@ Maximum size: %d KB`, name, name, p.getConfiguration().AllowedFormats, p.getConf
 	return p.respondEphemeral(helpText), nil
 }
 
-func (p *Plugin) deleteSticker(userID, name string) (*model.CommandResponse, error) {
-	sticker, err := p.GetStickerByName(name)
+func (p *Plugin) deleteSticker(userID, name string, viewer *Viewer) (*model.CommandResponse, error) {
+	sticker, err := p.GetStickerByName(name, viewer)
 	if err != nil {
 		return p.respondEphemeral(fmt.Sprintf("Sticker '%s' not found.", name)), nil
 	}
 
-	canDelete, err := p.CanDeleteSticker(userID, sticker.ID)
+	if err := p.Authorize(userID, ActionDelete, stickerTarget(sticker)); err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Cannot delete sticker: %s.", err.Error())), nil
+	}
+
+	if _, err := p.TrashSticker(sticker.ID, userID); err != nil {
+		return p.respondEphemeral("Failed to delete sticker: " + err.Error()), nil
+	}
+
+	return p.respondEphemeral(fmt.Sprintf("Sticker '%s' has been moved to the trash. Use `/sticker restore %s` within %d days to bring it back.",
+		sticker.Name, sticker.Name, p.getTrashRetentionDays())), nil
+}
+
+func (p *Plugin) listTrash(userID string) (*model.CommandResponse, error) {
+	list, err := p.GetTrashedStickers(userID)
 	if err != nil {
-		return p.respondEphemeral("Error checking permissions: " + err.Error()), nil
+		return p.respondEphemeral("Failed to get the trash: " + err.Error()), nil
 	}
 
-	if !canDelete {
-		return p.respondEphemeral("You can only delete stickers that you created."), nil
+	if len(list.Stickers) == 0 {
+		return p.respondEphemeral("The trash is empty."), nil
 	}
 
-	if err := p.DeleteSticker(sticker.ID); err != nil {
-		return p.respondEphemeral("Failed to delete sticker: " + err.Error()), nil
+	var sb strings.Builder
+	sb.WriteString("**Deleted Stickers**\n\n")
+	for _, s := range list.Stickers {
+		purgeAt := time.UnixMilli(s.DeletedAt).AddDate(0, 0, list.RetentionDays)
+		sb.WriteString(fmt.Sprintf("- `%s` (purged after %s)\n", s.Name, purgeAt.Format("2006-01-02")))
+	}
+	sb.WriteString(fmt.Sprintf("\nTotal: %d stickers", list.Total))
+
+	return p.respondEphemeral(sb.String()), nil
+}
+
+func (p *Plugin) listPending(userID string) (*model.CommandResponse, error) {
+	canModerate := p.Authorize(userID, ActionModerate, Target{}) == nil
+	list, err := p.GetPendingStickers(userID, canModerate)
+	if err != nil {
+		return p.respondEphemeral("Failed to get pending stickers: " + err.Error()), nil
+	}
+
+	if len(list.Stickers) == 0 {
+		return p.respondEphemeral("No stickers are awaiting approval."), nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("**Stickers Awaiting Approval**\n\n")
+	for _, s := range list.Stickers {
+		line := fmt.Sprintf("- `%s`", s.Name)
+		uploaderID := s.CreatorID
+		if s.PendingRevision != nil {
+			line = fmt.Sprintf("- `%s` (changed)", s.Name)
+			uploaderID = s.PendingRevision.UserID
+		}
+		if canModerate {
+			line += " by " + p.displayUsername(uploaderID)
+		}
+		sb.WriteString(line + "\n")
+	}
+	sb.WriteString(fmt.Sprintf("\nTotal: %d stickers", list.Total))
+
+	return p.respondEphemeral(sb.String()), nil
+}
+
+func (p *Plugin) restoreSticker(userID, name, newName string) (*model.CommandResponse, error) {
+	list, err := p.GetTrashedStickers(userID)
+	if err != nil {
+		return p.respondEphemeral("Failed to get the trash: " + err.Error()), nil
+	}
+
+	// The list is most recently deleted first, which is the one to restore
+	// when several trashed stickers share a name
+	var trashed *Sticker
+	for _, s := range list.Stickers {
+		if normalizeName(s.Name) == normalizeName(name) {
+			trashed = s
+			break
+		}
+	}
+	if trashed == nil {
+		return p.respondEphemeral(fmt.Sprintf("Sticker '%s' is not in the trash.", name)), nil
+	}
+
+	if err := p.Authorize(userID, ActionDelete, stickerTarget(trashed)); err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Cannot restore sticker: %s.", err.Error())), nil
+	}
+
+	sticker, err := p.RestoreSticker(trashed.ID, userID, newName)
+	if errors.Is(err, ErrRestoreNameTaken) {
+		return p.respondEphemeral(fmt.Sprintf("Cannot restore sticker: %s. Use `/sticker restore %s [new name]`.", err.Error(), name)), nil
+	}
+	if errors.Is(err, ErrNameReserved) {
+		return p.respondEphemeral(fmt.Sprintf("Cannot restore sticker: %s.", err.Error())), nil
+	}
+	if err != nil {
+		return p.respondEphemeral("Failed to restore sticker: " + err.Error()), nil
+	}
+
+	return p.respondEphemeral(fmt.Sprintf("Sticker '%s' has been restored.", sticker.Name)), nil
+}
+
+func (p *Plugin) renameSticker(userID, oldName, newName string, viewer *Viewer) (*model.CommandResponse, error) {
+	sticker, err := p.GetStickerByName(oldName, viewer)
+	if err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Sticker '%s' not found.", oldName)), nil
+	}
+
+	if err := p.Authorize(userID, ActionEdit, stickerTarget(sticker)); err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Cannot rename sticker: %s.", err.Error())), nil
+	}
+
+	req := &stickerRequest{Name: &newName}
+	var validationErr error
+	renamed, err := p.EditSticker(sticker.ID, userID, versionActionUpdate, func(sticker *Sticker) error {
+		validationErr = p.applyStickerRequest(sticker, req)
+		return validationErr
+	})
+	if err != nil {
+		if validationErr != nil {
+			return p.respondEphemeral(fmt.Sprintf("Cannot rename sticker: %s.", validationErr.Error())), nil
+		}
+		return p.respondEphemeral("Failed to rename sticker: " + err.Error()), nil
+	}
+
+	if renamed.PendingRevision != nil && renamed.PendingRevision.Name != renamed.Name {
+		return p.respondEphemeral(fmt.Sprintf("Renaming sticker '%s' to '%s' awaits moderator approval.", sticker.Name, newName)), nil
+	}
+
+	return p.respondEphemeral(fmt.Sprintf("Sticker '%s' has been renamed to '%s'.", sticker.Name, newName)), nil
+}
+
+const packUsage = "Usage: /sticker pack list | show [pack] | create [pack] [description] | add [pack] [sticker] | remove [pack] [sticker] | delete [pack]"
+
+func (p *Plugin) executePackCommand(userID string, parts []string, viewer *Viewer) (*model.CommandResponse, error) {
+	if len(parts) < 1 {
+		return p.respondEphemeral(packUsage), nil
+	}
+
+	switch {
+	case parts[0] == "list":
+		return p.listPacks(viewer)
+	case parts[0] == "show" && len(parts) >= 2:
+		return p.showPack(parts[1], viewer)
+	case parts[0] == "create" && len(parts) >= 2:
+		return p.createPack(userID, parts[1], strings.Join(parts[2:], " "), viewer)
+	case parts[0] == "add" && len(parts) >= 3:
+		return p.addStickerToPack(userID, parts[1], parts[2], viewer)
+	case parts[0] == "remove" && len(parts) >= 3:
+		return p.removeStickerFromPack(userID, parts[1], parts[2], viewer)
+	case parts[0] == "delete" && len(parts) >= 2:
+		return p.deletePack(userID, parts[1], viewer)
+	default:
+		return p.respondEphemeral(packUsage), nil
+	}
+}
+
+func (p *Plugin) listPacks(viewer *Viewer) (*model.CommandResponse, error) {
+	list, err := p.GetAllPacks(viewer)
+	if err != nil {
+		return p.respondEphemeral("Failed to get packs: " + err.Error()), nil
+	}
+
+	if len(list.Packs) == 0 {
+		return p.respondEphemeral("No sticker packs yet. Use `/sticker pack create [pack]` to create one!"), nil
 	}
 
-	return p.respondEphemeral(fmt.Sprintf("Sticker '%s' has been deleted.", name)), nil
+	var sb strings.Builder
+	sb.WriteString("**Sticker Packs**\n\n")
+
+	for _, pack := range list.Packs {
+		sb.WriteString(fmt.Sprintf("- `%s` (%d stickers)", pack.Name, len(pack.StickerIDs)))
+		if pack.Description != "" {
+			sb.WriteString(" - " + pack.Description)
+		}
+		sb.WriteString("\n")
+	}
+
+	sb.WriteString(fmt.Sprintf("\nTotal: %d packs", len(list.Packs)))
+
+	return p.respondEphemeral(sb.String()), nil
+}
+
+func (p *Plugin) showPack(packName string, viewer *Viewer) (*model.CommandResponse, error) {
+	pack, err := p.GetPackByName(packName, viewer)
+	if err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Pack '%s' not found.", packName)), nil
+	}
+
+	stickers := p.GetPackStickers(pack, viewer)
+	if len(stickers.Stickers) == 0 {
+		return p.respondEphemeral(fmt.Sprintf("Pack '%s' has no stickers yet.", pack.Name)), nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("**Sticker Pack: %s**\n\n", pack.Name))
+
+	for _, s := range stickers.Stickers {
+		sb.WriteString(fmt.Sprintf("- `%s`\n", s.Name))
+	}
+
+	sb.WriteString(fmt.Sprintf("\nTotal: %d stickers", len(stickers.Stickers)))
+
+	return p.respondEphemeral(sb.String()), nil
+}
+
+func (p *Plugin) createPack(userID, packName, description string, viewer *Viewer) (*model.CommandResponse, error) {
+	if err := p.Authorize(userID, ActionCreate, Target{Scope: Scope{Type: ScopeServer}}); err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Cannot create pack: %s.", err.Error())), nil
+	}
+
+	if p.IsPackNameTaken(packName) {
+		return p.respondEphemeral(fmt.Sprintf("Pack name '%s' is already taken. Please choose a different name.", packName)), nil
+	}
+
+	pack := NewStickerPack(packName, description, userID)
+	if err := p.SavePack(pack); err != nil {
+		return p.respondEphemeral("Failed to create pack: " + err.Error()), nil
+	}
+
+	return p.respondEphemeral(fmt.Sprintf("Pack '%s' has been created. Add stickers with `/sticker pack add %s [sticker]`.", packName, packName)), nil
+}
+
+// getManagedPack resolves a pack by name and checks that the user may modify it
+func (p *Plugin) getManagedPack(userID, packName string, viewer *Viewer) (*StickerPack, *model.CommandResponse) {
+	pack, err := p.GetPackByName(packName, viewer)
+	if err != nil {
+		return nil, p.respondEphemeral(fmt.Sprintf("Pack '%s' not found.", packName))
+	}
+
+	if err := p.Authorize(userID, ActionManagePacks, packTarget(pack)); err != nil {
+		return nil, p.respondEphemeral(fmt.Sprintf("Cannot modify pack: %s.", err.Error()))
+	}
+
+	return pack, nil
+}
+
+func (p *Plugin) addStickerToPack(userID, packName, stickerName string, viewer *Viewer) (*model.CommandResponse, error) {
+	pack, resp := p.getManagedPack(userID, packName, viewer)
+	if resp != nil {
+		return resp, nil
+	}
+
+	sticker, err := p.GetStickerByName(stickerName, viewer)
+	if err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Sticker '%s' not found.", stickerName)), nil
+	}
+
+	if _, err := p.UpdatePack(pack.ID, func(pack *StickerPack) error {
+		if !pack.HasSticker(sticker.ID) {
+			pack.StickerIDs = append(pack.StickerIDs, sticker.ID)
+		}
+		return nil
+	}); err != nil {
+		return p.respondEphemeral("Failed to update pack: " + err.Error()), nil
+	}
+
+	return p.respondEphemeral(fmt.Sprintf("Sticker '%s' has been added to pack '%s'.", sticker.Name, pack.Name)), nil
+}
+
+func (p *Plugin) removeStickerFromPack(userID, packName, stickerName string, viewer *Viewer) (*model.CommandResponse, error) {
+	pack, resp := p.getManagedPack(userID, packName, viewer)
+	if resp != nil {
+		return resp, nil
+	}
+
+	sticker, err := p.GetStickerByName(stickerName, viewer)
+	if err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Sticker '%s' not found.", stickerName)), nil
+	}
+
+	if _, err := p.UpdatePack(pack.ID, func(pack *StickerPack) error {
+		pack.RemoveSticker(sticker.ID)
+		return nil
+	}); err != nil {
+		return p.respondEphemeral("Failed to update pack: " + err.Error()), nil
+	}
+
+	return p.respondEphemeral(fmt.Sprintf("Sticker '%s' has been removed from pack '%s'.", sticker.Name, pack.Name)), nil
+}
+
+func (p *Plugin) deletePack(userID, packName string, viewer *Viewer) (*model.CommandResponse, error) {
+	pack, resp := p.getManagedPack(userID, packName, viewer)
+	if resp != nil {
+		return resp, nil
+	}
+
+	if err := p.DeletePack(pack.ID); err != nil {
+		return p.respondEphemeral("Failed to delete pack: " + err.Error()), nil
+	}
+
+	return p.respondEphemeral(fmt.Sprintf("Pack '%s' has been deleted.", pack.Name)), nil
+}
+
+func (p *Plugin) executeAdminCommand(userID string, parts []string) (*model.CommandResponse, error) {
+	if err := p.Authorize(userID, ActionAdminister, Target{}); err != nil {
+		return p.respondEphemeral(fmt.Sprintf("Cannot run admin command: %s.", err.Error())), nil
+	}
+
+	usage := "Usage: /sticker admin fsck [repair] | gc [run] | duplicates [backfill]"
+	if len(parts) < 1 {
+		return p.respondEphemeral(usage), nil
+	}
+
+	switch parts[0] {
+	case "fsck":
+		return p.fsck(len(parts) > 1 && parts[1] == "repair")
+	case "gc":
+		return p.collectOrphanImages(len(parts) < 2 || parts[1] != "run")
+	case "duplicates":
+		return p.listDuplicates(len(parts) > 1 && parts[1] == "backfill")
+	default:
+		return p.respondEphemeral(usage), nil
+	}
+}
+
+func (p *Plugin) collectOrphanImages(dryRun bool) (*model.CommandResponse, error) {
+	report, err := p.CollectOrphanImages(dryRun)
+	if err != nil {
+		return p.respondEphemeral("Image garbage collection failed: " + err.Error()), nil
+	}
+
+	if len(report.Candidates) == 0 {
+		return p.respondEphemeral(fmt.Sprintf("No unreferenced images older than %d hours.", report.GracePeriodHours)), nil
+	}
+
+	var sb strings.Builder
+	if report.DryRun {
+		sb.WriteString(fmt.Sprintf("**Unreferenced images older than %d hours (dry run)**\n\n", report.GracePeriodHours))
+	} else {
+		sb.WriteString(fmt.Sprintf("**Deleted unreferenced images older than %d hours**\n\n", report.GracePeriodHours))
+	}
+
+	for _, image := range report.Candidates {
+		sb.WriteString(fmt.Sprintf("- `%s` (%s)\n", image.Key, image.ModifiedAt.Format(time.RFC3339)))
+	}
+
+	for _, e := range report.Errors {
+		sb.WriteString(fmt.Sprintf("\n- Error: %s", e))
+	}
+
+	if report.DryRun {
+		sb.WriteString("\nRun `/sticker admin gc run` to delete them.")
+	} else {
+		sb.WriteString(fmt.Sprintf("\nDeleted %d of %d images.", len(report.Deleted), len(report.Candidates)))
+	}
+
+	return p.respondEphemeral(sb.String()), nil
+}
+
+func (p *Plugin) listDuplicates(backfill bool) (*model.CommandResponse, error) {
+	report, err := p.FindDuplicateClusters(nearDuplicateDistance, backfill)
+	if err != nil {
+		return p.respondEphemeral("Duplicate search failed: " + err.Error()), nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("**Near-duplicate Stickers**\n\n")
+
+	if len(report.Clusters) == 0 {
+		sb.WriteString("No near-identical stickers found.\n")
+	}
+	for _, cluster := range report.Clusters {
+		names := make([]string, 0, len(cluster.Stickers))
+		for _, sticker := range cluster.Stickers {
+			names = append(names, "`"+sticker.Name+"`")
+		}
+		sb.WriteString(fmt.Sprintf("- %s (distance up to %d)\n", strings.Join(names, ", "), cluster.MaxDistance))
+	}
+
+	for _, e := range report.Errors {
+		sb.WriteString(fmt.Sprintf("\n- Error: %s", e))
+	}
+
+	if report.Backfilled > 0 {
+		sb.WriteString(fmt.Sprintf("\nHashed %d older stickers.", report.Backfilled))
+	}
+	if report.Unhashed > 0 {
+		sb.WriteString(fmt.Sprintf("\n%d stickers have no perceptual hash; run `/sticker admin duplicates backfill` to include them.", report.Unhashed))
+	}
+
+	return p.respondEphemeral(sb.String()), nil
+}
+
+func (p *Plugin) fsck(repair bool) (*model.CommandResponse, error) {
+	report, err := p.CheckStickerConsistency(repair)
+	if err != nil {
+		return p.respondEphemeral("Consistency check failed: " + err.Error()), nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("**Sticker Consistency Check**\n\n")
+	sb.WriteString(fmt.Sprintf("- Indexed stickers: %d\n", report.IndexedCount))
+	sb.WriteString(fmt.Sprintf("- Stickers in the trash: %d\n", report.TrashedCount))
+	sb.WriteString(fmt.Sprintf("- Sticker records: %d\n", report.RecordCount))
+	sb.WriteString(fmt.Sprintf("- Stored images: %d\n", report.ImageCount))
+	sb.WriteString(fmt.Sprintf("- Dangling index entries: %d\n", len(report.DanglingIndexEntries)))
+	sb.WriteString(fmt.Sprintf("- Dangling trash entries: %d\n", len(report.DanglingTrashEntries)))
+	sb.WriteString(fmt.Sprintf("- Orphan records: %d\n", len(report.OrphanRecords)))
+	sb.WriteString(fmt.Sprintf("- Orphan images: %d\n", len(report.OrphanImages)))
+	sb.WriteString(fmt.Sprintf("- Stickers with missing images: %d\n", len(report.MissingImages)))
+	sb.WriteString(fmt.Sprintf("- Index update conflicts since start: %d\n", report.IndexMetrics.Conflicts))
+
+	for _, e := range report.Errors {
+		sb.WriteString(fmt.Sprintf("\n- Error: %s", e))
+	}
+
+	switch {
+	case report.Repaired:
+		sb.WriteString("\nRepair completed.")
+	case report.HasProblems():
+		sb.WriteString("\nRun `/sticker admin fsck repair` to fix these problems.")
+	default:
+		sb.WriteString("\nNo problems found.")
+	}
+
+	return p.respondEphemeral(sb.String()), nil
 }
 
 func (p *Plugin) respondEphemeral(message string) *model.CommandResponse {
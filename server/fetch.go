@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	fetchTimeout        = 30 * time.Second
+	fetchConnectTimeout = 10 * time.Second
+	fetchMaxRedirects   = 5
+)
+
+// ErrFetchNotAllowed marks downloads refused because of the URL or the
+// address it resolves to, as opposed to network failures
+var ErrFetchNotAllowed = errors.New("URL not allowed")
+
+// reservedNetworks are ranges that are not publicly routable but that the net
+// package does not classify as private, loopback or link-local
+var reservedNetworks = mustParseCIDRs(
+	"0.0.0.0/8",
+	"100.64.0.0/10",
+	"192.0.0.0/24",
+	"198.18.0.0/15",
+	"240.0.0.0/4",
+	"64:ff9b:1::/48",
+)
+
+// IPv6 ranges whose addresses carry an IPv4 address that a relay or
+// translator forwards to
+var (
+	ipv4CompatibleNetwork = mustParseCIDRs("::/96")[0]
+	nat64Network          = mustParseCIDRs("64:ff9b::/96")[0]
+	sixToFourNetwork      = mustParseCIDRs("2002::/16")[0]
+	teredoNetwork         = mustParseCIDRs("2001::/32")[0]
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// embeddedIPv4s returns the IPv4 addresses carried by an IPv4-compatible,
+// NAT64, 6to4 or Teredo address. Both the Teredo server and the obfuscated
+// client address are returned.
+func embeddedIPv4s(ip net.IP) []net.IP {
+	if ip.To4() != nil {
+		return nil
+	}
+	ip = ip.To16()
+	if ip == nil {
+		return nil
+	}
+
+	switch {
+	case ipv4CompatibleNetwork.Contains(ip), nat64Network.Contains(ip):
+		return []net.IP{net.IPv4(ip[12], ip[13], ip[14], ip[15])}
+	case sixToFourNetwork.Contains(ip):
+		return []net.IP{net.IPv4(ip[2], ip[3], ip[4], ip[5])}
+	case teredoNetwork.Contains(ip):
+		return []net.IP{
+			net.IPv4(ip[4], ip[5], ip[6], ip[7]),
+			net.IPv4(ip[12]^0xff, ip[13]^0xff, ip[14]^0xff, ip[15]^0xff),
+		}
+	default:
+		return nil
+	}
+}
+
+// isInternalIP reports whether an address is loopback, private, link-local or
+// otherwise not a public internet address. IPv6 addresses that carry an IPv4
+// address are internal when that address is.
+func isInternalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	for _, embedded := range embeddedIPv4s(ip) {
+		if isInternalIP(embedded) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalAllowlist holds the hosts and ranges from Mattermost's
+// AllowedUntrustedInternalConnections setting
+type internalAllowlist struct {
+	hosts    map[string]bool
+	networks []*net.IPNet
+}
+
+func parseInternalAllowlist(value string) *internalAllowlist {
+	allowlist := &internalAllowlist{hosts: map[string]bool{}}
+	fields := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+	for _, field := range fields {
+		if _, network, err := net.ParseCIDR(field); err == nil {
+			allowlist.networks = append(allowlist.networks, network)
+			continue
+		}
+		if ip := net.ParseIP(field); ip != nil {
+			allowlist.networks = append(allowlist.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		allowlist.hosts[strings.ToLower(field)] = true
+	}
+	return allowlist
+}
+
+func (a *internalAllowlist) allowsIP(ip net.IP) bool {
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// urlFetcher downloads user-supplied URLs without letting them reach internal
+// services. Every connection, including those made for redirects, is checked
+// after DNS resolution and dialled to the checked address, so a host cannot
+// resolve to a public address for the check and an internal one for the
+// request.
+type urlFetcher struct {
+	client    *http.Client
+	allowlist *internalAllowlist
+	maxBytes  int64
+}
+
+// allowedUntrustedInternalConnections returns the server's allowlist of
+// internal hosts and ranges that user-supplied URLs may reach
+func (p *Plugin) allowedUntrustedInternalConnections() string {
+	cfg := p.API.GetConfig()
+	if cfg == nil || cfg.ServiceSettings.AllowedUntrustedInternalConnections == nil {
+		return ""
+	}
+	return *cfg.ServiceSettings.AllowedUntrustedInternalConnections
+}
+
+func newURLFetcher(allowedInternal string, maxBytes int64) *urlFetcher {
+	f := &urlFetcher{
+		allowlist: parseInternalAllowlist(allowedInternal),
+		maxBytes:  maxBytes,
+	}
+
+	transport := &http.Transport{
+		// Proxies from the environment would bypass the address checks
+		Proxy:                 nil,
+		DialContext:           f.dialContext,
+		TLSHandshakeTimeout:   fetchConnectTimeout,
+		ResponseHeaderTimeout: fetchConnectTimeout,
+		DisableKeepAlives:     true,
+	}
+
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   fetchTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= fetchMaxRedirects {
+				return fmt.Errorf("%w: too many redirects", ErrFetchNotAllowed)
+			}
+			return checkFetchURL(req.URL)
+		},
+	}
+
+	return f
+}
+
+// checkFetchURL allows only plain http(s) URLs without credentials
+func checkFetchURL(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: only http and https URLs are supported", ErrFetchNotAllowed)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: URLs with credentials are not supported", ErrFetchNotAllowed)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%w: missing host", ErrFetchNotAllowed)
+	}
+	return nil
+}
+
+// dialContext resolves the host itself, refuses it if any of its addresses is
+// internal and not allowlisted, and connects to the checked address
+func (f *urlFetcher) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: fetchConnectTimeout}
+	trustedHost := f.allowlist.hosts[strings.ToLower(host)]
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		if isInternalIP(ip) && !trustedHost && !f.allowlist.allowsIP(ip) {
+			// A host with any internal address is refused outright rather
+			// than relying on address order
+			return nil, fmt.Errorf("%w: %s resolves to an internal address", ErrFetchNotAllowed, host)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+
+	return dialer.DialContext(ctx, network, net.JoinHostPort(ips[0].String(), port))
+}
+
+// Fetch downloads a URL and returns its body and Content-Type. Bodies larger
+// than the size cap are rejected without being read in full.
+func (f *urlFetcher) Fetch(rawURL string) ([]byte, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: invalid URL", ErrFetchNotAllowed)
+	}
+	if err := checkFetchURL(u); err != nil {
+		return nil, "", err
+	}
+
+	resp, err := f.client.Get(u.String())
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("status %s", resp.Status)
+	}
+
+	if resp.ContentLength > f.maxBytes {
+		return nil, "", fmt.Errorf("%w: image size exceeds limit", ErrInvalidImage)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBytes+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if int64(len(data)) > f.maxBytes {
+		return nil, "", fmt.Errorf("%w: image size exceeds limit", ErrInvalidImage)
+	}
+
+	return data, resp.Header.Get("Content-Type"), nil
+}
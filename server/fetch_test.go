@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsInternalIP(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "8.8.8.8", want: false},
+		{ip: "127.0.0.1", want: true},
+		{ip: "10.1.2.3", want: true},
+		{ip: "169.254.169.254", want: true},
+		{ip: "100.64.0.1", want: true},
+		{ip: "0.1.2.3", want: true},
+		{ip: "2606:4700::1111", want: false},
+		{ip: "::1", want: true},
+		{ip: "fd00::1", want: true},
+		{ip: "fe80::1", want: true},
+		{ip: "::ffff:127.0.0.1", want: true},
+		{ip: "::ffff:8.8.8.8", want: false},
+		{ip: "::127.0.0.1", want: true},
+		// NAT64
+		{ip: "64:ff9b::a9fe:a9fe", want: true},
+		{ip: "64:ff9b::808:808", want: false},
+		{ip: "64:ff9b:1::808:808", want: true},
+		// 6to4
+		{ip: "2002:7f00:1::1", want: true},
+		{ip: "2002:a00:1::1", want: true},
+		{ip: "2002:808:808::1", want: false},
+		// Teredo, with the client address inverted in the last 32 bits
+		{ip: "2001:0:4136:e378:8000:63bf:80ff:fffe", want: true},
+		{ip: "2001:0:a00:1:8000:63bf:f7f7:f7f7", want: true},
+		{ip: "2001:0:4136:e378:8000:63bf:f7f7:f7f7", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := isInternalIP(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("isInternalIP(%s) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInternalAllowlist(t *testing.T) {
+	allowlist := parseInternalAllowlist("10.0.0.0/8, 192.168.1.5\nImages.Internal")
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.20.30.40", want: true},
+		{ip: "192.168.1.5", want: true},
+		{ip: "192.168.1.6", want: false},
+		{ip: "127.0.0.1", want: false},
+	}
+	for _, tt := range tests {
+		if got := allowlist.allowsIP(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("allowsIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+	if !allowlist.hosts["images.internal"] {
+		t.Errorf("hosts %v", allowlist.hosts)
+	}
+}
+
+func TestURLFetcher(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write([]byte("0123456789"))
+	})
+	mux.HandleFunc("/missing.png", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/to-file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		allowed  string
+		maxBytes int64
+		url      string
+		wantErr  error
+		wantBody string
+	}{
+		{name: "internal refused", url: server.URL + "/image.png", maxBytes: 100, wantErr: ErrFetchNotAllowed},
+		{name: "allowlisted", allowed: "127.0.0.0/8", url: server.URL + "/image.png", maxBytes: 100, wantBody: "0123456789"},
+		{name: "too large", allowed: "127.0.0.1", url: server.URL + "/image.png", maxBytes: 5, wantErr: ErrInvalidImage},
+		{name: "credentials", allowed: "127.0.0.1", url: strings.Replace(server.URL, "://", "://user:pass@", 1) + "/image.png", maxBytes: 100, wantErr: ErrFetchNotAllowed},
+		{name: "scheme", url: "ftp://example.com/image.png", maxBytes: 100, wantErr: ErrFetchNotAllowed},
+		{name: "redirect to file", allowed: "127.0.0.1", url: server.URL + "/to-file", maxBytes: 100, wantErr: ErrFetchNotAllowed},
+		{name: "redirect loop", allowed: "127.0.0.1", url: server.URL + "/loop", maxBytes: 100, wantErr: ErrFetchNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, contentType, err := newURLFetcher(tt.allowed, tt.maxBytes).Fetch(tt.url)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantBody || contentType != "image/png" {
+				t.Errorf("fetched %q as %q", data, contentType)
+			}
+		})
+	}
+
+	if _, _, err := newURLFetcher("127.0.0.1", 100).Fetch(server.URL + "/missing.png"); err == nil || errors.Is(err, ErrFetchNotAllowed) {
+		t.Errorf("missing image returned %v", err)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const kvListPerPage = 1000
+
+// FsckReport describes inconsistencies between the sticker and trash indexes,
+// the sticker records and the image store. Index entries are dangling when
+// they have no record or the record belongs in the other index.
+type FsckReport struct {
+	IndexedCount         int          `json:"indexed_count"`
+	TrashedCount         int          `json:"trashed_count"`
+	RecordCount          int          `json:"record_count"`
+	ImageCount           int          `json:"image_count"`
+	DanglingIndexEntries []string     `json:"dangling_index_entries"`
+	DanglingTrashEntries []string     `json:"dangling_trash_entries"`
+	OrphanRecords        []string     `json:"orphan_records"`
+	OrphanImages         []string     `json:"orphan_images"`
+	MissingImages        []string     `json:"missing_images"`
+	Errors               []string     `json:"errors"`
+	Repaired             bool         `json:"repaired"`
+	IndexMetrics         IndexMetrics `json:"index_metrics"`
+}
+
+// HasProblems reports whether the check found anything to repair
+func (r *FsckReport) HasProblems() bool {
+	return len(r.DanglingIndexEntries) > 0 || len(r.DanglingTrashEntries) > 0 || len(r.OrphanRecords) > 0 ||
+		len(r.OrphanImages) > 0 || len(r.MissingImages) > 0
+}
+
+// listStickerRecordIDs returns the IDs of all sticker records in the KV store
+func (p *Plugin) listStickerRecordIDs() ([]string, error) {
+	ids := []string{}
+	for page := 0; ; page++ {
+		keys, appErr := p.API.KVList(page, kvListPerPage)
+		if appErr != nil {
+			return nil, fmt.Errorf("failed to list keys: %w", appErr)
+		}
+
+		for _, key := range keys {
+			if strings.HasPrefix(key, stickerKeyPrefix) {
+				ids = append(ids, strings.TrimPrefix(key, stickerKeyPrefix))
+			}
+		}
+
+		if len(keys) < kvListPerPage {
+			return ids, nil
+		}
+	}
+}
+
+// getIndex reads an index of sticker IDs, the main one or the trash
+func (p *Plugin) getIndex(key string) ([]string, error) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, fmt.Errorf("failed to get sticker index: %w", appErr)
+	}
+
+	var ids []string
+	if data != nil {
+		if err := json.Unmarshal(data, &ids); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal sticker index: %w", err)
+		}
+	}
+
+	return ids, nil
+}
+
+// CheckStickerConsistency compares the sticker and trash indexes against the
+// sticker records and the image store. With repair set, dangling index
+// entries are dropped, orphan records are re-indexed and orphan images are
+// deleted. Stickers whose image is missing are only reported.
+func (p *Plugin) CheckStickerConsistency(repair bool) (*FsckReport, error) {
+	report := &FsckReport{
+		DanglingIndexEntries: []string{},
+		DanglingTrashEntries: []string{},
+		OrphanRecords:        []string{},
+		OrphanImages:         []string{},
+		MissingImages:        []string{},
+		Errors:               []string{},
+	}
+
+	indexIDs, err := p.getIndex(stickersKey)
+	if err != nil {
+		return nil, err
+	}
+
+	trashIDs, err := p.getIndex(trashKey)
+	if err != nil {
+		return nil, err
+	}
+
+	recordIDs, err := p.listStickerRecordIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	report.IndexedCount = len(indexIDs)
+	report.TrashedCount = len(trashIDs)
+	report.RecordCount = len(recordIDs)
+
+	indexed := make(map[string]bool, len(indexIDs))
+	for _, id := range indexIDs {
+		indexed[id] = true
+	}
+	inTrash := make(map[string]bool, len(trashIDs))
+	for _, id := range trashIDs {
+		inTrash[id] = true
+	}
+
+	// trashed tells for each readable record whether it belongs in the
+	// trash; unreadable records are left in whichever index holds them
+	records := make(map[string]bool, len(recordIDs))
+	trashed := make(map[string]bool, len(recordIDs))
+	referenced := make(map[string]string, len(recordIDs))
+	originals := make(map[string]string, len(recordIDs))
+	for _, id := range recordIDs {
+		records[id] = true
+		sticker, err := p.GetSticker(id)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("sticker %s: %s", id, err.Error()))
+			continue
+		}
+		trashed[id] = sticker.IsTrashed()
+		if (trashed[id] && !inTrash[id]) || (!trashed[id] && !indexed[id]) {
+			report.OrphanRecords = append(report.OrphanRecords, id)
+		}
+
+		for _, key := range sticker.ImageKeys() {
+			referenced[key] = id
+		}
+		if sticker.Filename != "" {
+			originals[sticker.Filename] = id
+		}
+	}
+
+	for _, id := range indexIDs {
+		if isTrashed, ok := trashed[id]; !records[id] || (ok && isTrashed) {
+			report.DanglingIndexEntries = append(report.DanglingIndexEntries, id)
+		}
+	}
+	for _, id := range trashIDs {
+		if isTrashed, ok := trashed[id]; !records[id] || (ok && !isTrashed) {
+			report.DanglingTrashEntries = append(report.DanglingTrashEntries, id)
+		}
+	}
+
+	store, err := p.getImageStore()
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+	report.ImageCount = len(images)
+
+	stored := make(map[string]bool, len(images))
+	// Images younger than the garbage collection grace period may belong to
+	// an upload whose sticker record is still being written
+	cutoff := time.Now().Add(-time.Duration(p.getImageGCGracePeriod()) * time.Hour)
+	for _, image := range images {
+		stored[image.Key] = true
+		if _, ok := referenced[image.Key]; !ok && image.ModifiedAt.Before(cutoff) {
+			report.OrphanImages = append(report.OrphanImages, image.Key)
+		}
+	}
+
+	for filename, id := range originals {
+		if !stored[filename] {
+			report.MissingImages = append(report.MissingImages, id)
+		}
+	}
+
+	sort.Strings(report.OrphanImages)
+	sort.Strings(report.MissingImages)
+	report.IndexMetrics = p.GetIndexMetrics()
+
+	if repair {
+		p.repairStickerConsistency(report, store)
+	}
+
+	return report, nil
+}
+
+func (p *Plugin) repairStickerConsistency(report *FsckReport, store StickerImageStore) {
+	for _, id := range report.DanglingIndexEntries {
+		if err := p.removeStickerFromIndex(id); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("remove index entry %s: %s", id, err.Error()))
+		}
+	}
+
+	for _, id := range report.DanglingTrashEntries {
+		if err := p.removeFromIndex(trashKey, id); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("remove trash entry %s: %s", id, err.Error()))
+		}
+	}
+
+	for _, id := range report.OrphanRecords {
+		key := stickersKey
+		if sticker, err := p.GetSticker(id); err == nil && sticker.IsTrashed() {
+			key = trashKey
+		}
+		if err := p.addToIndex(key, id); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("index sticker %s: %s", id, err.Error()))
+		}
+	}
+
+	p.notifyStickersReset()
+
+	for _, key := range report.OrphanImages {
+		if err := store.Delete(key); err != nil {
+			if errors.Is(err, ErrImageDeleteUnsupported) {
+				report.Errors = append(report.Errors, err.Error())
+				break
+			}
+			report.Errors = append(report.Errors, fmt.Sprintf("delete image %s: %s", key, err.Error()))
+		}
+	}
+
+	report.Repaired = true
+}
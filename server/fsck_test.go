@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestFsckOrphanImagesUseGracePeriod(t *testing.T) {
+	dir := t.TempDir()
+	p := newTestPlugin(newFakeAPI(), &configuration{StickerStoragePath: dir, ImageGCGracePeriodHours: 6})
+
+	ages := map[string]time.Duration{
+		"recent.png": time.Hour,
+		"old.png":    12 * time.Hour,
+	}
+	for name, age := range ages {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		modified := time.Now().Add(-age)
+		if err := os.Chtimes(path, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := p.CheckStickerConsistency(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(report.OrphanImages, []string{"old.png"}) {
+		t.Errorf("orphan images %q, want only the one older than the grace period", report.OrphanImages)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	imageGCJobKey   = "image_gc"
+	imageGCInterval = time.Hour
+
+	defaultImageGCGracePeriodHours = 24
+)
+
+// ImageGCReport lists image files that no sticker references and which are
+// older than the grace period, and what was done with them.
+type ImageGCReport struct {
+	DryRun           bool          `json:"dry_run"`
+	GracePeriodHours int           `json:"grace_period_hours"`
+	Candidates       []StoredImage `json:"candidates"`
+	Deleted          []string      `json:"deleted"`
+	Errors           []string      `json:"errors"`
+}
+
+func (p *Plugin) getImageGCGracePeriod() int {
+	hours := p.getConfiguration().ImageGCGracePeriodHours
+	if hours <= 0 {
+		return defaultImageGCGracePeriodHours
+	}
+	return hours
+}
+
+// CollectOrphanImages removes image files that no sticker record references
+// once they are older than the configured grace period. With dryRun set it
+// only reports what would be removed.
+func (p *Plugin) CollectOrphanImages(dryRun bool) (*ImageGCReport, error) {
+	gracePeriod := p.getImageGCGracePeriod()
+	report := &ImageGCReport{
+		DryRun:           dryRun,
+		GracePeriodHours: gracePeriod,
+		Candidates:       []StoredImage{},
+		Deleted:          []string{},
+		Errors:           []string{},
+	}
+
+	// Scan records rather than the index so that images of stickers missing
+	// from the index are never collected
+	recordIDs, err := p.listStickerRecordIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	referenced := make(map[string]bool, len(recordIDs))
+	for _, id := range recordIDs {
+		sticker, err := p.GetSticker(id)
+		if err != nil {
+			// Without every record we cannot tell which images are unused
+			return nil, fmt.Errorf("failed to read sticker %s: %w", id, err)
+		}
+		for _, key := range sticker.ImageKeys() {
+			referenced[key] = true
+		}
+	}
+
+	store, err := p.getImageStore()
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-time.Duration(gracePeriod) * time.Hour)
+	for _, image := range images {
+		if !referenced[image.Key] && image.ModifiedAt.Before(cutoff) {
+			report.Candidates = append(report.Candidates, image)
+		}
+	}
+
+	sort.Slice(report.Candidates, func(i, j int) bool {
+		return report.Candidates[i].ModifiedAt.Before(report.Candidates[j].ModifiedAt)
+	})
+
+	if dryRun {
+		return report, nil
+	}
+
+	for _, image := range report.Candidates {
+		if err := store.Delete(image.Key); err != nil {
+			if errors.Is(err, ErrImageDeleteUnsupported) {
+				report.Errors = append(report.Errors, err.Error())
+				break
+			}
+			report.Errors = append(report.Errors, fmt.Sprintf("delete image %s: %s", image.Key, err.Error()))
+			continue
+		}
+		report.Deleted = append(report.Deleted, image.Key)
+	}
+
+	return report, nil
+}
+
+// runImageGC is the scheduled job callback. It runs on a single node at a
+// time thanks to the cluster job scheduler.
+func (p *Plugin) runImageGC() {
+	cfg := p.getConfiguration()
+	if !cfg.ImageGCEnabled {
+		return
+	}
+
+	report, err := p.CollectOrphanImages(cfg.ImageGCDryRun)
+	if err != nil {
+		p.API.LogError("Sticker image garbage collection failed", "error", err.Error())
+		return
+	}
+
+	if len(report.Candidates) == 0 {
+		return
+	}
+
+	if report.DryRun {
+		p.API.LogInfo("Sticker image garbage collection dry run", "orphan_images", len(report.Candidates))
+		return
+	}
+
+	p.API.LogInfo("Sticker image garbage collection finished", "deleted", len(report.Deleted), "errors", len(report.Errors))
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "golang.org/x/image/webp"
+)
+
+// ErrInvalidImage marks upload errors caused by the image itself, as opposed
+// to storage failures
+var ErrInvalidImage = errors.New("invalid image")
+
+// ImageInfo describes an image as detected from its content
+type ImageInfo struct {
+	Format     string
+	Width      int
+	Height     int
+	FrameCount int
+}
+
+// sniffImageFormat identifies the image format from its magic bytes
+func sniffImageFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF87a")), bytes.HasPrefix(data, []byte("GIF89a")):
+		return "gif"
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpg"
+	case len(data) >= 12 && string(data[0:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	default:
+		return ""
+	}
+}
+
+// DetectImage inspects the image header and returns its format, number of
+// frames and dimensions. The dimensions are those displayed, after any EXIF
+// rotation. Files that are not a supported image or whose header cannot be
+// decoded are rejected. No pixels are decoded, so the limits can be checked
+// before an oversized image costs any memory.
+func DetectImage(data []byte) (*ImageInfo, error) {
+	format := sniffImageFormat(data)
+	if format == "" {
+		return nil, fmt.Errorf("%w: unrecognized image format", ErrInvalidImage)
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: corrupt %s image: %s", ErrInvalidImage, format, err.Error())
+	}
+
+	info := &ImageInfo{
+		Format:     format,
+		Width:      config.Width,
+		Height:     config.Height,
+		FrameCount: 1,
+	}
+
+	switch format {
+	case "jpg":
+		// Orientations 5 to 8 turn the image by a quarter
+		if jpegOrientation(data) >= 5 {
+			info.Width, info.Height = info.Height, info.Width
+		}
+	case "gif":
+		frames, err := countGIFFrames(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: corrupt gif image: %s", ErrInvalidImage, err.Error())
+		}
+		info.FrameCount = frames
+	case "webp":
+		frames, err := countWebPFrames(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: corrupt webp image: %s", ErrInvalidImage, err.Error())
+		}
+		info.FrameCount = frames
+	}
+
+	return info, nil
+}
+
+// countGIFFrames walks the blocks of a GIF file and counts image descriptors
+// without decompressing any frame
+func countGIFFrames(data []byte) (int, error) {
+	// Header and logical screen descriptor
+	const headerLength = 13
+	if len(data) < headerLength {
+		return 0, errTruncated
+	}
+
+	offset := headerLength
+	if flags := data[10]; flags&0x80 != 0 {
+		offset += 3 << ((flags & 0x07) + 1)
+	}
+
+	frames := 0
+	for offset < len(data) {
+		switch data[offset] {
+		case gifBlockTrailer:
+			offset = len(data)
+
+		case gifBlockImage:
+			// Image descriptor, local color table, LZW code size, data
+			const descriptorLength = 10
+			if offset+descriptorLength > len(data) {
+				return 0, errTruncated
+			}
+			flags := data[offset+9]
+			offset += descriptorLength
+			if flags&0x80 != 0 {
+				offset += 3 << ((flags & 0x07) + 1)
+			}
+			end, err := skipGIFSubBlocks(data, offset+1)
+			if err != nil {
+				return 0, err
+			}
+			frames++
+			offset = end
+
+		case gifBlockExtension:
+			end, err := skipGIFSubBlocks(data, offset+2)
+			if err != nil {
+				return 0, err
+			}
+			offset = end
+
+		default:
+			return 0, fmt.Errorf("unknown block 0x%02x at offset %d", data[offset], offset)
+		}
+	}
+
+	if frames == 0 {
+		return 0, fmt.Errorf("no image frames")
+	}
+	return frames, nil
+}
+
+// countWebPFrames walks the RIFF chunks of a WebP file and counts animation
+// frames. Still images have no ANMF chunks and count as one frame.
+func countWebPFrames(data []byte) (int, error) {
+	frames := 0
+	for offset := 12; offset+8 <= len(data); {
+		fourCC := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		if size < 0 || offset+8+size > len(data) {
+			return 0, fmt.Errorf("truncated %s chunk", fourCC)
+		}
+
+		if fourCC == "ANMF" {
+			frames++
+		}
+
+		// Chunks are padded to an even size
+		offset += 8 + size + size%2
+	}
+
+	if frames == 0 {
+		return 1, nil
+	}
+	return frames, nil
+}
+
+// isFormatAllowed reports whether a normalized format is in AllowedFormats
+func (p *Plugin) isFormatAllowed(format string) bool {
+	for _, allowed := range strings.Split(p.getConfiguration().AllowedFormats, ",") {
+		if normalizeFormat(allowed) == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateStickerImage checks an uploaded image by content rather than by
+// name. filename may be empty; when it has an extension it must match the
+// detected format.
+func (p *Plugin) ValidateStickerImage(data []byte, filename string) (*ImageInfo, error) {
+	info, err := p.detectStickerImage(data, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.checkImageLimits(info, len(data)); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// detectStickerImage detects the image format and checks that it is allowed
+// and agrees with the file extension
+func (p *Plugin) detectStickerImage(data []byte, filename string) (*ImageInfo, error) {
+	info, err := DetectImage(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if ext := filepath.Ext(filename); ext != "" && normalizeFormat(ext) != info.Format {
+		return nil, fmt.Errorf("%w: file extension %s does not match %s content", ErrInvalidImage, ext, info.Format)
+	}
+
+	if !p.isFormatAllowed(info.Format) {
+		return nil, fmt.Errorf("%w: file format not allowed", ErrInvalidImage)
+	}
+
+	return info, nil
+}
+
+// checkImageLimits enforces the configured size, dimension and frame limits
+func (p *Plugin) checkImageLimits(info *ImageInfo, size int) error {
+	cfg := p.getConfiguration()
+	if cfg.MaxStickerSize > 0 && size > cfg.MaxStickerSize*1024 {
+		return fmt.Errorf("%w: file size exceeds limit of %d KB", ErrInvalidImage, cfg.MaxStickerSize)
+	}
+	if cfg.MaxImageWidth > 0 && info.Width > cfg.MaxImageWidth {
+		return fmt.Errorf("%w: image width %d exceeds limit of %d", ErrInvalidImage, info.Width, cfg.MaxImageWidth)
+	}
+	if cfg.MaxImageHeight > 0 && info.Height > cfg.MaxImageHeight {
+		return fmt.Errorf("%w: image height %d exceeds limit of %d", ErrInvalidImage, info.Height, cfg.MaxImageHeight)
+	}
+	if cfg.MaxFrameCount > 0 && info.FrameCount > cfg.MaxFrameCount {
+		return fmt.Errorf("%w: image has %d frames, limit is %d", ErrInvalidImage, info.FrameCount, cfg.MaxFrameCount)
+	}
+	return nil
+}
+
+// PrepareStickerImage validates an uploaded image, resizes it when enabled,
+// strips its metadata, stores it and generates its thumbnails. Unless
+// allowDuplicate is set, an image identical to that of an existing sticker is
+// rejected with a *DuplicateImageError.
+func (p *Plugin) PrepareStickerImage(data []byte, filename string, allowDuplicate bool) (*StickerImage, error) {
+	info, err := p.detectStickerImage(data, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg := p.getConfiguration(); cfg.ResizeImages {
+		maxBytes := int64(cfg.MaxStickerSize * 1024)
+		if maxBytes <= 0 {
+			maxBytes = maxResizeInputSize
+		}
+		data, info, err = ResizeStickerImage(data, info, p.getResizeMaxDimension(), maxBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Phone photos carry GPS coordinates and camera details that must not
+	// be shared with everyone who can see the sticker
+	data, err = StripImageMetadata(data, info.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.checkImageLimits(info, len(data)); err != nil {
+		return nil, err
+	}
+
+	if !allowDuplicate {
+		existing, err := p.FindStickerByImage(data)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil {
+			return nil, &DuplicateImageError{Sticker: existing}
+		}
+	}
+
+	key, err := p.StoreImage(data, "sticker."+info.Format)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save sticker image: %w", err)
+	}
+
+	stored := &StickerImage{
+		Filename:   key,
+		UploadedAt: time.Now().UnixMilli(),
+		Format:     info.Format,
+		Width:      info.Width,
+		Height:     info.Height,
+		FrameCount: info.FrameCount,
+		Sanitized:  true,
+		SHA256:     hashImage(data),
+	}
+
+	// Without thumbnails clients fall back to the original image and
+	// without a perceptual hash the sticker is skipped by near-duplicate
+	// detection, so failures here do not fail the upload. decodeUpright
+	// returns the first frame of an animated image.
+	img, err := decodeUpright(data)
+	if err != nil {
+		p.API.LogWarn("Failed to decode sticker image for thumbnails", "filename", key, "error", err.Error())
+		return stored, nil
+	}
+
+	stored.PerceptualHash = PerceptualHash(img)
+	if err := p.generateStickerPreviews(stored, img); err != nil {
+		p.API.LogWarn("Failed to generate sticker thumbnails", "filename", key, "error", err.Error())
+	}
+
+	return stored, nil
+}
+
+// ReleaseStickerImage deletes an image and its generated files unless another
+// sticker uses them, for images that end up not being used
+func (p *Plugin) ReleaseStickerImage(stored *StickerImage) {
+	if err := p.ReleaseImages(stored.Keys()); err != nil {
+		p.API.LogWarn("Failed to release sticker image", "filename", stored.Filename, "error", err.Error())
+	}
+}
+
+// NewStickerFromImage prepares an uploaded image and returns the new, not yet
+// saved, sticker showing it
+func (p *Plugin) NewStickerFromImage(name string, data []byte, filename, creatorID string, allowDuplicate bool) (*Sticker, error) {
+	stored, err := p.PrepareStickerImage(data, filename, allowDuplicate)
+	if err != nil {
+		return nil, err
+	}
+
+	sticker := NewSticker(name, "", "", creatorID)
+	sticker.StickerImage = *stored
+	return sticker, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+)
+
+func encodeTestGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, 4, 3), palette))
+		g.Delay = append(g.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectImage(t *testing.T) {
+	threeFrames := encodeTestGIF(t, 3)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		format     string
+		width      int
+		height     int
+		frameCount int
+		invalid    bool
+	}{
+		{name: "png", data: encodeTestPNG(t, 5, 7), format: "png", width: 5, height: 7, frameCount: 1},
+		{name: "single frame gif", data: encodeTestGIF(t, 1), format: "gif", width: 4, height: 3, frameCount: 1},
+		{name: "animated gif", data: threeFrames, format: "gif", width: 4, height: 3, frameCount: 3},
+		{name: "gif without trailer", data: threeFrames[:len(threeFrames)-1], format: "gif", width: 4, height: 3, frameCount: 3},
+		{name: "truncated gif", data: threeFrames[:len(threeFrames)-8], invalid: true},
+		{name: "gif header only", data: threeFrames[:13], invalid: true},
+		{name: "unknown format", data: []byte("not an image"), invalid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := DetectImage(tt.data)
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidImage) {
+					t.Fatalf("expected ErrInvalidImage, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := ImageInfo{Format: tt.format, Width: tt.width, Height: tt.height, FrameCount: tt.frameCount}
+			if *info != want {
+				t.Errorf("got %+v, want %+v", *info, want)
+			}
+		})
+	}
+}
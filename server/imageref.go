@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
+)
+
+const (
+	// imageRefsKeyPrefix records count the stickers and uploads using a
+	// stored image, by image store key
+	imageRefsKeyPrefix = "image_refs_"
+	imageLockKeyPrefix = "image_lock_"
+)
+
+// DuplicateImageError is returned when an uploaded image is identical to the
+// image of an existing sticker
+type DuplicateImageError struct {
+	Sticker *Sticker
+}
+
+// ErrHiddenDuplicateImage is reported instead of a DuplicateImageError to
+// users who cannot see the existing sticker, so that it is not revealed
+var ErrHiddenDuplicateImage = errors.New("this image is already used by another sticker")
+
+func (e *DuplicateImageError) Error() string {
+	return fmt.Sprintf("this image already exists as sticker '%s'", e.Sticker.Name)
+}
+
+func hashImage(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// imageKey names image content by its SHA-256, keeping the extension of the
+// original filename
+func imageKey(data []byte, filename string) string {
+	return hashImage(data) + strings.ToLower(filepath.Ext(filename))
+}
+
+// StoreImage saves image content under its hash and returns its key. The
+// same content always gets the same key, so it is stored once however many
+// stickers use it. Every call adds a reference to the image, which
+// ReleaseImages drops again. Stores that assign their own keys store every
+// call separately.
+func (p *Plugin) StoreImage(data []byte, filename string) (string, error) {
+	key := imageKey(data, filename)
+	unlock, err := p.lockImage(key)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	// The file is written even when it is already stored, in case the
+	// image garbage collector removed it
+	stored, err := p.SaveStickerImage(key, data)
+	if err != nil {
+		return "", err
+	}
+	if _, err := p.changeImageReferences(stored, 1); err != nil {
+		// The file is left for the image garbage collector, since other
+		// stickers may use it
+		return "", err
+	}
+	return stored, nil
+}
+
+// ReleaseImages drops a reference to each image and deletes the images that
+// nothing references any more, for images a sticker stopped using or that
+// were stored for a sticker that was never saved. Images stored before
+// reference counts have no count and are deleted right away.
+func (p *Plugin) ReleaseImages(keys []string) error {
+	var errs []error
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := p.releaseImage(key); err != nil {
+			errs = append(errs, fmt.Errorf("failed to release image %s: %w", key, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (p *Plugin) releaseImage(key string) error {
+	unlock, err := p.lockImage(key)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	remaining, err := p.changeImageReferences(key, -1)
+	if err != nil {
+		return err
+	}
+	if remaining > 0 {
+		return nil
+	}
+	return p.DeleteStickerImage(key)
+}
+
+// changeImageReferences adds delta to the reference count of an image and
+// returns the new count. The record is deleted once the count drops to zero.
+func (p *Plugin) changeImageReferences(key string, delta int) (int, error) {
+	var count int
+	err := p.compareAndSetWithRetry(imageRefsKeyPrefix+key, func(oldData []byte) ([]byte, bool, error) {
+		count = 0
+		if oldData != nil {
+			if err := json.Unmarshal(oldData, &count); err != nil {
+				return nil, false, fmt.Errorf("failed to unmarshal image references: %w", err)
+			}
+		}
+		if oldData == nil && delta < 0 {
+			return nil, false, nil
+		}
+
+		count = max(count+delta, 0)
+		if count == 0 {
+			return nil, true, nil
+		}
+		newData, err := json.Marshal(count)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal image references: %w", err)
+		}
+		return newData, true, nil
+	})
+	return count, err
+}
+
+// lockImage serializes storing and releasing an image across the cluster, so
+// that a release never deletes a file that an upload of the same content has
+// just stored again. Like the index lock, it is only taken once the plugin
+// is activated.
+func (p *Plugin) lockImage(key string) (func(), error) {
+	if p.indexMutex == nil {
+		return func() {}, nil
+	}
+
+	mutex, err := cluster.NewMutex(p.API, imageLockKeyPrefix+key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create image lock: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), indexLockTimeout)
+	defer cancel()
+	if err := mutex.LockWithContext(ctx); err != nil {
+		return nil, fmt.Errorf("failed to lock image: %w", err)
+	}
+	return mutex.Unlock, nil
+}
+
+// FindStickerByImage returns the sticker whose image has exactly this
+// content, or nil
+func (p *Plugin) FindStickerByImage(data []byte) (*Sticker, error) {
+	list, err := p.GetAllStickers(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := hashImage(data)
+	for _, sticker := range list.Stickers {
+		if sticker.SHA256 == hash {
+			return sticker, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImagesAreStoredByContent(t *testing.T) {
+	dir := t.TempDir()
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{StickerStoragePath: dir})
+
+	data := []byte("image content")
+	first, err := p.StoreImage(data, "a.PNG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := p.StoreImage(data, "b.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second || first != hashImage(data)+".png" {
+		t.Fatalf("keys %q and %q, want both named after the content", first, second)
+	}
+
+	one := NewSticker("one", "", "", "creator")
+	one.Filename, one.SHA256 = first, hashImage(data)
+	saveTestSticker(t, p, one)
+	two := NewSticker("two", "", "", "creator")
+	two.Filename, two.SHA256 = first, hashImage(data)
+	saveTestSticker(t, p, two)
+
+	if found, err := p.FindStickerByImage(data); err != nil || found == nil || found.ID != one.ID {
+		t.Fatalf("found %v, %v", found, err)
+	}
+
+	path := filepath.Join(dir, first)
+	if err := p.DeleteSticker(one.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("image deleted while another sticker uses it: %v", err)
+	}
+
+	if err := p.DeleteSticker(two.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("image kept after its last sticker was deleted: %v", err)
+	}
+}
+
+func TestImageReferences(t *testing.T) {
+	dir := t.TempDir()
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{StickerStoragePath: dir})
+	data := []byte("shared content")
+
+	exists := func(key string) bool {
+		_, err := os.Stat(filepath.Join(dir, key))
+		return err == nil
+	}
+
+	// A sticker and an upload not yet saved share the image
+	key, err := p.StoreImage(data, "sticker.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sticker := NewSticker("wave", "", "", "creator")
+	sticker.Filename = key
+	saveTestSticker(t, p, sticker)
+	if _, err := p.StoreImage(data, "sticker.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := p.DeleteSticker(sticker.ID); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(key) {
+		t.Fatal("image of a pending upload deleted with another sticker")
+	}
+
+	if err := p.ReleaseImages([]string{key}); err != nil {
+		t.Fatal(err)
+	}
+	if exists(key) {
+		t.Error("image kept after its last reference was released")
+	}
+	if _, ok := api.kv[imageRefsKeyPrefix+key]; ok {
+		t.Error("reference record kept after the last release")
+	}
+
+	// Content stored again after its release is kept
+	if _, err := p.StoreImage(data, "sticker.png"); err != nil {
+		t.Fatal(err)
+	}
+	if !exists(key) {
+		t.Error("image stored again is missing")
+	}
+
+	// Images stored before reference counts are deleted on release
+	if err := os.WriteFile(filepath.Join(dir, "legacy.png"), []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.ReleaseImages([]string{"legacy.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if exists("legacy.png") {
+		t.Error("image without references kept")
+	}
+}
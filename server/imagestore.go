@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	storageBackendLocal      = "local"
+	storageBackendMattermost = "mattermost"
+	storageBackendS3         = "s3"
+)
+
+// ErrImageDeleteUnsupported is returned by stores that cannot delete images.
+// The files are left behind and reported by image GC and fsck.
+var ErrImageDeleteUnsupported = errors.New("the Mattermost file store does not support deleting files; unused images must be removed by an administrator")
+
+// StickerImageStore persists sticker image bytes. Save stores them under key,
+// replacing what is stored there, and returns the key to read them back with,
+// which differs from key for stores that assign their own. That key is
+// stored in Sticker.Filename and later passed back to Read and Delete.
+type StickerImageStore interface {
+	Save(key string, fileData []byte) (string, error)
+	Read(key string) ([]byte, error)
+	Delete(key string) error
+	List() ([]StoredImage, error)
+}
+
+// StoredImage describes an image held by a StickerImageStore
+type StoredImage struct {
+	Key        string    `json:"key"`
+	ModifiedAt time.Time `json:"modified_at"`
+}
+
+func (p *Plugin) newImageStore(cfg *configuration) (StickerImageStore, error) {
+	switch cfg.StorageBackend {
+	case "", storageBackendLocal:
+		if cfg.StickerStoragePath == "" {
+			return nil, fmt.Errorf("sticker storage path not configured")
+		}
+		return &localImageStore{dir: cfg.StickerStoragePath}, nil
+	case storageBackendMattermost:
+		return &mattermostImageStore{api: p.API, botID: p.botID}, nil
+	case storageBackendS3:
+		return newS3ImageStore(cfg)
+	default:
+		return nil, fmt.Errorf("unknown storage backend '%s'", cfg.StorageBackend)
+	}
+}
+
+// getImageStore returns the image store for the current configuration,
+// creating it on first use after a configuration change. It is built under
+// the lock so that a store for a replaced configuration is never kept.
+func (p *Plugin) getImageStore() (StickerImageStore, error) {
+	p.configurationLock.RLock()
+	store := p.imageStore
+	p.configurationLock.RUnlock()
+
+	if store != nil {
+		return store, nil
+	}
+
+	p.configurationLock.Lock()
+	defer p.configurationLock.Unlock()
+
+	if p.imageStore == nil {
+		if p.configuration == nil {
+			return nil, fmt.Errorf("plugin configuration not loaded")
+		}
+		store, err := p.newImageStore(p.configuration)
+		if err != nil {
+			return nil, err
+		}
+		p.imageStore = store
+	}
+	return p.imageStore, nil
+}
+
+// localImageStore keeps images as files in a single directory
+type localImageStore struct {
+	dir string
+}
+
+func (s *localImageStore) path(key string) (string, error) {
+	if key == "" || filepath.Base(key) != key {
+		return "", fmt.Errorf("invalid image key '%s'", key)
+	}
+	return filepath.Join(s.dir, key), nil
+}
+
+func (s *localImageStore) Save(key string, fileData []byte) (string, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create storage directory: %w", err)
+	}
+
+	if err := os.WriteFile(fullPath, fileData, 0644); err != nil {
+		return "", fmt.Errorf("failed to write sticker file: %w", err)
+	}
+
+	return key, nil
+}
+
+func (s *localImageStore) Read(key string) ([]byte, error) {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(fullPath)
+}
+
+func (s *localImageStore) Delete(key string) error {
+	fullPath, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fullPath)
+}
+
+func (s *localImageStore) List() ([]StoredImage, error) {
+	entries, err := os.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []StoredImage{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage directory: %w", err)
+	}
+
+	images := make([]StoredImage, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		images = append(images, StoredImage{Key: entry.Name(), ModifiedAt: info.ModTime()})
+	}
+
+	return images, nil
+}
+
+// mattermostImageStore keeps images in the Mattermost file store. Files are
+// uploaded to the plugin bot's direct channel with itself so that they are
+// not attached to any user-visible channel.
+type mattermostImageStore struct {
+	api   plugin.API
+	botID string
+}
+
+func (s *mattermostImageStore) channel() (*model.Channel, error) {
+	channel, appErr := s.api.GetDirectChannel(s.botID, s.botID)
+	if appErr != nil {
+		return nil, fmt.Errorf("failed to get storage channel: %w", appErr)
+	}
+	return channel, nil
+}
+
+// Save uploads the file named after key; the file store assigns the key
+func (s *mattermostImageStore) Save(key string, fileData []byte) (string, error) {
+	if s.botID == "" {
+		return "", fmt.Errorf("sticker bot is not available")
+	}
+
+	channel, err := s.channel()
+	if err != nil {
+		return "", err
+	}
+
+	fileInfo, appErr := s.api.UploadFile(fileData, channel.Id, key)
+	if appErr != nil {
+		return "", fmt.Errorf("failed to upload file: %w", appErr)
+	}
+
+	return fileInfo.Id, nil
+}
+
+func (s *mattermostImageStore) Read(key string) ([]byte, error) {
+	data, appErr := s.api.GetFile(key)
+	if appErr != nil {
+		return nil, fmt.Errorf("failed to get file: %w", appErr)
+	}
+	return data, nil
+}
+
+// Delete always fails: the plugin API offers no way to remove files from the
+// Mattermost file store.
+func (s *mattermostImageStore) Delete(key string) error {
+	return ErrImageDeleteUnsupported
+}
+
+func (s *mattermostImageStore) List() ([]StoredImage, error) {
+	if s.botID == "" {
+		return nil, fmt.Errorf("sticker bot is not available")
+	}
+
+	channel, err := s.channel()
+	if err != nil {
+		return nil, err
+	}
+
+	const perPage = 200
+	images := []StoredImage{}
+	for page := 0; ; page++ {
+		infos, appErr := s.api.GetFileInfos(page, perPage, &model.GetFileInfosOptions{
+			ChannelIds: []string{channel.Id},
+		})
+		if appErr != nil {
+			return nil, fmt.Errorf("failed to list files: %w", appErr)
+		}
+
+		for _, info := range infos {
+			images = append(images, StoredImage{Key: info.Id, ModifiedAt: time.UnixMilli(info.UpdateAt)})
+		}
+
+		if len(infos) < perPage {
+			return images, nil
+		}
+	}
+}
+
+// s3ImageStore keeps images in an S3-compatible bucket
+type s3ImageStore struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3ImageStore(cfg *configuration) (*s3ImageStore, error) {
+	if cfg.S3Endpoint == "" || cfg.S3Bucket == "" {
+		return nil, fmt.Errorf("S3 endpoint and bucket must be configured")
+	}
+
+	client, err := minio.New(cfg.S3Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.S3AccessKeyID, cfg.S3SecretAccessKey, ""),
+		Secure: cfg.S3UseSSL,
+		Region: cfg.S3Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create S3 client: %w", err)
+	}
+
+	return &s3ImageStore{
+		client: client,
+		bucket: cfg.S3Bucket,
+		prefix: strings.Trim(cfg.S3PathPrefix, "/"),
+	}, nil
+}
+
+func (s *s3ImageStore) objectName(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3ImageStore) Save(key string, fileData []byte) (string, error) {
+	_, err := s.client.PutObject(context.Background(), s.bucket, s.objectName(key), bytes.NewReader(fileData), int64(len(fileData)), minio.PutObjectOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload sticker to S3: %w", err)
+	}
+
+	return key, nil
+}
+
+func (s *s3ImageStore) Read(key string) ([]byte, error) {
+	obj, err := s.client.GetObject(context.Background(), s.bucket, s.objectName(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sticker from S3: %w", err)
+	}
+	defer obj.Close()
+
+	return io.ReadAll(obj)
+}
+
+func (s *s3ImageStore) Delete(key string) error {
+	return s.client.RemoveObject(context.Background(), s.bucket, s.objectName(key), minio.RemoveObjectOptions{})
+}
+
+func (s *s3ImageStore) List() ([]StoredImage, error) {
+	listPrefix := ""
+	if s.prefix != "" {
+		listPrefix = s.prefix + "/"
+	}
+
+	images := []StoredImage{}
+	for obj := range s.client.ListObjects(context.Background(), s.bucket, minio.ListObjectsOptions{Prefix: listPrefix}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list S3 objects: %w", obj.Err)
+		}
+		key := strings.TrimPrefix(obj.Key, listPrefix)
+		if key == "" || strings.HasSuffix(key, "/") {
+			continue
+		}
+		images = append(images, StoredImage{Key: key, ModifiedAt: obj.LastModified})
+	}
+
+	return images, nil
+}
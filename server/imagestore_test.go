@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// fakeS3 is an S3-compatible server holding objects in memory. It speaks just
+// enough of the protocol for the requests the MinIO client sends for put,
+// get, delete and list.
+type fakeS3 struct {
+	bucket string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+type fakeS3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	Size         int    `xml:"Size"`
+	ETag         string `xml:"ETag"`
+}
+
+type fakeS3ListResult struct {
+	XMLName     xml.Name       `xml:"ListBucketResult"`
+	Name        string         `xml:"Name"`
+	Prefix      string         `xml:"Prefix"`
+	KeyCount    int            `xml:"KeyCount"`
+	MaxKeys     int            `xml:"MaxKeys"`
+	IsTruncated bool           `xml:"IsTruncated"`
+	Contents    []fakeS3Object `xml:"Contents"`
+}
+
+var fakeS3ModifiedAt = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	bucket, object, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != s.bucket {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodGet && object == "":
+		s.list(w, r.URL.Query().Get("prefix"))
+
+	case r.Method == http.MethodPut:
+		data, err := readS3Body(r)
+		if err != nil {
+			fakeS3Error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[object] = data
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[object]
+		if !ok {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", fakeS3ModifiedAt.Format(http.TimeFormat))
+		w.Header().Set("ETag", `"`+strconv.Itoa(len(data))+`"`)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(data)
+		}
+
+	case r.Method == http.MethodDelete:
+		delete(s.objects, object)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		fakeS3Error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, prefix string) {
+	result := fakeS3ListResult{Name: s.bucket, Prefix: prefix, MaxKeys: 1000}
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, fakeS3Object{
+				Key:          key,
+				LastModified: fakeS3ModifiedAt.Format(time.RFC3339),
+				Size:         len(data),
+				ETag:         `"` + strconv.Itoa(len(data)) + `"`,
+			})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool {
+		return result.Contents[i].Key < result.Contents[j].Key
+	})
+	result.KeyCount = len(result.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+func fakeS3Error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+// readS3Body reads a request body, decoding the aws-chunked encoding that
+// signed uploads over plain HTTP use
+func readS3Body(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+
+	var data []byte
+	reader := bufio.NewReader(r.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func TestS3ImageStore(t *testing.T) {
+	s3 := &fakeS3{bucket: "stickers", objects: map[string][]byte{
+		// Outside the configured prefix, so never listed
+		"other/unrelated.png": []byte("other"),
+	}}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	store, err := newS3ImageStore(&configuration{
+		S3Endpoint:        strings.TrimPrefix(server.URL, "http://"),
+		S3Bucket:          "stickers",
+		S3PathPrefix:      "/plugin/images/",
+		S3Region:          "us-east-1",
+		S3AccessKeyID:     "access",
+		S3SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("\x89PNG\r\n\x1a\nnot really a png")
+	key, err := store.Save(imageKey(data, "Wave.PNG"), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != hashImage(data)+".png" {
+		t.Errorf("unexpected key %q", key)
+	}
+	if stored := s3.objects["plugin/images/"+key]; !bytes.Equal(stored, data) {
+		t.Errorf("object under the prefix holds %q", stored)
+	}
+
+	read, err := store.Read(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Errorf("read %q, want %q", read, data)
+	}
+
+	images, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(images) != 1 || images[0].Key != key || !images[0].ModifiedAt.Equal(fakeS3ModifiedAt) {
+		t.Errorf("listed %+v", images)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s3.objects["plugin/images/"+key]; ok {
+		t.Error("object still stored after delete")
+	}
+	if _, err := store.Read(key); err == nil {
+		t.Error("read of a deleted image succeeded")
+	}
+}
+
+func TestNewS3ImageStoreRequiresBucket(t *testing.T) {
+	if _, err := newS3ImageStore(&configuration{S3Endpoint: "localhost:9000"}); err == nil {
+		t.Error("store created without a bucket")
+	}
+}
+
+func TestMattermostImageStoreDeleteIsReported(t *testing.T) {
+	store := &mattermostImageStore{}
+	if err := store.Delete("file"); !errors.Is(err, ErrImageDeleteUnsupported) {
+		t.Errorf("delete returned %v", err)
+	}
+}
+
+func TestCollectOrphanImagesReportsUnsupportedDelete(t *testing.T) {
+	api := newFakeAPI()
+	old := time.Now().Add(-48 * time.Hour).UnixMilli()
+	api.files = []*model.FileInfo{{Id: "orphan1", UpdateAt: old}, {Id: "orphan2", UpdateAt: old}}
+
+	p := newTestPlugin(api, &configuration{StorageBackend: storageBackendMattermost})
+	p.botID = "bot"
+
+	report, err := p.CollectOrphanImages(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Candidates) != 2 || len(report.Deleted) != 0 {
+		t.Errorf("candidates %v, deleted %v", report.Candidates, report.Deleted)
+	}
+	if len(report.Errors) != 1 || report.Errors[0] != ErrImageDeleteUnsupported.Error() {
+		t.Errorf("errors %q", report.Errors)
+	}
+}
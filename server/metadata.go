@@ -0,0 +1,426 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// StripImageMetadata removes EXIF, XMP, ICC profiles, comments and text
+// chunks from an image without re-encoding it. Only the container is
+// rewritten, so the pixels are unchanged. The EXIF orientation of a JPEG is
+// kept, since without it rotated photos are displayed sideways.
+func StripImageMetadata(data []byte, format string) ([]byte, error) {
+	var (
+		stripped []byte
+		err      error
+	)
+
+	switch format {
+	case "png":
+		stripped, err = stripPNGMetadata(data)
+	case "jpg":
+		stripped, err = stripJPEGMetadata(data)
+	case "gif":
+		stripped, err = stripGIFMetadata(data)
+	case "webp":
+		stripped, err = stripWebPMetadata(data)
+	default:
+		return nil, fmt.Errorf("%w: cannot strip metadata from %s images", ErrInvalidImage, format)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: corrupt %s image: %s", ErrInvalidImage, format, err.Error())
+	}
+	return stripped, nil
+}
+
+var errTruncated = errors.New("unexpected end of data")
+
+// pngMetadataChunks are the ancillary chunks carrying text, EXIF, ICC
+// profiles or timestamps
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+	"iCCP": true,
+	"tIME": true,
+}
+
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signatureLength = 8
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:signatureLength]...)
+
+	for offset := signatureLength; offset < len(data); {
+		if offset+8 > len(data) {
+			return nil, errTruncated
+		}
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		chunkType := string(data[offset+4 : offset+8])
+
+		// Length, type, data and CRC
+		end := offset + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errTruncated
+		}
+
+		if !pngMetadataChunks[chunkType] {
+			out = append(out, data[offset:end]...)
+		}
+		offset = end
+
+		if chunkType == "IEND" {
+			break
+		}
+	}
+
+	return out, nil
+}
+
+const (
+	jpegMarkerSOS  = 0xda
+	jpegMarkerEOI  = 0xd9
+	jpegMarkerAPP0 = 0xe0
+	jpegMarkerAPP1 = 0xe1
+	// APP14 holds the Adobe color transform, which decoders need
+	jpegMarkerAPP14 = 0xee
+	jpegMarkerAPP15 = 0xef
+	jpegMarkerCOM   = 0xfe
+)
+
+// stripJPEGMetadata drops the APPn segments other than JFIF and Adobe, which
+// is where EXIF, XMP and ICC profiles live, and comment segments. An EXIF
+// orientation is replaced by a segment holding nothing else.
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	// Start of image
+	out = append(out, data[:2]...)
+	keptOrientation := false
+
+	for offset := 2; ; {
+		if offset+2 > len(data) {
+			return nil, errTruncated
+		}
+		if data[offset] != 0xff {
+			return nil, fmt.Errorf("expected marker at offset %d", offset)
+		}
+
+		marker := data[offset+1]
+		switch {
+		case marker == 0xff:
+			// Fill byte
+			offset++
+			continue
+		case marker == jpegMarkerEOI:
+			return append(out, data[offset:offset+2]...), nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// Standalone markers without a length
+			out = append(out, data[offset:offset+2]...)
+			offset += 2
+			continue
+		}
+
+		if offset+4 > len(data) {
+			return nil, errTruncated
+		}
+		end := offset + 2 + int(binary.BigEndian.Uint16(data[offset+2:offset+4]))
+		if end > len(data) {
+			return nil, errTruncated
+		}
+
+		if marker == jpegMarkerSOS {
+			// Entropy-coded data follows; nothing after it is metadata we
+			// strip, so copy the rest verbatim
+			return append(out, data[offset:]...), nil
+		}
+
+		metadata := marker == jpegMarkerCOM ||
+			(marker > jpegMarkerAPP0 && marker <= jpegMarkerAPP15 && marker != jpegMarkerAPP14)
+		if !metadata {
+			out = append(out, data[offset:end]...)
+		} else if marker == jpegMarkerAPP1 && !keptOrientation {
+			if orientation := exifOrientation(data[offset+4 : end]); orientation > 1 {
+				out = append(out, exifOrientationSegment(orientation)...)
+				keptOrientation = true
+			}
+		}
+		offset = end
+	}
+}
+
+const exifTagOrientation = 0x0112
+
+var exifHeader = []byte("Exif\x00\x00")
+
+// jpegOrientation returns the EXIF orientation of a JPEG image, or 1 when it
+// has none or is not a JPEG
+func jpegOrientation(data []byte) int {
+	if sniffImageFormat(data) != "jpg" {
+		return 1
+	}
+
+	for offset := 2; offset+4 <= len(data); {
+		if data[offset] != 0xff {
+			return 1
+		}
+
+		marker := data[offset+1]
+		switch {
+		case marker == 0xff:
+			offset++
+			continue
+		case marker == jpegMarkerSOS || marker == jpegMarkerEOI:
+			return 1
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			offset += 2
+			continue
+		}
+
+		end := offset + 2 + int(binary.BigEndian.Uint16(data[offset+2:offset+4]))
+		if end > len(data) {
+			return 1
+		}
+		if marker == jpegMarkerAPP1 {
+			if orientation := exifOrientation(data[offset+4 : end]); orientation != 0 {
+				return orientation
+			}
+		}
+		offset = end
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation from the first IFD of an APP1
+// payload, or returns 0 when it is not EXIF or has no valid orientation
+func exifOrientation(payload []byte) int {
+	if !bytes.HasPrefix(payload, exifHeader) {
+		return 0
+	}
+	tiff := payload[len(exifHeader):]
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	ifd := int64(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > int64(len(tiff)) {
+		return 0
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := int(ifd) + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:]) != exifTagOrientation {
+			continue
+		}
+		// A single SHORT is stored at the start of the value field
+		if orientation := int(order.Uint16(tiff[entry+8:])); orientation >= 1 && orientation <= 8 {
+			return orientation
+		}
+		return 0
+	}
+	return 0
+}
+
+// exifOrientationSegment builds an APP1 segment whose EXIF holds only the
+// orientation
+func exifOrientationSegment(orientation int) []byte {
+	segment := []byte{0xff, jpegMarkerAPP1, 0, 0}
+	segment = append(segment, exifHeader...)
+	// Big-endian TIFF header with the first IFD right after it
+	segment = append(segment, 'M', 'M', 0, 42, 0, 0, 0, 8)
+	// One entry of type SHORT and count 1, then no next IFD
+	segment = append(segment,
+		0, 1,
+		exifTagOrientation>>8, exifTagOrientation&0xff, 0, 3, 0, 0, 0, 1, 0, byte(orientation), 0, 0,
+		0, 0, 0, 0,
+	)
+	binary.BigEndian.PutUint16(segment[2:4], uint16(len(segment)-2))
+	return segment
+}
+
+const (
+	gifBlockExtension       = 0x21
+	gifBlockImage           = 0x2c
+	gifBlockTrailer         = 0x3b
+	gifExtensionComment     = 0xfe
+	gifExtensionApplication = 0xff
+)
+
+// gifAnimationApplications are the application extensions that control
+// looping and must be kept
+var gifAnimationApplications = []string{"NETSCAPE2.0", "ANIMEXTS1.0"}
+
+// stripGIFMetadata drops comment extensions and application extensions
+// other than the looping ones, which is where XMP is stored
+func stripGIFMetadata(data []byte) ([]byte, error) {
+	// Header and logical screen descriptor
+	const headerLength = 13
+	if len(data) < headerLength {
+		return nil, errTruncated
+	}
+
+	offset := headerLength
+	if flags := data[10]; flags&0x80 != 0 {
+		offset += 3 << ((flags & 0x07) + 1)
+	}
+	if offset > len(data) {
+		return nil, errTruncated
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:offset]...)
+
+	for offset < len(data) {
+		start := offset
+		switch data[offset] {
+		case gifBlockTrailer:
+			return append(out, data[offset]), nil
+
+		case gifBlockImage:
+			// Image descriptor, local color table, LZW code size, data
+			const descriptorLength = 10
+			if offset+descriptorLength > len(data) {
+				return nil, errTruncated
+			}
+			flags := data[offset+9]
+			offset += descriptorLength
+			if flags&0x80 != 0 {
+				offset += 3 << ((flags & 0x07) + 1)
+			}
+			offset++
+			end, err := skipGIFSubBlocks(data, offset)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, data[start:end]...)
+			offset = end
+
+		case gifBlockExtension:
+			if offset+2 > len(data) {
+				return nil, errTruncated
+			}
+			label := data[offset+1]
+			end, err := skipGIFSubBlocks(data, offset+2)
+			if err != nil {
+				return nil, err
+			}
+
+			keep := true
+			switch label {
+			case gifExtensionComment:
+				keep = false
+			case gifExtensionApplication:
+				keep = isGIFAnimationApplication(data[offset+2 : end])
+			}
+			if keep {
+				out = append(out, data[start:end]...)
+			}
+			offset = end
+
+		default:
+			return nil, fmt.Errorf("unknown block 0x%02x at offset %d", data[offset], offset)
+		}
+	}
+
+	// Decoders tolerate a missing trailer, so supply one
+	return append(out, gifBlockTrailer), nil
+}
+
+// skipGIFSubBlocks returns the offset after the sub-block chain starting at
+// offset, including its zero-length terminator
+func skipGIFSubBlocks(data []byte, offset int) (int, error) {
+	for {
+		if offset >= len(data) {
+			return 0, errTruncated
+		}
+		size := int(data[offset])
+		offset++
+		if size == 0 {
+			return offset, nil
+		}
+		offset += size
+	}
+}
+
+// isGIFAnimationApplication reports whether the sub-blocks of an application
+// extension identify one of gifAnimationApplications
+func isGIFAnimationApplication(blocks []byte) bool {
+	if len(blocks) < 12 || blocks[0] != 11 {
+		return false
+	}
+	identifier := string(blocks[1:12])
+	for _, app := range gifAnimationApplications {
+		if identifier == app {
+			return true
+		}
+	}
+	return false
+}
+
+// WebP VP8X feature flags for the chunks stripped below
+const (
+	webpFlagICC  = 0x20
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+var webpMetadataChunks = map[string]bool{
+	"ICCP": true,
+	"EXIF": true,
+	"XMP ": true,
+}
+
+// stripWebPMetadata drops the ICCP, EXIF and XMP chunks, clears their flags
+// in the VP8X header and fixes up the RIFF size
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	const headerLength = 12
+	if len(data) < headerLength {
+		return nil, errTruncated
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:headerLength]...)
+
+	for offset := headerLength; offset < len(data); {
+		if offset+8 > len(data) {
+			return nil, errTruncated
+		}
+		fourCC := string(data[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+
+		// Chunks are padded to an even size
+		end := offset + 8 + size + size%2
+		if size < 0 || offset+8+size > len(data) {
+			return nil, fmt.Errorf("truncated %s chunk", fourCC)
+		}
+		end = min(end, len(data))
+
+		if !webpMetadataChunks[fourCC] {
+			chunkStart := len(out)
+			out = append(out, data[offset:end]...)
+			if fourCC == "VP8X" && size > 0 {
+				out[chunkStart+8] &^= webpFlagICC | webpFlagEXIF | webpFlagXMP
+			}
+		}
+		offset = end
+	}
+
+	binary.LittleEndian.PutUint32(out[4:8], uint32(len(out)-8))
+	return out, nil
+}
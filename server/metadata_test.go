@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+// exifSegment builds an APP1 segment with a little-endian EXIF holding the
+// orientation and a camera make, the kind of detail that must not survive
+func exifSegment(orientation int) []byte {
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 2, 0}
+	entry := make([]byte, 12)
+	binary.LittleEndian.PutUint16(entry[0:], exifTagOrientation)
+	binary.LittleEndian.PutUint16(entry[2:], 3)
+	binary.LittleEndian.PutUint32(entry[4:], 1)
+	binary.LittleEndian.PutUint16(entry[8:], uint16(orientation))
+	tiff = append(tiff, entry...)
+	// Make, ASCII, stored inline
+	tiff = append(tiff, 0x0f, 0x01, 2, 0, 4, 0, 0, 0, 'A', 'C', 'M', 0)
+	tiff = append(tiff, 0, 0, 0, 0)
+
+	segment := []byte{0xff, jpegMarkerAPP1, 0, 0}
+	segment = append(segment, exifHeader...)
+	segment = append(segment, tiff...)
+	binary.BigEndian.PutUint16(segment[2:4], uint16(len(segment)-2))
+	return segment
+}
+
+// testJPEG encodes a wide image, red on the left and blue on the right, with
+// the given EXIF orientation
+func testJPEG(t *testing.T, orientation int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{R: 0xff, A: 0xff}
+			if x >= 32 {
+				c = color.RGBA{B: 0xff, A: 0xff}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	withExif := append([]byte{}, data[:2]...)
+	withExif = append(withExif, exifSegment(orientation)...)
+	return append(withExif, data[2:]...)
+}
+
+func TestStripJPEGMetadataKeepsOrientation(t *testing.T) {
+	tests := []struct {
+		name        string
+		orientation int
+		wantExif    bool
+	}{
+		{name: "upright", orientation: 1, wantExif: false},
+		{name: "rotated", orientation: 6, wantExif: true},
+		{name: "mirrored", orientation: 2, wantExif: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stripped, err := StripImageMetadata(testJPEG(t, tt.orientation), "jpg")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(stripped, []byte("ACM")) {
+				t.Error("camera make survived stripping")
+			}
+			if got := bytes.Contains(stripped, exifHeader); got != tt.wantExif {
+				t.Errorf("EXIF kept = %v, want %v", got, tt.wantExif)
+			}
+			if got := jpegOrientation(stripped); got != tt.orientation {
+				t.Errorf("orientation %d, want %d", got, tt.orientation)
+			}
+			if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+				t.Errorf("stripped image does not decode: %v", err)
+			}
+		})
+	}
+}
+
+func TestResizeAppliesOrientation(t *testing.T) {
+	// Orientation 6 shows the image turned a quarter clockwise, so red ends
+	// up on top
+	data := testJPEG(t, 6)
+
+	info, err := DetectImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Width != 32 || info.Height != 64 {
+		t.Fatalf("detected %dx%d, want 32x64 as displayed", info.Width, info.Height)
+	}
+
+	resized, resizedInfo, err := ResizeStickerImage(data, info, 16, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resizedInfo.Width != 8 || resizedInfo.Height != 16 {
+		t.Fatalf("resized to %dx%d, want 8x16", resizedInfo.Width, resizedInfo.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(resized))
+	if err != nil {
+		t.Fatal(err)
+	}
+	top, _, _, _ := img.At(4, 2).RGBA()
+	bottom, _, _, _ := img.At(4, 13).RGBA()
+	if top < 0x8000 || bottom > 0x8000 {
+		t.Errorf("red is not on top: top red %x, bottom red %x", top, bottom)
+	}
+}
+
+// secret marks metadata that must not survive stripping
+var secret = []byte("SECRET-METADATA")
+
+func testPNGWithText(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	// A tEXt chunk right after the signature and IHDR
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(secret)))
+	chunk = append(chunk, "tEXt"...)
+	chunk = append(chunk, secret...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	const ihdrEnd = 8 + 25
+	withText := append([]byte{}, data[:ihdrEnd]...)
+	withText = append(withText, chunk...)
+	return append(withText, data[ihdrEnd:]...)
+}
+
+func testGIFWithComment(t *testing.T) []byte {
+	t.Helper()
+
+	palette := color.Palette{color.Black, color.White}
+	frame := image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &gif.GIF{
+		Image: []*image.Paletted{frame, frame},
+		Delay: []int{10, 10},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	comment := []byte{gifBlockExtension, gifExtensionComment, byte(len(secret))}
+	comment = append(comment, secret...)
+	comment = append(comment, 0)
+
+	withComment := append([]byte{}, data[:len(data)-1]...)
+	withComment = append(withComment, comment...)
+	return append(withComment, gifBlockTrailer)
+}
+
+func webpChunk(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func testWebPWithEXIF() []byte {
+	vp8x := make([]byte, 10)
+	vp8x[0] = webpFlagEXIF | webpFlagXMP
+
+	body := []byte("WEBP")
+	body = append(body, webpChunk("VP8X", vp8x)...)
+	body = append(body, webpChunk("VP8L", []byte{0x2f, 1, 2, 3, 4})...)
+	body = append(body, webpChunk("EXIF", secret)...)
+	body = append(body, webpChunk("XMP ", secret)...)
+
+	data := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	return append(data, body...)
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   []byte
+		decode bool
+		check  func(t *testing.T, stripped []byte)
+	}{
+		{name: "png text", format: "png", data: testPNGWithText(t), decode: true},
+		{
+			name: "gif comment", format: "gif", data: testGIFWithComment(t), decode: true,
+			check: func(t *testing.T, stripped []byte) {
+				if !bytes.Contains(stripped, []byte("NETSCAPE2.0")) {
+					t.Error("looping extension dropped")
+				}
+			},
+		},
+		{
+			name: "webp exif and xmp", format: "webp", data: testWebPWithEXIF(),
+			check: func(t *testing.T, stripped []byte) {
+				if size := binary.LittleEndian.Uint32(stripped[4:8]); int(size) != len(stripped)-8 {
+					t.Errorf("RIFF size %d for %d bytes", size, len(stripped))
+				}
+				if flags := stripped[20]; flags&(webpFlagEXIF|webpFlagXMP) != 0 {
+					t.Errorf("VP8X flags 0x%02x still announce metadata", flags)
+				}
+				if !bytes.Contains(stripped, []byte("VP8L")) {
+					t.Error("image data dropped")
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stripped, err := StripImageMetadata(tt.data, tt.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(stripped, secret) {
+				t.Error("metadata survived stripping")
+			}
+			if tt.decode {
+				if _, _, err := image.Decode(bytes.NewReader(stripped)); err != nil {
+					t.Errorf("stripped image does not decode: %v", err)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, stripped)
+			}
+		})
+	}
+}
+
+func TestStripImageMetadataRejectsCorruptImages(t *testing.T) {
+	tests := []struct {
+		format string
+		data   []byte
+	}{
+		{format: "png", data: testPNGWithText(t)[:40]},
+		{format: "gif", data: []byte("GIF89a")},
+		{format: "webp", data: testWebPWithEXIF()[:24]},
+		{format: "bmp", data: []byte("BM")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			if _, err := StripImageMetadata(tt.data, tt.format); !errors.Is(err, ErrInvalidImage) {
+				t.Errorf("returned %v", err)
+			}
+		})
+	}
+}
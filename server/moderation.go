@@ -0,0 +1,529 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Sticker moderation states. In moderated mode new uploads are pending until
+// a moderator approves them; a rejected sticker is deleted right away. Edits
+// of an approved sticker are held as its pending revision instead, and
+// rejecting them only drops the revision.
+const (
+	StickerStatusApproved = "approved"
+	StickerStatusPending  = "pending"
+	StickerStatusRejected = "rejected"
+)
+
+const (
+	moderationActionApprove = "approve"
+	moderationActionReject  = "reject"
+
+	// moderationActionPath receives the interactive button clicks of the
+	// moderator notifications
+	moderationActionPath = "/api/v1/moderation/action"
+)
+
+var (
+	ErrStickerPending    = errors.New("this sticker is awaiting moderator approval")
+	ErrStickerNotPending = errors.New("sticker is not awaiting approval")
+)
+
+// PendingList is the list of stickers awaiting approval, oldest first
+type PendingList struct {
+	Stickers []*Sticker `json:"stickers"`
+	Total    int        `json:"total"`
+}
+
+// StickerRevision is the reviewed fields of an approved sticker as edited,
+// with the images the sticker keeps once the edit is approved. UserID is the
+// user who last changed them and CreatedAt when the first edit was held.
+type StickerRevision struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags"`
+	Aliases     []string `json:"aliases"`
+
+	StickerImage
+	PreviousImages []PreviousImage `json:"previous_images,omitempty"`
+
+	UserID    string `json:"user_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// images returns the revision's image followed by its previous images
+func (r *StickerRevision) images() []StickerImage {
+	return stickerImages(r.StickerImage, r.PreviousImages)
+}
+
+// withPendingRevision returns a copy of the sticker showing its pending
+// revision, or an unchanged copy when it has none. The copy can be modified
+// without affecting the sticker.
+func (s *Sticker) withPendingRevision() *Sticker {
+	revised := *s
+	if r := s.PendingRevision; r != nil {
+		revised.Name = r.Name
+		revised.Description = r.Description
+		revised.Tags = r.Tags
+		revised.Aliases = r.Aliases
+		revised.StickerImage = r.StickerImage
+		revised.PreviousImages = r.PreviousImages
+	}
+	revised.Tags = slices.Clone(revised.Tags)
+	revised.Aliases = slices.Clone(revised.Aliases)
+	revised.PreviousImages = slices.Clone(revised.PreviousImages)
+	return &revised
+}
+
+// getModeratorIDs returns the user IDs of the configured moderators. The
+// usernames are resolved once after each configuration change.
+func (p *Plugin) getModeratorIDs() []string {
+	p.configurationLock.RLock()
+	ids, loaded := p.moderatorIDs, p.moderatorsLoaded
+	p.configurationLock.RUnlock()
+
+	if loaded {
+		return ids
+	}
+
+	p.configurationLock.Lock()
+	defer p.configurationLock.Unlock()
+
+	if !p.moderatorsLoaded {
+		p.moderatorIDs = p.resolveModerators(p.configuration)
+		p.moderatorsLoaded = true
+	}
+	return p.moderatorIDs
+}
+
+// resolveModerators resolves the configured moderator usernames to user IDs,
+// skipping names that do not exist
+func (p *Plugin) resolveModerators(cfg *configuration) []string {
+	if cfg == nil {
+		return nil
+	}
+
+	var ids []string
+	for _, name := range strings.Split(cfg.Moderators, ",") {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "@")
+		if name == "" {
+			continue
+		}
+		user, appErr := p.API.GetUserByUsername(name)
+		if appErr != nil {
+			p.API.LogWarn("Configured sticker moderator not found", "username", name)
+			continue
+		}
+		ids = append(ids, user.Id)
+	}
+	return ids
+}
+
+// isModerator reports whether the user is one of the configured moderators
+func (p *Plugin) isModerator(userID string) bool {
+	for _, id := range p.getModeratorIDs() {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// SubmitSticker saves a newly created sticker. In moderated mode it is held
+// for approval and the moderators are notified, unless the creator can
+// moderate stickers themselves. If the sticker cannot be saved, its prepared
+// image is released.
+func (p *Plugin) SubmitSticker(sticker *Sticker) error {
+	if p.needsReview(sticker.CreatorID) {
+		sticker.Status = StickerStatusPending
+	}
+
+	if err := p.SaveSticker(sticker); err != nil {
+		// The record may have been written before the index failed; the
+		// image is only released once nothing refers to it
+		if appErr := p.API.KVDelete(stickerKeyPrefix + sticker.ID); appErr != nil {
+			p.API.LogWarn("Failed to delete unsaved sticker", "sticker_id", sticker.ID, "error", appErr.Error())
+			return err
+		}
+		p.notifyStickerChanged(sticker.ID)
+		p.ReleaseStickerImage(&sticker.StickerImage)
+		return err
+	}
+
+	if sticker.IsPending() {
+		p.notifyModerators(sticker, "uploaded")
+	}
+	return nil
+}
+
+// reviewedFields are the changes that send an approved sticker back to the
+// moderators in moderated mode
+var reviewedFields = []string{"name", "description", "tags", "aliases", "image"}
+
+// needsReview reports whether an edit by the user must be approved again
+// before others can use the sticker
+func (p *Plugin) needsReview(userID string) bool {
+	return p.getConfiguration().ModerationEnabled && p.Authorize(userID, ActionModerate, Target{}) != nil
+}
+
+// changesReviewedFields reports whether any of the changes needs approval
+func changesReviewedFields(changes []string) bool {
+	return slices.ContainsFunc(changes, func(field string) bool {
+		return slices.Contains(reviewedFields, field)
+	})
+}
+
+// holdForReview turns an edit of an approved sticker into its pending
+// revision. edited is the sticker after the edit was applied on top of the
+// pending revision of approved. It gets back the reviewed fields of approved,
+// and their edited values become its pending revision unless they are those
+// of approved. It reports whether the edit started a revision and returns
+// the image keys only used by a revision the edit undid.
+func holdForReview(edited, approved *Sticker, userID string) (bool, []string) {
+	revised := snapshotSticker(edited)
+	revision := &StickerRevision{
+		Name:           edited.Name,
+		Description:    edited.Description,
+		Tags:           edited.Tags,
+		Aliases:        edited.Aliases,
+		StickerImage:   edited.StickerImage,
+		PreviousImages: edited.PreviousImages,
+		UserID:         userID,
+		CreatedAt:      time.Now().UnixMilli(),
+	}
+
+	edited.Name = approved.Name
+	edited.Description = approved.Description
+	edited.Tags = slices.Clone(approved.Tags)
+	edited.Aliases = slices.Clone(approved.Aliases)
+	edited.StickerImage = approved.StickerImage
+	edited.PreviousImages = slices.Clone(approved.PreviousImages)
+
+	if !changesReviewedFields(changedFields(snapshotSticker(approved), revised)) {
+		edited.PendingRevision = nil
+		return false, unsharedImageKeys(revision.images(), approved.images())
+	}
+
+	previous := approved.PendingRevision
+	if previous != nil {
+		revision.CreatedAt = previous.CreatedAt
+		if !changesReviewedFields(changedFields(snapshotSticker(approved.withPendingRevision()), revised)) {
+			revision.UserID = previous.UserID
+		}
+	}
+	edited.PendingRevision = revision
+	return previous == nil, nil
+}
+
+// applyPendingRevision makes the pending revision the sticker's approved
+// state. Its name and aliases are checked again, since other stickers may
+// have taken them while it waited. Images the sticker shows that the
+// revision does not, such as one a moderator put in place meanwhile, are
+// kept as previous images.
+func (p *Plugin) applyPendingRevision(sticker *Sticker) error {
+	revision := sticker.PendingRevision
+	for _, name := range append([]string{revision.Name}, revision.Aliases...) {
+		if p.isStickerNameTakenBy(name, sticker.ID) {
+			return fmt.Errorf("name '%s' is %w", name, ErrNameTaken)
+		}
+	}
+
+	kept := make(map[string]bool)
+	for _, image := range revision.images() {
+		kept[image.Filename] = true
+	}
+	previousImages := slices.Clone(revision.PreviousImages)
+	for _, previous := range sticker.PreviousImages {
+		if !kept[previous.Filename] {
+			previousImages = append(previousImages, previous)
+		}
+	}
+	if sticker.Filename != "" && !kept[sticker.Filename] {
+		previousImages = append(previousImages, PreviousImage{
+			StickerImage: sticker.StickerImage,
+			ReplacedAt:   time.Now().UnixMilli(),
+			ReplacedBy:   revision.UserID,
+		})
+	}
+
+	sticker.Name = revision.Name
+	sticker.Description = revision.Description
+	sticker.Tags = revision.Tags
+	sticker.Aliases = revision.Aliases
+	sticker.StickerImage = revision.StickerImage
+	sticker.PreviousImages = previousImages
+	sticker.PendingRevision = nil
+	return nil
+}
+
+// notifyModerators sends every moderator a direct message from the bot with
+// buttons to approve or reject the sticker, and records the posts so that
+// they can be updated once the sticker is decided. The event says what the
+// creator did, such as "uploaded" or "changed".
+func (p *Plugin) notifyModerators(sticker *Sticker, event string) {
+	moderatorIDs := p.getModeratorIDs()
+	if len(moderatorIDs) == 0 {
+		p.API.LogWarn("No sticker moderators are configured; the sticker stays pending", "sticker_id", sticker.ID)
+		return
+	}
+
+	creator := p.displayUsername(sticker.CreatorID)
+	shown := sticker
+	imageURL := p.GetStickerPublicURL(sticker, "")
+	if sticker.PendingRevision != nil {
+		creator = p.displayUsername(sticker.PendingRevision.UserID)
+		shown = sticker.withPendingRevision()
+		imageURL = p.stickerImageURL(shown, url.Values{"revision": {"pending"}})
+	}
+
+	var postIDs []string
+	for _, moderatorID := range moderatorIDs {
+		channel, appErr := p.API.GetDirectChannel(moderatorID, p.botID)
+		if appErr != nil {
+			p.API.LogWarn("Failed to open moderator channel", "user_id", moderatorID, "error", appErr.Error())
+			continue
+		}
+
+		post := &model.Post{
+			UserId:    p.botID,
+			ChannelId: channel.Id,
+			Message:   fmt.Sprintf("%s %s the sticker **%s**, which needs approval.", creator, event, sticker.Name),
+		}
+		model.ParseSlackAttachment(post, []*model.SlackAttachment{{
+			Title:    shown.Name,
+			Text:     shown.Description,
+			ImageURL: imageURL,
+			Actions: []*model.PostAction{
+				moderationButton(moderationActionApprove, "Approve", "primary", sticker.ID),
+				moderationButton(moderationActionReject, "Reject", "danger", sticker.ID),
+			},
+		}})
+
+		created, appErr := p.API.CreatePost(post)
+		if appErr != nil {
+			p.API.LogWarn("Failed to notify sticker moderator", "user_id", moderatorID, "error", appErr.Error())
+			continue
+		}
+		postIDs = append(postIDs, created.Id)
+	}
+
+	if _, err := p.UpdateSticker(sticker.ID, func(sticker *Sticker) error {
+		sticker.ModerationPostIDs = append(sticker.ModerationPostIDs, postIDs...)
+		return nil
+	}); err != nil {
+		p.API.LogWarn("Failed to record moderator notifications", "sticker_id", sticker.ID, "error", err.Error())
+	}
+}
+
+func moderationButton(action, name, style, stickerID string) *model.PostAction {
+	return &model.PostAction{
+		Id:    action,
+		Type:  model.PostActionTypeButton,
+		Name:  name,
+		Style: style,
+		Integration: &model.PostActionIntegration{
+			URL: "/plugins/" + pluginID + moderationActionPath,
+			Context: map[string]any{
+				"action":     action,
+				"sticker_id": stickerID,
+			},
+		},
+	}
+}
+
+// decideSticker records a moderator's decision on a pending sticker, or on
+// the pending revision of an approved one, and returns the sticker as it was
+// before and after. Compare-and-set makes sure only one moderator decides.
+// A sticker in the trash can be rejected but not approved.
+func (p *Plugin) decideSticker(id, moderatorID, status string) (*Sticker, *Sticker, error) {
+	var before *Sticker
+	sticker, err := p.UpdateSticker(id, func(sticker *Sticker) error {
+		prior := *sticker
+		before = &prior
+
+		if !sticker.IsPending() && sticker.PendingRevision == nil {
+			return ErrStickerNotPending
+		}
+		if status == StickerStatusApproved && sticker.IsTrashed() {
+			return ErrStickerTrashed
+		}
+
+		switch {
+		case sticker.PendingRevision == nil:
+			sticker.Status = status
+		case status == StickerStatusApproved:
+			if err := p.applyPendingRevision(sticker); err != nil {
+				return err
+			}
+		default:
+			sticker.PendingRevision = nil
+		}
+		sticker.ModeratedBy = moderatorID
+		sticker.ModeratedAt = time.Now().UnixMilli()
+		sticker.ModerationPostIDs = nil
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return before, sticker, nil
+}
+
+// ApproveSticker publishes a pending sticker, or the pending revision of an
+// approved one, and tells its creator or the editor
+func (p *Plugin) ApproveSticker(id, moderatorID string) (*Sticker, error) {
+	before, sticker, err := p.decideSticker(id, moderatorID, StickerStatusApproved)
+	if err != nil {
+		return nil, err
+	}
+
+	p.closeModerationPosts(before.ModerationPostIDs, fmt.Sprintf(":white_check_mark: Approved by %s.", p.displayUsername(moderatorID)))
+
+	if revision := before.PendingRevision; revision != nil {
+		p.recordApprovedRevision(before, sticker, moderatorID)
+		p.sendBotDM(revision.UserID, fmt.Sprintf("Your change to the sticker **%s** has been approved.", sticker.Name))
+		return sticker, nil
+	}
+
+	p.sendBotDM(sticker.CreatorID, fmt.Sprintf("Your sticker **%s** has been approved and can now be used.", sticker.Name))
+	return sticker, nil
+}
+
+// recordApprovedRevision records the approval of a revision in the
+// sticker's history as the moderator's change
+func (p *Plugin) recordApprovedRevision(before, after *Sticker, moderatorID string) {
+	previous := snapshotSticker(before)
+	version := &StickerVersion{
+		Action:    versionActionApprove,
+		UserID:    moderatorID,
+		CreatedAt: after.ModeratedAt,
+		Changes:   changedFields(previous, snapshotSticker(after)),
+		Sticker:   snapshotSticker(after),
+	}
+	if before.Filename != after.Filename {
+		version.PreviousFilename = before.Filename
+	}
+
+	if _, err := p.recordStickerVersion(after.ID, version, &previous); err != nil {
+		p.API.LogWarn("Failed to record sticker version", "sticker_id", after.ID, "error", err.Error())
+	}
+}
+
+// RejectSticker permanently deletes a pending sticker, or drops the pending
+// revision of an approved one, and tells its creator or the editor, with the
+// reason if one is given
+func (p *Plugin) RejectSticker(id, moderatorID, reason string) error {
+	before, sticker, err := p.decideSticker(id, moderatorID, StickerStatusRejected)
+	if err != nil {
+		return err
+	}
+
+	recipientID := sticker.CreatorID
+	message := fmt.Sprintf("Your sticker **%s** was rejected by a moderator.", sticker.Name)
+	if revision := before.PendingRevision; revision != nil {
+		// The images the sticker shows are unaffected
+		if err := p.ReleaseImages(unsharedImageKeys(revision.images(), sticker.images())); err != nil {
+			p.API.LogWarn("Failed to delete images of a rejected revision", "sticker_id", id, "error", err.Error())
+		}
+		recipientID = revision.UserID
+		message = fmt.Sprintf("Your change to the sticker **%s** was rejected by a moderator.", sticker.Name)
+	} else if err := p.DeleteSticker(id); err != nil {
+		return err
+	}
+
+	p.closeModerationPosts(before.ModerationPostIDs, fmt.Sprintf(":x: Rejected by %s.", p.displayUsername(moderatorID)))
+
+	if reason != "" {
+		message += " Reason: " + reason
+	}
+	p.sendBotDM(recipientID, message)
+
+	return nil
+}
+
+// closeModerationPosts replaces the buttons of moderator notifications with
+// the outcome
+func (p *Plugin) closeModerationPosts(postIDs []string, outcome string) {
+	for _, postID := range postIDs {
+		post, appErr := p.API.GetPost(postID)
+		if appErr != nil {
+			continue
+		}
+
+		attachments := post.Attachments()
+		for _, attachment := range attachments {
+			attachment.Actions = nil
+			attachment.Footer = outcome
+		}
+		model.ParseSlackAttachment(post, attachments)
+
+		if _, appErr := p.API.UpdatePost(post); appErr != nil {
+			p.API.LogWarn("Failed to update moderator notification", "post_id", postID, "error", appErr.Error())
+		}
+	}
+}
+
+func (p *Plugin) sendBotDM(userID, message string) {
+	channel, appErr := p.API.GetDirectChannel(userID, p.botID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to open direct channel", "user_id", userID, "error", appErr.Error())
+		return
+	}
+
+	if _, appErr := p.API.CreatePost(&model.Post{
+		UserId:    p.botID,
+		ChannelId: channel.Id,
+		Message:   message,
+	}); appErr != nil {
+		p.API.LogWarn("Failed to send direct message", "user_id", userID, "error", appErr.Error())
+	}
+}
+
+func (p *Plugin) displayUsername(userID string) string {
+	if user, appErr := p.API.GetUser(userID); appErr == nil {
+		return "@" + user.Username
+	}
+	return userID
+}
+
+// GetPendingStickers returns the stickers awaiting approval and those with
+// a pending revision, oldest first. Unless all is set only the user's own
+// uploads and edits are returned.
+func (p *Plugin) GetPendingStickers(userID string, all bool) (*PendingList, error) {
+	list, err := p.GetAllStickers(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stickers := make([]*Sticker, 0)
+	for _, sticker := range list.Stickers {
+		revision := sticker.PendingRevision
+		if !sticker.IsPending() && revision == nil {
+			continue
+		}
+		if !all && sticker.CreatorID != userID && (revision == nil || revision.UserID != userID) {
+			continue
+		}
+		stickers = append(stickers, sticker)
+	}
+
+	pendingSince := func(sticker *Sticker) int64 {
+		if sticker.PendingRevision != nil {
+			return sticker.PendingRevision.CreatedAt
+		}
+		return sticker.CreatedAt
+	}
+	sort.SliceStable(stickers, func(i, j int) bool {
+		return pendingSince(stickers[i]) < pendingSince(stickers[j])
+	})
+
+	return &PendingList{Stickers: stickers, Total: len(stickers)}, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRejectingAnEditKeepsTheApprovedSticker(t *testing.T) {
+	dir := t.TempDir()
+	api := newFakeAPI()
+	api.addUser("creator", "system_user")
+	api.addUser("moderator", "system_user")
+	p := newTestPlugin(api, &configuration{
+		StickerStoragePath: dir,
+		ModerationEnabled:  true,
+		Moderators:         "user-moderator",
+	})
+
+	storeImage := func(content string) *StickerImage {
+		key, err := p.StoreImage([]byte(content), "sticker.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &StickerImage{Filename: key, Format: "png"}
+	}
+	exists := func(key string) bool {
+		_, err := os.Stat(filepath.Join(dir, key))
+		return err == nil
+	}
+
+	wave := NewSticker("wave", "", "", "creator")
+	wave.StickerImage = *storeImage("approved")
+	saveTestSticker(t, p, wave)
+	approved := wave.Filename
+	edit := func(name string) {
+		if _, err := p.EditSticker(wave.ID, "creator", versionActionUpdate, func(s *Sticker) error {
+			return p.applyStickerRequest(s, &stickerRequest{Name: &name})
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	edit("hello")
+	edited, err := p.ReplaceStickerImage(wave.ID, "creator", storeImage("edited"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !edited.IsApproved() || edited.Name != "wave" || edited.Filename != approved {
+		t.Fatalf("edit changed the approved sticker: %+v", edited)
+	}
+	revision := edited.PendingRevision
+	if revision == nil || revision.Name != "hello" || revision.Filename == approved {
+		t.Fatalf("pending revision %+v", revision)
+	}
+	if list, err := p.GetPendingStickers("moderator", true); err != nil || list.Total != 1 {
+		t.Fatalf("pending list %+v, %v", list, err)
+	}
+
+	if err := p.RejectSticker(wave.ID, "moderator", ""); err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.GetSticker(wave.ID)
+	if err != nil {
+		t.Fatalf("rejecting an edit deleted the sticker: %v", err)
+	}
+	if got.Name != "wave" || got.Filename != approved || !got.IsApproved() || got.PendingRevision != nil {
+		t.Errorf("sticker after rejecting its edit: %+v", got)
+	}
+	if !exists(approved) {
+		t.Error("approved image deleted")
+	}
+	if exists(revision.Filename) {
+		t.Error("image of the rejected edit kept")
+	}
+
+	edit("hello")
+	approvedEdit, err := p.ApproveSticker(wave.ID, "moderator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if approvedEdit.Name != "hello" || approvedEdit.PendingRevision != nil {
+		t.Errorf("sticker after approving its edit: %+v", approvedEdit)
+	}
+}
+
+func TestRejectingANewStickerDeletesIt(t *testing.T) {
+	api := newFakeAPI()
+	api.addUser("creator", "system_user")
+	api.addUser("moderator", "system_user")
+	p := newTestPlugin(api, &configuration{ModerationEnabled: true, Moderators: "user-moderator"})
+
+	sticker := NewSticker("wave", "", "wave.png", "creator")
+	if err := p.SubmitSticker(sticker); err != nil {
+		t.Fatal(err)
+	}
+	if !sticker.IsPending() {
+		t.Fatalf("status %q, want pending", sticker.Status)
+	}
+
+	if err := p.RejectSticker(sticker.ID, "moderator", "blurry"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetSticker(sticker.ID); err == nil {
+		t.Error("rejected sticker kept")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	packsKey      = "packs"
+	packKeyPrefix = "pack_"
+)
+
+// StickerPack is a curated, ordered collection of stickers
+type StickerPack struct {
+	ID             string   `json:"id"`
+	Name           string   `json:"name"`
+	Description    string   `json:"description"`
+	CoverStickerID string   `json:"cover_sticker_id"`
+	OwnerID        string   `json:"owner_id"`
+	Scope          Scope    `json:"scope"`
+	StickerIDs     []string `json:"sticker_ids"`
+	CreatedAt      int64    `json:"created_at"`
+	UpdatedAt      int64    `json:"updated_at"`
+}
+
+type StickerPackList struct {
+	Packs []*StickerPack `json:"packs"`
+	Total int            `json:"total"`
+}
+
+func NewStickerPack(name, description, ownerID string) *StickerPack {
+	now := time.Now().UnixMilli()
+	return &StickerPack{
+		ID:          model.NewId(),
+		Name:        name,
+		Description: description,
+		OwnerID:     ownerID,
+		Scope:       Scope{Type: ScopeServer},
+		StickerIDs:  []string{},
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+}
+
+func (sp *StickerPack) ToJSON() ([]byte, error) {
+	return json.Marshal(sp)
+}
+
+func StickerPackFromJSON(data []byte) (*StickerPack, error) {
+	var sp StickerPack
+	if err := json.Unmarshal(data, &sp); err != nil {
+		return nil, err
+	}
+	if sp.StickerIDs == nil {
+		sp.StickerIDs = []string{}
+	}
+	if sp.Scope.Type == "" {
+		sp.Scope.Type = ScopeServer
+	}
+	return &sp, nil
+}
+
+// HasSticker reports whether the pack contains the sticker
+func (sp *StickerPack) HasSticker(stickerID string) bool {
+	for _, id := range sp.StickerIDs {
+		if id == stickerID {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveSticker drops the sticker from the pack, clearing the cover if it
+// pointed at it, and reports whether anything changed
+func (sp *StickerPack) RemoveSticker(stickerID string) bool {
+	ids := make([]string, 0, len(sp.StickerIDs))
+	for _, id := range sp.StickerIDs {
+		if id != stickerID {
+			ids = append(ids, id)
+		}
+	}
+
+	changed := len(ids) != len(sp.StickerIDs)
+	sp.StickerIDs = ids
+
+	if sp.CoverStickerID == stickerID {
+		sp.CoverStickerID = ""
+		changed = true
+	}
+
+	return changed
+}
+
+// GetAllPacks returns the packs visible to the viewer, or every pack for a
+// nil viewer
+func (p *Plugin) GetAllPacks(viewer *Viewer) (*StickerPackList, error) {
+	data, appErr := p.API.KVGet(packsKey)
+	if appErr != nil {
+		return nil, fmt.Errorf("failed to get packs: %w", appErr)
+	}
+
+	if data == nil {
+		return &StickerPackList{Packs: []*StickerPack{}, Total: 0}, nil
+	}
+
+	var ids []string
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal pack IDs: %w", err)
+	}
+
+	packs := make([]*StickerPack, 0, len(ids))
+	for _, id := range ids {
+		pack, err := p.GetPack(id)
+		if err != nil {
+			p.API.LogWarn("Skipping indexed pack without a record", "pack_id", id, "error", err.Error())
+			continue
+		}
+		if !viewer.CanSee(pack.Scope) {
+			continue
+		}
+		packs = append(packs, pack)
+	}
+
+	return &StickerPackList{
+		Packs: packs,
+		Total: len(packs),
+	}, nil
+}
+
+func (p *Plugin) GetPack(id string) (*StickerPack, error) {
+	data, appErr := p.API.KVGet(packKeyPrefix + id)
+	if appErr != nil {
+		return nil, fmt.Errorf("failed to get pack: %w", appErr)
+	}
+
+	if data == nil {
+		return nil, fmt.Errorf("pack not found")
+	}
+
+	return StickerPackFromJSON(data)
+}
+
+// GetPackByName finds a pack visible to the viewer by name. Pack names are
+// unique across all scopes.
+func (p *Plugin) GetPackByName(name string, viewer *Viewer) (*StickerPack, error) {
+	list, err := p.GetAllPacks(viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	normalizedName := strings.ToLower(strings.TrimSpace(name))
+	for _, pack := range list.Packs {
+		if strings.ToLower(pack.Name) == normalizedName {
+			return pack, nil
+		}
+	}
+
+	return nil, fmt.Errorf("pack '%s' not found", name)
+}
+
+func (p *Plugin) IsPackNameTaken(name string) bool {
+	_, err := p.GetPackByName(name, nil)
+	return err == nil
+}
+
+func (p *Plugin) SavePack(pack *StickerPack) error {
+	data, err := pack.ToJSON()
+	if err != nil {
+		return fmt.Errorf("failed to marshal pack: %w", err)
+	}
+
+	if appErr := p.API.KVSet(packKeyPrefix+pack.ID, data); appErr != nil {
+		return fmt.Errorf("failed to save pack: %w", appErr)
+	}
+
+	return p.addToIndex(packsKey, pack.ID)
+}
+
+// UpdatePack applies mutate to the stored pack with compare-and-set so that
+// concurrent edits, e.g. two users adding stickers, are not lost
+func (p *Plugin) UpdatePack(id string, mutate func(pack *StickerPack) error) (*StickerPack, error) {
+	var updated *StickerPack
+	err := p.compareAndSetWithRetry(packKeyPrefix+id, func(oldData []byte) ([]byte, bool, error) {
+		if oldData == nil {
+			return nil, false, fmt.Errorf("pack not found")
+		}
+
+		pack, err := StickerPackFromJSON(oldData)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to unmarshal pack: %w", err)
+		}
+
+		if err := mutate(pack); err != nil {
+			return nil, false, err
+		}
+		pack.UpdatedAt = time.Now().UnixMilli()
+
+		newData, err := pack.ToJSON()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal pack: %w", err)
+		}
+
+		updated = pack
+		return newData, true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return updated, nil
+}
+
+func (p *Plugin) DeletePack(id string) error {
+	if appErr := p.API.KVDelete(packKeyPrefix + id); appErr != nil {
+		return fmt.Errorf("failed to delete pack: %w", appErr)
+	}
+
+	return p.removeFromIndex(packsKey, id)
+}
+
+// RemoveStickerFromPacks drops a deleted sticker from every pack holding it
+func (p *Plugin) RemoveStickerFromPacks(stickerID string) error {
+	list, err := p.GetAllPacks(nil)
+	if err != nil {
+		return err
+	}
+
+	for _, pack := range list.Packs {
+		if !pack.HasSticker(stickerID) && pack.CoverStickerID != stickerID {
+			continue
+		}
+
+		if _, err := p.UpdatePack(pack.ID, func(pack *StickerPack) error {
+			pack.RemoveSticker(stickerID)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ChangeStickerPacks adds a sticker to the packs in add and removes it from
+// those in remove. If a pack cannot be updated, the packs already changed
+// are changed back.
+func (p *Plugin) ChangeStickerPacks(stickerID string, add, remove []string) error {
+	type change struct {
+		packID string
+		member bool
+	}
+	setMember := func(c change) error {
+		_, err := p.UpdatePack(c.packID, func(pack *StickerPack) error {
+			if !c.member {
+				pack.RemoveSticker(stickerID)
+			} else if !pack.HasSticker(stickerID) {
+				pack.StickerIDs = append(pack.StickerIDs, stickerID)
+			}
+			return nil
+		})
+		return err
+	}
+
+	changes := make([]change, 0, len(add)+len(remove))
+	for _, id := range add {
+		changes = append(changes, change{packID: id, member: true})
+	}
+	for _, id := range remove {
+		changes = append(changes, change{packID: id, member: false})
+	}
+
+	for i, c := range changes {
+		if err := setMember(c); err != nil {
+			for _, done := range changes[:i] {
+				if undoErr := setMember(change{packID: done.packID, member: !done.member}); undoErr != nil {
+					p.API.LogWarn("Failed to undo pack change", "pack_id", done.packID, "sticker_id", stickerID, "error", undoErr.Error())
+				}
+			}
+			return fmt.Errorf("failed to update pack %s: %w", c.packID, err)
+		}
+	}
+	return nil
+}
+
+// GetPackStickers resolves the pack's stickers in pack order, leaving out
+// those the viewer cannot see
+func (p *Plugin) GetPackStickers(pack *StickerPack, viewer *Viewer) *StickerList {
+	stickers := make([]*Sticker, 0, len(pack.StickerIDs))
+	for _, id := range pack.StickerIDs {
+		sticker, err := p.GetSticker(id)
+		if err != nil || !viewer.CanSeeSticker(sticker) {
+			continue
+		}
+		stickers = append(stickers, sticker)
+	}
+
+	return &StickerList{
+		Stickers: stickers,
+		Total:    len(stickers),
+	}
+}
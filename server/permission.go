@@ -0,0 +1,293 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Role is a user's Mattermost role where an action takes place, from least
+// to most privileged
+type Role int
+
+const (
+	RoleGuest Role = iota
+	RoleMember
+	RoleChannelAdmin
+	RoleTeamAdmin
+	RoleSystemAdmin
+)
+
+// Role setting values, as stored in the plugin configuration
+const (
+	roleNameGuest        = "guest"
+	roleNameMember       = "member"
+	roleNameChannelAdmin = "channel_admin"
+	roleNameTeamAdmin    = "team_admin"
+	roleNameSystemAdmin  = "system_admin"
+)
+
+var roleNames = map[string]Role{
+	roleNameGuest:        RoleGuest,
+	roleNameMember:       RoleMember,
+	roleNameChannelAdmin: RoleChannelAdmin,
+	roleNameTeamAdmin:    RoleTeamAdmin,
+	roleNameSystemAdmin:  RoleSystemAdmin,
+}
+
+// String returns the plural label used in permission errors
+func (r Role) String() string {
+	switch r {
+	case RoleGuest:
+		return "guests"
+	case RoleMember:
+		return "members"
+	case RoleChannelAdmin:
+		return "channel admins"
+	case RoleTeamAdmin:
+		return "team admins"
+	default:
+		return "system admins"
+	}
+}
+
+// parseRole reads a role setting, falling back when it is empty or unknown
+func parseRole(value string, fallback Role) Role {
+	if role, ok := roleNames[value]; ok {
+		return role
+	}
+	return fallback
+}
+
+// Action is something a user does to the sticker library
+type Action string
+
+const (
+	// ActionCreate uploads a sticker or creates a pack
+	ActionCreate Action = "create"
+	// ActionEdit changes a sticker, including its image and aliases
+	ActionEdit Action = "edit"
+	// ActionDelete moves a sticker to the trash, restores it or purges it
+	ActionDelete Action = "delete"
+	// ActionManagePacks changes or deletes a pack
+	ActionManagePacks Action = "manage_packs"
+	// ActionAdminister runs maintenance such as fsck and garbage collection
+	ActionAdminister Action = "administer"
+	// ActionModerate approves or rejects stickers in moderated mode
+	ActionModerate Action = "moderate"
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Target is what an action applies to. OwnerID is the creator of the sticker
+// or owner of the pack, empty when creating. Team and channel roles only
+// count in the team or channel of Scope; server-wide targets need a system
+// role.
+type Target struct {
+	OwnerID string
+	Scope   Scope
+}
+
+func stickerTarget(sticker *Sticker) Target {
+	return Target{OwnerID: sticker.CreatorID, Scope: sticker.Scope}
+}
+
+func packTarget(pack *StickerPack) Target {
+	return Target{OwnerID: pack.OwnerID, Scope: pack.Scope}
+}
+
+// requiredRole returns the configured minimum role for an action. For edit,
+// delete and pack management it applies to other users' stickers and packs.
+func (p *Plugin) requiredRole(action Action) Role {
+	config := p.getConfiguration()
+	switch action {
+	case ActionCreate:
+		return parseRole(config.CreateStickerRole, RoleMember)
+	case ActionEdit:
+		return parseRole(config.EditStickerRole, RoleSystemAdmin)
+	case ActionDelete:
+		return parseRole(config.DeleteStickerRole, RoleSystemAdmin)
+	case ActionManagePacks:
+		return parseRole(config.ManagePacksRole, RoleSystemAdmin)
+	default:
+		return RoleSystemAdmin
+	}
+}
+
+// GetUserRole returns the highest role a user holds on the server, in the
+// team and in the channel. Either ID may be empty. Outside system admins,
+// users who are not members of the team or channel hold no role there, and
+// get an error wrapping ErrPermissionDenied.
+func (p *Plugin) GetUserRole(userID, teamID, channelID string) (Role, error) {
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		return RoleGuest, fmt.Errorf("failed to get user: %w", appErr)
+	}
+
+	if user.IsSystemAdmin() {
+		return RoleSystemAdmin, nil
+	}
+
+	var teamMember *model.TeamMember
+	if teamID != "" {
+		// Users who left the team keep a deleted membership
+		if member, appErr := p.API.GetTeamMember(teamID, userID); appErr == nil && member.DeleteAt == 0 {
+			teamMember = member
+		}
+	}
+	isTeamAdmin := teamMember != nil && (teamMember.SchemeAdmin || model.IsInRole(teamMember.Roles, model.TeamAdminRoleId))
+
+	// Team admins act on every channel of their team, whether or not they
+	// joined it
+	var channelMember *model.ChannelMember
+	if channelID != "" {
+		if member, appErr := p.API.GetChannelMember(channelID, userID); appErr == nil {
+			channelMember = member
+		} else if !isTeamAdmin {
+			return RoleGuest, fmt.Errorf("%w: you are not a member of this channel", ErrPermissionDenied)
+		}
+	} else if teamID != "" && teamMember == nil {
+		return RoleGuest, fmt.Errorf("%w: you are not a member of this team", ErrPermissionDenied)
+	}
+
+	if user.IsGuest() {
+		return RoleGuest, nil
+	}
+	if isTeamAdmin {
+		return RoleTeamAdmin, nil
+	}
+	if channelMember != nil && (channelMember.SchemeAdmin || model.IsInRole(channelMember.Roles, model.ChannelAdminRoleId)) {
+		return RoleChannelAdmin, nil
+	}
+
+	return RoleMember, nil
+}
+
+// roleContext returns the team and channel whose roles count for a target.
+// It only comes from the target's own scope: anyone can create a channel and
+// become its admin, so a team or channel named by the caller never counts.
+func (p *Plugin) roleContext(target Target) (teamID, channelID string) {
+	switch target.Scope.Type {
+	case ScopeTeam:
+		return target.Scope.ID, ""
+	case ScopeChannel:
+		if channel, appErr := p.API.GetChannel(target.Scope.ID); appErr == nil {
+			return channel.TeamId, channel.Id
+		}
+		return "", target.Scope.ID
+	default:
+		return "", ""
+	}
+}
+
+// Authorize is the single permission check for changes to the sticker
+// library. Creators and owners may always edit, delete and manage their own
+// stickers and packs, and configured moderators may moderate; anything else
+// needs the role configured for the action. Errors wrap ErrPermissionDenied
+// when the user lacks permission.
+func (p *Plugin) Authorize(userID string, action Action, target Target) error {
+	switch action {
+	case ActionEdit, ActionDelete, ActionManagePacks:
+		if target.OwnerID != "" && target.OwnerID == userID {
+			return nil
+		}
+	case ActionModerate:
+		if p.isModerator(userID) {
+			return nil
+		}
+	}
+
+	teamID, channelID := p.roleContext(target)
+	role, err := p.GetUserRole(userID, teamID, channelID)
+	if err != nil {
+		return err
+	}
+
+	required := p.requiredRole(action)
+
+	var denied string
+	switch action {
+	case ActionCreate:
+		if role == RoleGuest {
+			if p.getConfiguration().BlockGuestUploads {
+				return fmt.Errorf("%w: guests cannot upload stickers", ErrPermissionDenied)
+			}
+			// Unless blocked, guests upload like members
+			role = RoleMember
+		}
+		denied = "create stickers and packs"
+	case ActionEdit:
+		denied = "edit other users' stickers"
+	case ActionDelete:
+		denied = "delete other users' stickers"
+	case ActionManagePacks:
+		denied = "manage other users' packs"
+	case ActionModerate:
+		denied = "moderate stickers"
+	default:
+		denied = "run sticker admin commands"
+	}
+
+	if role >= required {
+		return nil
+	}
+	if required == RoleSystemAdmin {
+		return fmt.Errorf("%w: only %s can %s", ErrPermissionDenied, required, denied)
+	}
+	return fmt.Errorf("%w: only %s and above can %s", ErrPermissionDenied, required, denied)
+}
+
+// AuthorizeSticker loads a sticker and checks that the user may edit or
+// delete it. Stickers in the trash can only be deleted, that is restored or
+// purged.
+func (p *Plugin) AuthorizeSticker(userID string, action Action, stickerID string) (*Sticker, error) {
+	var sticker *Sticker
+	var err error
+	if action == ActionDelete {
+		sticker, err = p.GetSticker(stickerID)
+	} else {
+		sticker, err = p.GetLiveSticker(stickerID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.Authorize(userID, action, stickerTarget(sticker)); err != nil {
+		return nil, err
+	}
+	return sticker, nil
+}
+
+// AuthorizePack loads a pack and checks that the user may manage it
+func (p *Plugin) AuthorizePack(userID, packID string) (*StickerPack, error) {
+	pack, err := p.GetPack(packID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.Authorize(userID, ActionManagePacks, packTarget(pack)); err != nil {
+		return nil, err
+	}
+	return pack, nil
+}
+
+// AuthorizeScopeChange checks that the user may create stickers and packs in
+// the scope one is moved to, so that moving is no way around the create role
+func (p *Plugin) AuthorizeScopeChange(userID string, from, to Scope) error {
+	if from == to {
+		return nil
+	}
+	return p.Authorize(userID, ActionCreate, Target{Scope: to})
+}
+
+// writePermissionError answers a request that failed authorization: 403 when
+// the user lacks permission and 404 when the target could not be loaded
+func writePermissionError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrPermissionDenied) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusNotFound)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	api := newFakeAPI()
+	api.addUser("admin", "system_user system_admin")
+	api.addUser("member", "system_user")
+	api.addUser("guest", "system_guest")
+	api.addUser("moderator", "system_user")
+	api.addUser("teamadmin", "system_user")
+	api.addTeamMember("team1", "teamadmin", "team_user team_admin")
+	api.addUser("channeladmin", "system_user")
+	api.addChannel("channel1", "team1")
+	api.addChannel("channel2", "team1")
+	api.addChannelMember("channel1", "channeladmin", "channel_user channel_admin")
+	api.addTeamMember("team1", "member", "team_user")
+	api.addChannelMember("channel1", "member", "channel_user")
+	api.addChannelMember("channel1", "guest", "channel_guest")
+	api.addUser("outsider", "system_user")
+
+	server := Scope{Type: ScopeServer}
+	team1 := Scope{Type: ScopeTeam, ID: "team1"}
+	team2 := Scope{Type: ScopeTeam, ID: "team2"}
+	channel1 := Scope{Type: ScopeChannel, ID: "channel1"}
+	channel2 := Scope{Type: ScopeChannel, ID: "channel2"}
+
+	tests := []struct {
+		name   string
+		cfg    configuration
+		userID string
+		action Action
+		target Target
+		want   bool
+	}{
+		{name: "member creates", userID: "member", action: ActionCreate, target: Target{Scope: server}, want: true},
+		{name: "guest creates", userID: "guest", action: ActionCreate, target: Target{Scope: server}, want: true},
+		{name: "guest blocked", cfg: configuration{BlockGuestUploads: true}, userID: "guest", action: ActionCreate, target: Target{Scope: server}},
+		{name: "creation limited to admins", cfg: configuration{CreateStickerRole: roleNameSystemAdmin}, userID: "member", action: ActionCreate, target: Target{Scope: server}},
+		{name: "admin creates when limited", cfg: configuration{CreateStickerRole: roleNameSystemAdmin}, userID: "admin", action: ActionCreate, target: Target{Scope: server}, want: true},
+		{name: "owner edits", userID: "member", action: ActionEdit, target: Target{OwnerID: "member", Scope: server}, want: true},
+		{name: "member edits another's", userID: "member", action: ActionEdit, target: Target{OwnerID: "admin", Scope: server}},
+		{name: "admin edits another's", userID: "admin", action: ActionEdit, target: Target{OwnerID: "member", Scope: server}, want: true},
+		{name: "team admin in the team", cfg: configuration{EditStickerRole: roleNameTeamAdmin}, userID: "teamadmin", action: ActionEdit, target: Target{OwnerID: "member", Scope: team1}, want: true},
+		{name: "team admin in a channel of the team", cfg: configuration{EditStickerRole: roleNameTeamAdmin}, userID: "teamadmin", action: ActionEdit, target: Target{OwnerID: "member", Scope: channel2}, want: true},
+		{name: "team admin in another team", cfg: configuration{EditStickerRole: roleNameTeamAdmin}, userID: "teamadmin", action: ActionEdit, target: Target{OwnerID: "member", Scope: team2}},
+		{name: "team admin server-wide", cfg: configuration{EditStickerRole: roleNameTeamAdmin}, userID: "teamadmin", action: ActionEdit, target: Target{OwnerID: "member", Scope: server}},
+		{name: "channel admin in the channel", cfg: configuration{DeleteStickerRole: roleNameChannelAdmin}, userID: "channeladmin", action: ActionDelete, target: Target{OwnerID: "member", Scope: channel1}, want: true},
+		{name: "channel admin in another channel", cfg: configuration{DeleteStickerRole: roleNameChannelAdmin}, userID: "channeladmin", action: ActionDelete, target: Target{OwnerID: "member", Scope: channel2}},
+		{name: "channel admin in the team", cfg: configuration{DeleteStickerRole: roleNameChannelAdmin}, userID: "channeladmin", action: ActionDelete, target: Target{OwnerID: "member", Scope: team1}},
+		{name: "member in the team", cfg: configuration{EditStickerRole: roleNameMember}, userID: "member", action: ActionEdit, target: Target{OwnerID: "admin", Scope: team1}, want: true},
+		{name: "member in the channel", cfg: configuration{EditStickerRole: roleNameMember}, userID: "member", action: ActionEdit, target: Target{OwnerID: "admin", Scope: channel1}, want: true},
+		{name: "outsider of the team", cfg: configuration{EditStickerRole: roleNameMember}, userID: "outsider", action: ActionEdit, target: Target{OwnerID: "admin", Scope: team1}},
+		{name: "outsider of the channel", cfg: configuration{DeleteStickerRole: roleNameMember}, userID: "outsider", action: ActionDelete, target: Target{OwnerID: "admin", Scope: channel1}},
+		{name: "team member outside the channel", cfg: configuration{DeleteStickerRole: roleNameMember}, userID: "member", action: ActionDelete, target: Target{OwnerID: "admin", Scope: channel2}},
+		{name: "outsider creates in a team", userID: "outsider", action: ActionCreate, target: Target{Scope: team1}},
+		{name: "guest role", cfg: configuration{EditStickerRole: roleNameGuest}, userID: "guest", action: ActionEdit, target: Target{OwnerID: "admin", Scope: channel1}, want: true},
+		{name: "guest outside the channel", cfg: configuration{EditStickerRole: roleNameGuest}, userID: "guest", action: ActionEdit, target: Target{OwnerID: "admin", Scope: channel2}},
+		{name: "pack owner", userID: "member", action: ActionManagePacks, target: Target{OwnerID: "member", Scope: server}, want: true},
+		{name: "member manages another's pack", userID: "member", action: ActionManagePacks, target: Target{OwnerID: "admin", Scope: server}},
+		{name: "moderator", cfg: configuration{Moderators: "@user-moderator"}, userID: "moderator", action: ActionModerate, target: Target{Scope: server}, want: true},
+		{name: "member moderates", cfg: configuration{Moderators: "user-moderator"}, userID: "member", action: ActionModerate, target: Target{Scope: server}},
+		{name: "admin moderates", userID: "admin", action: ActionModerate, target: Target{Scope: server}, want: true},
+		{name: "admin administers", userID: "admin", action: ActionAdminister, target: Target{Scope: server}, want: true},
+		{name: "team admin administers", userID: "teamadmin", action: ActionAdminister, target: Target{Scope: team1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			p := newTestPlugin(api, &cfg)
+
+			err := p.Authorize(tt.userID, tt.action, tt.target)
+			if tt.want && err != nil {
+				t.Errorf("denied: %v", err)
+			}
+			if !tt.want && !errors.Is(err, ErrPermissionDenied) {
+				t.Errorf("returned %v, want permission denied", err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeUnknownUser(t *testing.T) {
+	p := newTestPlugin(newFakeAPI(), &configuration{})
+
+	err := p.Authorize("nobody", ActionCreate, Target{Scope: Scope{Type: ScopeServer}})
+	if err == nil || errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("returned %v, want a lookup failure", err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// nearDuplicateDistance is the largest number of differing hash bits at
+	// which two images are considered visually near-identical
+	nearDuplicateDistance = 6
+
+	// maxNearDuplicateDistance bounds the distance admins may search with,
+	// beyond which unrelated images start to match
+	maxNearDuplicateDistance = 16
+)
+
+// PerceptualHash computes a 64-bit difference hash of an image: it is shrunk
+// to 9x8 grayscale and each bit records whether a pixel is brighter than its
+// right neighbour. Re-compressed or resized copies of an image hash to the
+// same or nearby values. Transparent areas are treated as white.
+func PerceptualHash(img image.Image) string {
+	const width, height = 9, 8
+
+	small := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(small, small.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Over, nil)
+
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if luminance(small.At(x, y)) > luminance(small.At(x+1, y)) {
+				hash |= 1
+			}
+		}
+	}
+
+	// Hex keeps the full 64 bits intact in JSON clients
+	return fmt.Sprintf("%016x", hash)
+}
+
+func luminance(c color.Color) uint32 {
+	return uint32(color.GrayModel.Convert(c).(color.Gray).Y)
+}
+
+// hashDistance returns the number of differing bits between two perceptual
+// hashes, or -1 if either is missing or malformed
+func hashDistance(a, b string) int {
+	x, errA := strconv.ParseUint(a, 16, 64)
+	y, errB := strconv.ParseUint(b, 16, 64)
+	if a == "" || b == "" || errA != nil || errB != nil {
+		return -1
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+// NearDuplicate is an existing sticker that looks like another image
+type NearDuplicate struct {
+	Sticker  *Sticker `json:"sticker"`
+	Distance int      `json:"distance"`
+}
+
+// FindNearDuplicates returns the stickers visible to the viewer, other than
+// the given one, whose perceptual hash is within nearDuplicateDistance of it,
+// closest first
+func (p *Plugin) FindNearDuplicates(sticker *Sticker, viewer *Viewer) ([]NearDuplicate, error) {
+	if sticker.PerceptualHash == "" {
+		return nil, nil
+	}
+
+	list, err := p.GetAllStickers(viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []NearDuplicate
+	for _, other := range list.Stickers {
+		if other.ID == sticker.ID {
+			continue
+		}
+		if d := hashDistance(sticker.PerceptualHash, other.PerceptualHash); d >= 0 && d <= nearDuplicateDistance {
+			matches = append(matches, NearDuplicate{Sticker: other, Distance: d})
+		}
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Distance < matches[j].Distance
+	})
+	return matches, nil
+}
+
+// DuplicateCluster is a group of stickers linked by near-identical images
+type DuplicateCluster struct {
+	Stickers []*Sticker `json:"stickers"`
+	// MaxDistance is the largest distance between two linked stickers
+	MaxDistance int `json:"max_distance"`
+}
+
+// DuplicateReport lists near-duplicate clusters. Stickers without a
+// perceptual hash are counted in Unhashed and hashed when Backfilled.
+type DuplicateReport struct {
+	Distance   int                `json:"distance"`
+	Clusters   []DuplicateCluster `json:"clusters"`
+	Unhashed   int                `json:"unhashed"`
+	Backfilled int                `json:"backfilled"`
+	Errors     []string           `json:"errors"`
+}
+
+// FindDuplicateClusters groups stickers whose perceptual hashes are within
+// distance bits of each other, transitively. With backfill set, stickers
+// uploaded before hashing was introduced are hashed first, which also lets
+// exact duplicates of them be detected on upload.
+func (p *Plugin) FindDuplicateClusters(distance int, backfill bool) (*DuplicateReport, error) {
+	report := &DuplicateReport{
+		Distance: distance,
+		Clusters: []DuplicateCluster{},
+		Errors:   []string{},
+	}
+
+	list, err := p.GetAllStickers(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stickers := make([]*Sticker, 0, len(list.Stickers))
+	for _, sticker := range list.Stickers {
+		if (sticker.PerceptualHash == "" || sticker.SHA256 == "") && backfill {
+			updated, err := p.backfillPerceptualHash(sticker)
+			if err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("hash sticker %s: %s", sticker.ID, err.Error()))
+			} else {
+				sticker = updated
+				report.Backfilled++
+			}
+		}
+
+		if sticker.PerceptualHash == "" {
+			report.Unhashed++
+			continue
+		}
+		stickers = append(stickers, sticker)
+	}
+
+	// Union-find over every close pair
+	parent := make([]int, len(stickers))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	maxDistance := make(map[int]int)
+	for i := range stickers {
+		for j := i + 1; j < len(stickers); j++ {
+			d := hashDistance(stickers[i].PerceptualHash, stickers[j].PerceptualHash)
+			if d < 0 || d > distance {
+				continue
+			}
+			ri, rj := find(i), find(j)
+			parent[rj] = ri
+			maxDistance[ri] = max(maxDistance[ri], maxDistance[rj], d)
+		}
+	}
+
+	members := make(map[int][]*Sticker)
+	var roots []int
+	for i, sticker := range stickers {
+		root := find(i)
+		if len(members[root]) == 0 {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], sticker)
+	}
+
+	for _, root := range roots {
+		if len(members[root]) < 2 {
+			continue
+		}
+		report.Clusters = append(report.Clusters, DuplicateCluster{
+			Stickers:    members[root],
+			MaxDistance: maxDistance[root],
+		})
+	}
+
+	return report, nil
+}
+
+// backfillPerceptualHash hashes the stored image of a sticker that has no
+// perceptual or content hash yet
+func (p *Plugin) backfillPerceptualHash(sticker *Sticker) (*Sticker, error) {
+	var data []byte
+	if sticker.Filename != "" {
+		var err error
+		data, err = p.ReadStickerImage(sticker.Filename)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		fileData, appErr := p.API.GetFile(sticker.FileID)
+		if appErr != nil {
+			return nil, appErr
+		}
+		data = fileData
+	}
+
+	img, err := decodeUpright(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	hash := PerceptualHash(img)
+	return p.UpdateSticker(sticker.ID, func(s *Sticker) error {
+		s.PerceptualHash = hash
+		if s.Filename == sticker.Filename {
+			s.SHA256 = hashImage(data)
+		}
+		return nil
+	})
+}
@@ -7,25 +7,105 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
+	"github.com/mattermost/mattermost/server/public/pluginapi/cluster"
 )
 
+const pluginID = "com.example.sticker"
+
 type Plugin struct {
 	plugin.MattermostPlugin
 
 	configurationLock sync.RWMutex
 	configuration     *configuration
+	imageStore        StickerImageStore
+	moderatorIDs      []string
+	moderatorsLoaded  bool
 
 	router *mux.Router
+	botID  string
+
+	indexMutex   *cluster.Mutex
+	indexMetrics IndexMetrics
+	stickerCache *stickerCache
+	usage        *usageTracker
+
+	imageGCJob    *cluster.Job
+	trashPurgeJob *cluster.Job
 }
 
 type configuration struct {
 	StickerServerURL   string
+	StorageBackend     string
 	StickerStoragePath string
+	S3Endpoint         string
+	S3Bucket           string
+	S3Region           string
+	S3AccessKeyID      string
+	S3SecretAccessKey  string
+	S3UseSSL           bool
+	S3PathPrefix       string
 	MaxStickerSize     int
 	AllowedFormats     string
+	MaxImageWidth      int
+	MaxImageHeight     int
+	MaxFrameCount      int
+
+	ResizeImages       bool
+	ResizeMaxDimension int
+
+	ImageGCEnabled          bool
+	ImageGCGracePeriodHours int
+	ImageGCDryRun           bool
+
+	TrashRetentionDays int
+
+	// Minimum roles for each action; see permission.go
+	CreateStickerRole string
+	EditStickerRole   string
+	DeleteStickerRole string
+	ManagePacksRole   string
+	BlockGuestUploads bool
+
+	// ModerationEnabled holds new uploads for approval by the Moderators, a
+	// comma-separated list of usernames
+	ModerationEnabled bool
+	Moderators        string
 }
 
 func (p *Plugin) OnActivate() error {
+	p.stickerCache = newStickerCache()
+	p.usage = newUsageTracker()
+
+	botID, err := p.API.EnsureBotUser(&model.Bot{
+		Username:    "sticker",
+		DisplayName: "Sticker",
+		Description: "Created by the Custom Sticker plugin.",
+	})
+	if err != nil {
+		return err
+	}
+	p.botID = botID
+
+	indexMutex, err := cluster.NewMutex(p.API, indexMutexKey)
+	if err != nil {
+		return err
+	}
+	p.indexMutex = indexMutex
+
+	imageGCJob, err := cluster.Schedule(p.API, imageGCJobKey, cluster.MakeWaitForInterval(imageGCInterval), p.runImageGC)
+	if err != nil {
+		return err
+	}
+	p.imageGCJob = imageGCJob
+
+	trashPurgeJob, err := cluster.Schedule(p.API, trashPurgeJobKey, cluster.MakeWaitForInterval(trashPurgeInterval), p.runTrashPurge)
+	if err != nil {
+		return err
+	}
+	p.trashPurgeJob = trashPurgeJob
+
+	p.startUsageFlusher()
+
 	p.router = mux.NewRouter()
 	p.initAPI()
 
@@ -37,6 +117,20 @@ func (p *Plugin) OnActivate() error {
 }
 
 func (p *Plugin) OnDeactivate() error {
+	if p.usage != nil {
+		p.stopUsageFlusher()
+	}
+	if p.imageGCJob != nil {
+		if err := p.imageGCJob.Close(); err != nil {
+			p.API.LogWarn("Failed to close image garbage collection job", "error", err.Error())
+		}
+	}
+	if p.trashPurgeJob != nil {
+		if err := p.trashPurgeJob.Close(); err != nil {
+			p.API.LogWarn("Failed to close trash purge job", "error", err.Error())
+		}
+	}
+
 	return nil
 }
 
@@ -50,8 +144,23 @@ func (p *Plugin) getConfiguration() *configuration {
 
 	if p.configuration == nil {
 		return &configuration{
+			StorageBackend: storageBackendLocal,
 			MaxStickerSize: 1024,
 			AllowedFormats: "png,gif,jpg,jpeg,webp",
+			MaxImageWidth:  2048,
+			MaxImageHeight: 2048,
+			MaxFrameCount:  300,
+
+			ResizeMaxDimension: defaultResizeMaxDimension,
+
+			ImageGCGracePeriodHours: defaultImageGCGracePeriodHours,
+
+			TrashRetentionDays: defaultTrashRetentionDays,
+
+			CreateStickerRole: roleNameMember,
+			EditStickerRole:   roleNameSystemAdmin,
+			DeleteStickerRole: roleNameSystemAdmin,
+			ManagePacksRole:   roleNameSystemAdmin,
 		}
 	}
 
@@ -67,6 +176,9 @@ func (p *Plugin) OnConfigurationChange() error {
 
 	p.configurationLock.Lock()
 	p.configuration = &cfg
+	p.imageStore = nil
+	p.moderatorIDs = nil
+	p.moderatorsLoaded = false
 	p.configurationLock.Unlock()
 
 	return nil
@@ -79,7 +191,7 @@ func (p *Plugin) registerCommand() error {
 		Description:      "Send or manage custom stickers",
 		AutoComplete:     true,
 		AutoCompleteDesc: "Send a sticker or manage stickers",
-		AutoCompleteHint: "[name] | add [name] | delete [name] | list",
+		AutoCompleteHint: "[name] | add [name] | delete [name] | restore [name] | rename [old] [new] | list | trash | pending | pack",
 	})
 }
 
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// fakeAPI is an in-memory plugin.API with a KV store, users, teams,
+// channels and posts. Methods the tests do not need panic through the nil embedded
+// interface.
+type fakeAPI struct {
+	plugin.API
+
+	mu sync.Mutex
+	kv map[string][]byte
+
+	users          map[string]*model.User
+	teamMembers    map[string]*model.TeamMember
+	channels       map[string]*model.Channel
+	channelMembers map[string]*model.ChannelMember
+	posts          map[string]*model.Post
+	files          []*model.FileInfo
+	config         *model.Config
+}
+
+func newFakeAPI() *fakeAPI {
+	return &fakeAPI{
+		kv:             map[string][]byte{},
+		users:          map[string]*model.User{},
+		teamMembers:    map[string]*model.TeamMember{},
+		channels:       map[string]*model.Channel{},
+		channelMembers: map[string]*model.ChannelMember{},
+		posts:          map[string]*model.Post{},
+		config:         &model.Config{},
+	}
+}
+
+func newTestPlugin(api *fakeAPI, cfg *configuration) *Plugin {
+	p := &Plugin{
+		configuration: cfg,
+		stickerCache:  newStickerCache(),
+		usage:         newUsageTracker(),
+	}
+	p.SetAPI(api)
+	return p
+}
+
+func notFound(where string) *model.AppError {
+	return model.NewAppError(where, "not_found", nil, "", 404)
+}
+
+func (f *fakeAPI) addUser(id, roles string) *model.User {
+	user := &model.User{Id: id, Username: "user-" + id, Roles: roles}
+	f.users[id] = user
+	return user
+}
+
+func (f *fakeAPI) addTeamMember(teamID, userID, roles string) {
+	f.teamMembers[teamID+"/"+userID] = &model.TeamMember{TeamId: teamID, UserId: userID, Roles: roles}
+}
+
+func (f *fakeAPI) addChannel(channelID, teamID string) {
+	f.channels[channelID] = &model.Channel{Id: channelID, TeamId: teamID}
+}
+
+func (f *fakeAPI) addChannelMember(channelID, userID, roles string) {
+	f.channelMembers[channelID+"/"+userID] = &model.ChannelMember{ChannelId: channelID, UserId: userID, Roles: roles}
+}
+
+func (f *fakeAPI) KVGet(key string) ([]byte, *model.AppError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.kv[key], nil
+}
+
+func (f *fakeAPI) KVSet(key string, value []byte) *model.AppError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.kv[key] = value
+	return nil
+}
+
+func (f *fakeAPI) KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	current, ok := f.kv[key]
+	if (oldValue == nil && ok) || (oldValue != nil && !bytes.Equal(current, oldValue)) {
+		return false, nil
+	}
+	// Like the server, a nil value deletes the key
+	if newValue == nil {
+		delete(f.kv, key)
+		return true, nil
+	}
+	f.kv[key] = newValue
+	return true, nil
+}
+
+func (f *fakeAPI) KVDelete(key string) *model.AppError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.kv, key)
+	return nil
+}
+
+func (f *fakeAPI) KVList(page, perPage int) ([]string, *model.AppError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.kv))
+	for key := range f.kv {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	start := min(page*perPage, len(keys))
+	end := min(start+perPage, len(keys))
+	return keys[start:end], nil
+}
+
+func (f *fakeAPI) GetUser(userID string) (*model.User, *model.AppError) {
+	if user, ok := f.users[userID]; ok {
+		return user, nil
+	}
+	return nil, notFound("GetUser")
+}
+
+func (f *fakeAPI) GetUserByUsername(name string) (*model.User, *model.AppError) {
+	for _, user := range f.users {
+		if user.Username == name {
+			return user, nil
+		}
+	}
+	return nil, notFound("GetUserByUsername")
+}
+
+func (f *fakeAPI) GetTeamMember(teamID, userID string) (*model.TeamMember, *model.AppError) {
+	if member, ok := f.teamMembers[teamID+"/"+userID]; ok {
+		return member, nil
+	}
+	return nil, notFound("GetTeamMember")
+}
+
+func (f *fakeAPI) GetChannel(channelID string) (*model.Channel, *model.AppError) {
+	if channel, ok := f.channels[channelID]; ok {
+		return channel, nil
+	}
+	return nil, notFound("GetChannel")
+}
+
+func (f *fakeAPI) GetChannelMember(channelID, userID string) (*model.ChannelMember, *model.AppError) {
+	if member, ok := f.channelMembers[channelID+"/"+userID]; ok {
+		return member, nil
+	}
+	return nil, notFound("GetChannelMember")
+}
+
+func (f *fakeAPI) GetPost(postID string) (*model.Post, *model.AppError) {
+	if post, ok := f.posts[postID]; ok {
+		return post, nil
+	}
+	return nil, notFound("GetPost")
+}
+
+func (f *fakeAPI) CreatePost(post *model.Post) (*model.Post, *model.AppError) {
+	post.Id = model.NewId()
+	f.posts[post.Id] = post
+	return post, nil
+}
+
+func (f *fakeAPI) UpdatePost(post *model.Post) (*model.Post, *model.AppError) {
+	f.posts[post.Id] = post
+	return post, nil
+}
+
+func (f *fakeAPI) GetDirectChannel(userID1, userID2 string) (*model.Channel, *model.AppError) {
+	return &model.Channel{Id: userID1 + "__" + userID2, Type: model.ChannelTypeDirect}, nil
+}
+
+func (f *fakeAPI) GetFileInfos(page, perPage int, opt *model.GetFileInfosOptions) ([]*model.FileInfo, *model.AppError) {
+	start := min(page*perPage, len(f.files))
+	end := min(start+perPage, len(f.files))
+	return f.files[start:end], nil
+}
+
+func (f *fakeAPI) GetConfig() *model.Config {
+	return f.config
+}
+
+func (f *fakeAPI) PublishPluginClusterEvent(model.PluginClusterEvent, model.PluginClusterEventSendOptions) error {
+	return nil
+}
+
+func (f *fakeAPI) LogDebug(string, ...any) {}
+func (f *fakeAPI) LogInfo(string, ...any)  {}
+func (f *fakeAPI) LogWarn(string, ...any)  {}
+func (f *fakeAPI) LogError(string, ...any) {}
+
+// saveTestSticker stores a sticker record and adds it to the index
+func saveTestSticker(t *testing.T, p *Plugin, sticker *Sticker) {
+	t.Helper()
+
+	if err := p.SaveSticker(sticker); err != nil {
+		t.Fatal(err)
+	}
+}
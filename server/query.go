@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	sortByName      = "name"
+	sortByCreatedAt = "created_at"
+	sortByUsage     = "usage"
+
+	defaultPerPage = 60
+	maxPerPage     = 200
+)
+
+// StickerQuery selects, orders and pages stickers for the list and search
+// endpoints. A zero PerPage returns every matching sticker, and only
+// stickers visible to Viewer are considered.
+type StickerQuery struct {
+	Viewer *Viewer
+
+	Search    string
+	CreatorID string
+	PackID    string
+	Tag       string
+	Format    string
+
+	SortBy     string
+	Descending bool
+
+	Page    int
+	PerPage int
+	After   string
+
+	afterCursor *Sticker
+}
+
+// stickerCursor records the sort fields of the last sticker of a page so the
+// next page can resume after it even if that sticker has been deleted since
+type stickerCursor struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	CreatedAt  int64  `json:"created_at"`
+	UsageCount int64  `json:"usage_count"`
+}
+
+func encodeStickerCursor(s *Sticker) string {
+	data, _ := json.Marshal(stickerCursor{
+		ID:         s.ID,
+		Name:       s.Name,
+		CreatedAt:  s.CreatedAt,
+		UsageCount: s.UsageCount,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeStickerCursor(cursor string) (*Sticker, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	var c stickerCursor
+	if err := json.Unmarshal(data, &c); err != nil || c.ID == "" {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+
+	return &Sticker{ID: c.ID, Name: c.Name, CreatedAt: c.CreatedAt, UsageCount: c.UsageCount}, nil
+}
+
+// ParseStickerQuery reads a StickerQuery from URL parameters
+func ParseStickerQuery(values url.Values) (*StickerQuery, error) {
+	q := &StickerQuery{
+		Search:    values.Get("q"),
+		CreatorID: values.Get("creator_id"),
+		PackID:    values.Get("pack_id"),
+		Tag:       strings.ToLower(strings.TrimSpace(values.Get("tag"))),
+		Format:    normalizeFormat(values.Get("format")),
+		SortBy:    values.Get("sort"),
+		After:     values.Get("after"),
+	}
+
+	switch q.SortBy {
+	case "":
+		q.SortBy = sortByCreatedAt
+	case sortByName, sortByCreatedAt, sortByUsage:
+	default:
+		return nil, fmt.Errorf("invalid sort '%s'", q.SortBy)
+	}
+
+	switch values.Get("order") {
+	case "", "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return nil, fmt.Errorf("invalid order '%s'", values.Get("order"))
+	}
+
+	if v := values.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 0 {
+			return nil, fmt.Errorf("invalid page '%s'", v)
+		}
+		q.Page = page
+	}
+
+	if v := values.Get("per_page"); v != "" {
+		perPage, err := strconv.Atoi(v)
+		if err != nil || perPage <= 0 {
+			return nil, fmt.Errorf("invalid per_page '%s'", v)
+		}
+		q.PerPage = perPage
+	}
+
+	if q.After != "" {
+		cursor, err := decodeStickerCursor(q.After)
+		if err != nil {
+			return nil, err
+		}
+		q.afterCursor = cursor
+	}
+
+	// Paging is opt-in so existing clients keep receiving the full list
+	if q.PerPage == 0 && (values.Has("page") || q.After != "") {
+		q.PerPage = defaultPerPage
+	}
+	if q.PerPage > maxPerPage {
+		q.PerPage = maxPerPage
+	}
+
+	return q, nil
+}
+
+// normalizeFormat turns a format or extension such as ".JPEG" into "jpg"
+func normalizeFormat(format string) string {
+	format = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(format), "."))
+	if format == "jpeg" {
+		return "jpg"
+	}
+	return format
+}
+
+// less orders stickers by the query's sort field, breaking ties by ID so
+// that the order is stable across requests
+func (q *StickerQuery) less(a, b *Sticker) bool {
+	var cmp int
+	switch q.SortBy {
+	case sortByName:
+		cmp = strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	case sortByUsage:
+		cmp = compareInt64(a.UsageCount, b.UsageCount)
+	default:
+		cmp = compareInt64(a.CreatedAt, b.CreatedAt)
+	}
+
+	if cmp == 0 {
+		cmp = strings.Compare(a.ID, b.ID)
+	}
+
+	if q.Descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+func compareInt64(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// QueryStickers filters, sorts and pages the sticker list
+func (p *Plugin) QueryStickers(q *StickerQuery) (*StickerList, error) {
+	list, err := p.GetAllStickers(q.Viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	var packMembers map[string]bool
+	if q.PackID != "" {
+		// An unknown pack, or one the viewer cannot see, simply has no
+		// members
+		packMembers = map[string]bool{}
+		if pack, err := p.GetPack(q.PackID); err == nil && q.Viewer.CanSee(pack.Scope) {
+			for _, id := range pack.StickerIDs {
+				packMembers[id] = true
+			}
+		}
+	}
+
+	search := strings.ToLower(strings.TrimSpace(q.Search))
+	filtered := make([]*Sticker, 0, len(list.Stickers))
+	for _, s := range list.Stickers {
+		if search != "" && !s.MatchesQuery(search) {
+			continue
+		}
+		if q.CreatorID != "" && s.CreatorID != q.CreatorID {
+			continue
+		}
+		if packMembers != nil && !packMembers[s.ID] {
+			continue
+		}
+		if q.Tag != "" && !s.HasTag(q.Tag) {
+			continue
+		}
+		if q.Format != "" && s.ImageFormat() != q.Format {
+			continue
+		}
+		filtered = append(filtered, s)
+	}
+
+	sort.Slice(filtered, func(i, j int) bool {
+		return q.less(filtered[i], filtered[j])
+	})
+
+	result := &StickerList{
+		Stickers: filtered,
+		Total:    len(filtered),
+	}
+
+	if q.PerPage == 0 {
+		return result, nil
+	}
+
+	// Compared before multiplying so that huge pages cannot overflow
+	start := len(filtered)
+	if q.Page < len(filtered)/q.PerPage+1 {
+		start = q.Page * q.PerPage
+	}
+	if q.afterCursor != nil {
+		start = sort.Search(len(filtered), func(i int) bool {
+			return q.less(q.afterCursor, filtered[i])
+		})
+	}
+
+	if start > len(filtered) {
+		start = len(filtered)
+	}
+	end := start + q.PerPage
+	if end > len(filtered) {
+		end = len(filtered)
+	}
+
+	result.Stickers = filtered[start:end]
+	result.Page = q.Page
+	result.PerPage = q.PerPage
+	if end < len(filtered) && end > 0 {
+		result.NextCursor = encodeStickerCursor(filtered[end-1])
+	}
+
+	return result, nil
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"sort"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// maxResizeInputSize caps uploads when resizing is enabled, since images
+	// larger than MaxStickerSize are then accepted and shrunk
+	maxResizeInputSize = 20 << 20
+
+	// maxResizeInputPixels caps the pixels of all frames together, checked
+	// from the header before decoding. A small file can declare a huge
+	// canvas, and decoding allocates all of it.
+	maxResizeInputPixels = 64 << 20
+
+	defaultResizeMaxDimension = 512
+
+	// Images that are still too large after re-encoding are shrunk by
+	// resizeShrinkPercent at a time, down to resizeMinDimension pixels
+	resizeShrinkPercent = 75
+	resizeMinDimension  = 32
+
+	resizeJPEGQuality = 85
+)
+
+// maxUploadSize returns how many bytes an upload may have before it is
+// processed
+func (p *Plugin) maxUploadSize() int64 {
+	cfg := p.getConfiguration()
+	if cfg.ResizeImages {
+		return maxResizeInputSize
+	}
+	return int64(cfg.MaxStickerSize * 1024)
+}
+
+func (p *Plugin) getResizeMaxDimension() int {
+	if dimension := p.getConfiguration().ResizeMaxDimension; dimension > 0 {
+		return dimension
+	}
+	return defaultResizeMaxDimension
+}
+
+// ResizeStickerImage downscales an image to fit a box of box pixels and
+// re-encodes it, shrinking further until it is at most maxBytes. Images that
+// already fit are returned unchanged. Transparency and GIF animation are kept;
+// WebP stills are re-encoded as PNG since there is no WebP encoder. Animated
+// WebP cannot be decoded at all, so it is only accepted when it already fits.
+func ResizeStickerImage(data []byte, info *ImageInfo, box int, maxBytes int64) ([]byte, *ImageInfo, error) {
+	if info.Width <= box && info.Height <= box && int64(len(data)) <= maxBytes {
+		return data, info, nil
+	}
+
+	if info.Format == "webp" && info.FrameCount > 1 {
+		return nil, nil, fmt.Errorf("%w: animated webp images cannot be resized; upload one within %dx%d pixels and %d KB, or a GIF",
+			ErrInvalidImage, box, box, maxBytes/1024)
+	}
+
+	if pixels := int64(info.Width) * int64(info.Height) * int64(info.FrameCount); pixels > maxResizeInputPixels {
+		return nil, nil, fmt.Errorf("%w: image is too large to resize (%dx%d pixels, %d frames)",
+			ErrInvalidImage, info.Width, info.Height, info.FrameCount)
+	}
+
+	var encode func(width, height int) ([]byte, error)
+	if info.Format == "gif" {
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: corrupt gif image: %s", ErrInvalidImage, err.Error())
+		}
+		encode = func(width, height int) ([]byte, error) {
+			var buf bytes.Buffer
+			if err := gif.EncodeAll(&buf, resizeGIF(g, width, height)); err != nil {
+				return nil, err
+			}
+			return buf.Bytes(), nil
+		}
+	} else {
+		// Re-encoded images carry no EXIF, so the rotation is applied to the
+		// pixels
+		img, err := decodeUpright(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: corrupt %s image: %s", ErrInvalidImage, info.Format, err.Error())
+		}
+		encode = func(width, height int) ([]byte, error) {
+			return encodeStill(scaleImage(img, width, height), info.Format)
+		}
+	}
+
+	width, height := fitSize(info.Width, info.Height, box)
+	for {
+		resized, err := encode(width, height)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to encode resized image: %w", err)
+		}
+
+		if int64(len(resized)) <= maxBytes {
+			resizedInfo, err := DetectImage(resized)
+			if err != nil {
+				return nil, nil, err
+			}
+			return resized, resizedInfo, nil
+		}
+
+		if width <= resizeMinDimension || height <= resizeMinDimension {
+			return nil, nil, fmt.Errorf("%w: image exceeds the size limit of %d KB even after resizing", ErrInvalidImage, maxBytes/1024)
+		}
+		width = max(1, width*resizeShrinkPercent/100)
+		height = max(1, height*resizeShrinkPercent/100)
+	}
+}
+
+// decodeUpright decodes an image, or the first frame of an animation, turned
+// the way its EXIF orientation says it is displayed
+func decodeUpright(data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return orientImage(img, jpegOrientation(data)), nil
+}
+
+// orientImage applies an EXIF orientation to the pixels of an image
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	// Orientations 5 to 8 turn the image by a quarter
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			sx, sy := x, y
+			switch orientation {
+			case 2:
+				sx = width - 1 - x
+			case 3:
+				sx, sy = width-1-x, height-1-y
+			case 4:
+				sy = height - 1 - y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, height-1-x
+			case 7:
+				sx, sy = width-1-y, height-1-x
+			case 8:
+				sx, sy = width-1-y, x
+			}
+			i, j := dst.PixOffset(x, y), src.PixOffset(sx, sy)
+			copy(dst.Pix[i:i+4], src.Pix[j:j+4])
+		}
+	}
+	return dst
+}
+
+// encodeStill encodes a resized still image in its original format, or as
+// PNG for formats that cannot be encoded
+func encodeStill(img image.Image, format string) ([]byte, error) {
+	if format != "jpg" {
+		var buf bytes.Buffer
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		if err := encoder.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: resizeJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeGIF scales every frame of an animation. Frames are composited onto
+// the full canvas first, honouring their disposal, so each output frame is
+// complete and partial frames do not drift when scaled.
+func resizeGIF(g *gif.GIF, width, height int) *gif.GIF {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	resized := &gif.GIF{
+		LoopCount: g.LoopCount,
+		Config:    image.Config{Width: width, Height: height},
+	}
+
+	for i, frame := range g.Image {
+		disposal := byte(0)
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.RGBA
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewRGBA(canvas.Bounds())
+			draw.Draw(previous, previous.Bounds(), canvas, image.Point{}, draw.Src)
+		}
+
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		// The composited canvas holds colours from earlier frames and the
+		// scaling blends new ones, so the palette comes from the result
+		paletted := quantizeFrame(scaleImage(canvas, width, height))
+
+		delay := 0
+		if i < len(g.Delay) {
+			delay = g.Delay[i]
+		}
+		resized.Image = append(resized.Image, paletted)
+		resized.Delay = append(resized.Delay, delay)
+		resized.Disposal = append(resized.Disposal, gif.DisposalBackground)
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return resized
+}
+
+// quantizeFrame converts a resized frame to a paletted image with a palette
+// built from the frame itself. Frames with at most 256 colours keep them
+// exactly; otherwise colours are grouped by their top five bits per channel
+// and the most common groups are kept, each as its average colour. Mostly
+// transparent pixels become a transparent entry at the end of the palette.
+func quantizeFrame(img *image.RGBA) *image.Paletted {
+	type group struct {
+		r, g, b, count int
+	}
+
+	bounds := img.Bounds()
+	colors := make(map[color.RGBA]int)
+	transparent := false
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c, ok := opaqueColor(img.RGBAAt(x, y))
+			if !ok {
+				transparent = true
+				continue
+			}
+			colors[c]++
+		}
+	}
+
+	maxColors := 256
+	if transparent {
+		maxColors--
+	}
+
+	var palette color.Palette
+	exact := make(map[color.RGBA]uint8, len(colors))
+	groupIndex := make(map[uint16]uint8)
+	if len(colors) <= maxColors {
+		// Sorted so that the same image always encodes the same way
+		for c := range colors {
+			palette = append(palette, c)
+		}
+		sort.Slice(palette, func(i, j int) bool {
+			a, b := palette[i].(color.RGBA), palette[j].(color.RGBA)
+			return uint32(a.R)<<16|uint32(a.G)<<8|uint32(a.B) < uint32(b.R)<<16|uint32(b.G)<<8|uint32(b.B)
+		})
+		for i, c := range palette {
+			exact[c.(color.RGBA)] = uint8(i)
+		}
+	} else {
+		groups := make(map[uint16]*group)
+		for c, count := range colors {
+			key := colorGroup(c)
+			g := groups[key]
+			if g == nil {
+				g = &group{}
+				groups[key] = g
+			}
+			g.r += int(c.R) * count
+			g.g += int(c.G) * count
+			g.b += int(c.B) * count
+			g.count += count
+		}
+
+		keys := make([]uint16, 0, len(groups))
+		for key := range groups {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if groups[keys[i]].count != groups[keys[j]].count {
+				return groups[keys[i]].count > groups[keys[j]].count
+			}
+			return keys[i] < keys[j]
+		})
+		if len(keys) > maxColors {
+			keys = keys[:maxColors]
+		}
+
+		for _, key := range keys {
+			g := groups[key]
+			groupIndex[key] = uint8(len(palette))
+			palette = append(palette, color.RGBA{
+				R: uint8(g.r / g.count),
+				G: uint8(g.g / g.count),
+				B: uint8(g.b / g.count),
+				A: 0xff,
+			})
+		}
+	}
+
+	opaque := len(palette)
+	if transparent || opaque == 0 {
+		palette = append(palette, color.RGBA{})
+	}
+
+	paletted := image.NewPaletted(bounds, palette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c, ok := opaqueColor(img.RGBAAt(x, y))
+			var index uint8
+			switch {
+			case !ok:
+				index = uint8(opaque)
+			case len(exact) > 0:
+				index = exact[c]
+			default:
+				key := colorGroup(c)
+				i, found := groupIndex[key]
+				if !found {
+					// Groups that did not make the cut share the nearest
+					// kept colour
+					i = uint8(palette[:opaque].Index(c))
+					groupIndex[key] = i
+				}
+				index = i
+			}
+			paletted.SetColorIndex(x, y, index)
+		}
+	}
+
+	return paletted
+}
+
+// opaqueColor returns the colour of a premultiplied pixel at full opacity,
+// or false when the pixel is mostly transparent and GIF should leave it out
+func opaqueColor(c color.RGBA) (color.RGBA, bool) {
+	if c.A < 0x80 {
+		return color.RGBA{}, false
+	}
+	if c.A == 0xff {
+		return c, true
+	}
+	return color.RGBA{
+		R: uint8(int(c.R) * 0xff / int(c.A)),
+		G: uint8(int(c.G) * 0xff / int(c.A)),
+		B: uint8(int(c.B) * 0xff / int(c.A)),
+		A: 0xff,
+	}, true
+}
+
+// colorGroup keys a colour by the top five bits of each channel
+func colorGroup(c color.RGBA) uint16 {
+	return uint16(c.R>>3)<<10 | uint16(c.G>>3)<<5 | uint16(c.B>>3)
+}
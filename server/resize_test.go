@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+)
+
+func TestResizeStickerImageKeepsCompositedColors(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	blue := color.RGBA{B: 0xff, A: 0xff}
+
+	background := image.NewPaletted(image.Rect(0, 0, 100, 100), color.Palette{red})
+	// The second frame only covers a corner and has no red in its palette
+	corner := image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{blue, color.Transparent})
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:    []*image.Paletted{background, corner},
+		Delay:    []int{10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := DetectImage(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resized, resizedInfo, err := ResizeStickerImage(buf.Bytes(), info, 50, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resizedInfo.Width != 50 || resizedInfo.Height != 50 || resizedInfo.FrameCount != 2 {
+		t.Fatalf("unexpected resized image %+v", *resizedInfo)
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(resized))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	frame := g.Image[1]
+	if got := color.RGBAModel.Convert(frame.At(40, 40)).(color.RGBA); got != red {
+		t.Errorf("composited background pixel is %v, want %v", got, red)
+	}
+	if got := color.RGBAModel.Convert(frame.At(1, 1)).(color.RGBA); got != blue {
+		t.Errorf("corner pixel is %v, want %v", got, blue)
+	}
+}
+
+func TestResizeStickerImageRejectsWithoutDecoding(t *testing.T) {
+	tests := []struct {
+		name string
+		info *ImageInfo
+	}{
+		{name: "huge canvas", info: &ImageInfo{Format: "png", Width: 30000, Height: 30000, FrameCount: 1}},
+		{name: "many large frames", info: &ImageInfo{Format: "gif", Width: 2048, Height: 2048, FrameCount: 100}},
+		{name: "animated webp", info: &ImageInfo{Format: "webp", Width: 1024, Height: 1024, FrameCount: 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The data is not an image; it must not be decoded at all
+			_, _, err := ResizeStickerImage([]byte("not decoded"), tt.info, 512, 1<<20)
+			if !errors.Is(err, ErrInvalidImage) {
+				t.Fatalf("expected ErrInvalidImage, got %v", err)
+			}
+		})
+	}
+}
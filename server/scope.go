@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Scope types. A sticker or pack is visible server-wide, only in one team,
+// or only in one channel.
+const (
+	ScopeServer  = "server"
+	ScopeTeam    = "team"
+	ScopeChannel = "channel"
+)
+
+// Sticker visibility. Private stickers are only listed for and sendable by
+// their creator, although posts already made with them render for everyone.
+const (
+	VisibilityPublic  = "public"
+	VisibilityPrivate = "private"
+)
+
+var (
+	ErrInvalidScope   = errors.New("invalid scope")
+	ErrOutOfScope     = errors.New("this sticker is not available in this channel")
+	ErrPrivateSticker = errors.New("this sticker is private to its creator")
+)
+
+// Scope limits where a sticker or pack can be seen and sent. ID is the team
+// or channel ID. Records from before scopes existed are read as server-wide.
+type Scope struct {
+	Type string `json:"type,omitempty"`
+	ID   string `json:"id,omitempty"`
+}
+
+// Viewer is a user looking at stickers from a team and channel. It decides
+// which scoped stickers and packs are visible; a nil Viewer sees everything
+// and is used for maintenance.
+type Viewer struct {
+	UserID    string
+	TeamID    string
+	ChannelID string
+}
+
+// CanSee reports whether something with the given scope is visible to the
+// viewer
+func (v *Viewer) CanSee(scope Scope) bool {
+	if v == nil {
+		return true
+	}
+
+	switch scope.Type {
+	case "", ScopeServer:
+		return true
+	case ScopeTeam:
+		return v.TeamID != "" && v.TeamID == scope.ID
+	case ScopeChannel:
+		return v.ChannelID != "" && v.ChannelID == scope.ID
+	default:
+		return false
+	}
+}
+
+// CanSeeSticker reports whether a sticker is visible to the viewer, which
+// takes its approval, scope and visibility into account
+func (v *Viewer) CanSeeSticker(sticker *Sticker) bool {
+	if v == nil {
+		return true
+	}
+	if !sticker.IsApproved() {
+		return false
+	}
+	if sticker.IsPrivate() && sticker.CreatorID != v.UserID {
+		return false
+	}
+	return v.CanSee(sticker.Scope)
+}
+
+// NewViewer builds the viewer for a user in a team and channel, keeping only
+// the team and channel the user belongs to. A channel determines the team,
+// so a direct message channel sees no team stickers, matching what can be
+// sent there.
+func (p *Plugin) NewViewer(userID, teamID, channelID string) *Viewer {
+	viewer := &Viewer{UserID: userID}
+
+	if channelID != "" {
+		if _, appErr := p.API.GetChannelMember(channelID, userID); appErr == nil {
+			if channel, appErr := p.API.GetChannel(channelID); appErr == nil {
+				viewer.ChannelID = channel.Id
+				viewer.TeamID = channel.TeamId
+				return viewer
+			}
+		}
+	}
+
+	if teamID != "" {
+		if _, appErr := p.API.GetTeamMember(teamID, userID); appErr == nil {
+			viewer.TeamID = teamID
+		}
+	}
+
+	return viewer
+}
+
+// viewerFromRequest builds the viewer from the team_id and channel_id query
+// parameters
+func (p *Plugin) viewerFromRequest(r *http.Request, userID string) *Viewer {
+	query := r.URL.Query()
+	return p.NewViewer(userID, query.Get("team_id"), query.Get("channel_id"))
+}
+
+// scopeFromForm reads a scope from the scope and scope_id form fields of an
+// upload
+func scopeFromForm(r *http.Request) Scope {
+	return Scope{Type: r.FormValue("scope"), ID: r.FormValue("scope_id")}
+}
+
+// checkScope normalizes a requested scope and checks that the user belongs
+// to its team or channel
+func (p *Plugin) checkScope(userID string, scope Scope) (Scope, error) {
+	switch scope.Type {
+	case "", ScopeServer:
+		return Scope{Type: ScopeServer}, nil
+	case ScopeTeam:
+		if scope.ID == "" {
+			return Scope{}, fmt.Errorf("%w: a team scope needs a team ID", ErrInvalidScope)
+		}
+		if _, appErr := p.API.GetTeamMember(scope.ID, userID); appErr != nil {
+			return Scope{}, fmt.Errorf("%w: you are not a member of team %s", ErrInvalidScope, scope.ID)
+		}
+	case ScopeChannel:
+		if scope.ID == "" {
+			return Scope{}, fmt.Errorf("%w: a channel scope needs a channel ID", ErrInvalidScope)
+		}
+		if _, appErr := p.API.GetChannelMember(scope.ID, userID); appErr != nil {
+			return Scope{}, fmt.Errorf("%w: you are not a member of channel %s", ErrInvalidScope, scope.ID)
+		}
+	default:
+		return Scope{}, fmt.Errorf("%w: unknown scope type '%s'", ErrInvalidScope, scope.Type)
+	}
+
+	return scope, nil
+}
+
+// parseVisibility validates a requested visibility, defaulting to public
+func parseVisibility(value string) (string, error) {
+	switch value {
+	case "", VisibilityPublic:
+		return VisibilityPublic, nil
+	case VisibilityPrivate:
+		return VisibilityPrivate, nil
+	default:
+		return "", fmt.Errorf("visibility must be %s or %s", VisibilityPublic, VisibilityPrivate)
+	}
+}
+
+// checkStickerSendable checks that a user may post a sticker in a channel
+func (p *Plugin) checkStickerSendable(userID, channelID string, sticker *Sticker) error {
+	if !sticker.IsApproved() {
+		return ErrStickerPending
+	}
+	if sticker.IsPrivate() && sticker.CreatorID != userID {
+		return ErrPrivateSticker
+	}
+	if sticker.Scope.Type == ScopeServer {
+		return nil
+	}
+
+	channel, appErr := p.API.GetChannel(channelID)
+	if appErr != nil {
+		return fmt.Errorf("failed to get channel: %w", appErr)
+	}
+
+	viewer := &Viewer{UserID: userID, TeamID: channel.TeamId, ChannelID: channel.Id}
+	if !viewer.CanSee(sticker.Scope) {
+		return ErrOutOfScope
+	}
+	return nil
+}
@@ -2,33 +2,116 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
 )
 
+const stickerPostType = "custom_sticker"
+
+var ErrNoChannelAccess = errors.New("you don't have access to this channel")
+
 type Sticker struct {
-	ID        string `json:"id"`
-	Name      string `json:"name"`
-	FileID    string `json:"file_id"`
-	Filename  string `json:"filename"`
-	CreatorID string `json:"creator_id"`
-	CreatedAt int64  `json:"created_at"`
+	ID        string   `json:"id"`
+	Name      string   `json:"name"`
+	FileID    string   `json:"file_id"`
+	CreatorID string   `json:"creator_id"`
+	CreatedAt int64    `json:"created_at"`
+	Tags      []string `json:"tags"`
+	Aliases   []string `json:"aliases"`
+
+	Description string `json:"description,omitempty"`
+
+	// Scope limits the team or channel the sticker can be seen and sent in,
+	// and a private Visibility limits it to its creator
+	Scope      Scope  `json:"scope"`
+	Visibility string `json:"visibility"`
+
+	StickerImage
+	// PreviousImages keeps the images the sticker showed before its image
+	// was replaced, oldest first
+	PreviousImages []PreviousImage `json:"previous_images,omitempty"`
+
+	UsageCount int64 `json:"usage_count"`
+	LastUsedAt int64 `json:"last_used_at"`
+
+	// DeletedAt and DeletedBy are set while the sticker is in the trash, and
+	// TrashedPackIDs remembers its packs so that a restore can put it back
+	DeletedAt      int64    `json:"deleted_at,omitempty"`
+	DeletedBy      string   `json:"deleted_by,omitempty"`
+	TrashedPackIDs []string `json:"trashed_pack_ids,omitempty"`
+
+	// Status is pending while the sticker awaits approval in moderated mode,
+	// and ModerationPostIDs are the notifications sent to the moderators
+	Status            string   `json:"status"`
+	ModeratedBy       string   `json:"moderated_by,omitempty"`
+	ModeratedAt       int64    `json:"moderated_at,omitempty"`
+	ModerationPostIDs []string `json:"moderation_post_ids,omitempty"`
+	// PendingRevision is an edit of an approved sticker awaiting approval;
+	// until then the sticker keeps its approved state
+	PendingRevision *StickerRevision `json:"pending_revision,omitempty"`
+}
+
+// StickerImage is a stored sticker image together with what was detected
+// about it and the files generated from it
+type StickerImage struct {
+	Filename   string `json:"filename"`
+	UploadedAt int64  `json:"uploaded_at,omitempty"`
+
+	Format     string `json:"format"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	FrameCount int    `json:"frame_count"`
+	// Sanitized is set once EXIF, XMP and other metadata have been removed
+	// from the stored image
+	Sanitized bool `json:"sanitized"`
+	// SHA256 is the hex SHA-256 of the stored image, used to find stickers
+	// with exactly the same image
+	SHA256 string `json:"sha256,omitempty"`
+	// PerceptualHash is a hex difference hash of the first frame, used to
+	// find visually near-identical stickers
+	PerceptualHash string `json:"perceptual_hash,omitempty"`
+
+	// Thumbnails maps a bounding box size in pixels to an image key, and
+	// Preview holds a still of the first frame of animated images
+	Thumbnails map[string]string `json:"thumbnails,omitempty"`
+	Preview    string            `json:"preview,omitempty"`
+}
+
+// PreviousImage is an image a sticker no longer shows, kept so that it can
+// be restored
+type PreviousImage struct {
+	StickerImage
+	ReplacedAt int64  `json:"replaced_at"`
+	ReplacedBy string `json:"replaced_by"`
 }
 
 type StickerList struct {
-	Stickers []*Sticker `json:"stickers"`
-	Total    int        `json:"total"`
+	Stickers   []*Sticker `json:"stickers"`
+	Total      int        `json:"total"`
+	Page       int        `json:"page,omitempty"`
+	PerPage    int        `json:"per_page,omitempty"`
+	NextCursor string     `json:"next_cursor,omitempty"`
 }
 
 func NewSticker(name, fileID, filename, creatorID string) *Sticker {
 	return &Sticker{
-		ID:        model.NewId(),
-		Name:      name,
-		FileID:    fileID,
-		Filename:  filename,
-		CreatorID: creatorID,
-		CreatedAt: time.Now().UnixMilli(),
+		ID:         model.NewId(),
+		Name:       name,
+		FileID:     fileID,
+		CreatorID:  creatorID,
+		CreatedAt:  time.Now().UnixMilli(),
+		Tags:       []string{},
+		Aliases:    []string{},
+		Scope:      Scope{Type: ScopeServer},
+		Visibility: VisibilityPublic,
+		Status:     StickerStatusApproved,
+
+		StickerImage: StickerImage{Filename: filename},
 	}
 }
 
@@ -41,22 +124,230 @@ func StickerFromJSON(data []byte) (*Sticker, error) {
 	if err := json.Unmarshal(data, &s); err != nil {
 		return nil, err
 	}
+	if s.Tags == nil {
+		s.Tags = []string{}
+	}
+	if s.Aliases == nil {
+		s.Aliases = []string{}
+	}
+	if s.Scope.Type == "" {
+		s.Scope.Type = ScopeServer
+	}
+	if s.Visibility == "" {
+		s.Visibility = VisibilityPublic
+	}
+	if s.Status == "" {
+		s.Status = StickerStatusApproved
+	}
 	return &s, nil
 }
 
-func (p *Plugin) CreateStickerPost(channelID, userID, stickerID, rootID string) (*model.Post, error) {
-	sticker, err := p.GetSticker(stickerID)
-	if err != nil {
+// ImageFormat returns the detected image format, e.g. "png", falling back to
+// the stored filename for stickers created before formats were recorded
+func (i *StickerImage) ImageFormat() string {
+	if i.Format != "" {
+		return i.Format
+	}
+	return normalizeFormat(filepath.Ext(i.Filename))
+}
+
+// Keys returns the image store keys of the image and its generated files
+func (i *StickerImage) Keys() []string {
+	keys := make([]string, 0, len(i.Thumbnails)+2)
+	if i.Filename != "" {
+		keys = append(keys, i.Filename)
+	}
+	for _, key := range i.Thumbnails {
+		keys = append(keys, key)
+	}
+	if i.Preview != "" {
+		keys = append(keys, i.Preview)
+	}
+	return keys
+}
+
+// IsPrivate reports whether only the creator may list and send the sticker
+func (s *Sticker) IsPrivate() bool {
+	return s.Visibility == VisibilityPrivate
+}
+
+// IsApproved reports whether the sticker may be listed and sent, which is
+// the case for every sticker uploaded outside moderated mode
+func (s *Sticker) IsApproved() bool {
+	return s.Status == StickerStatusApproved
+}
+
+// IsPending reports whether the sticker awaits a moderator's decision
+func (s *Sticker) IsPending() bool {
+	return s.Status == StickerStatusPending
+}
+
+// IsTrashed reports whether the sticker has been deleted but not purged yet
+func (s *Sticker) IsTrashed() bool {
+	return s.DeletedAt != 0
+}
+
+// ImageKeys returns every image store key the sticker references, including
+// those of previous images and of its pending revision
+func (s *Sticker) ImageKeys() []string {
+	keys := s.StickerImage.Keys()
+	for i := range s.PreviousImages {
+		keys = append(keys, s.PreviousImages[i].Keys()...)
+	}
+	if s.PendingRevision != nil {
+		keys = append(keys, unsharedImageKeys(s.PendingRevision.images(), s.images())...)
+	}
+	return keys
+}
+
+// images returns the sticker's image followed by its previous images
+func (s *Sticker) images() []StickerImage {
+	return stickerImages(s.StickerImage, s.PreviousImages)
+}
+
+func stickerImages(current StickerImage, previous []PreviousImage) []StickerImage {
+	images := make([]StickerImage, 0, len(previous)+1)
+	if current.Filename != "" {
+		images = append(images, current)
+	}
+	for _, image := range previous {
+		images = append(images, image.StickerImage)
+	}
+	return images
+}
+
+// unsharedImageKeys returns the keys of the images in from that are not in
+// to. Each stored image holds one reference however many states of a
+// sticker show it, so only these can be released when from is dropped.
+func unsharedImageKeys(from, to []StickerImage) []string {
+	shared := make(map[string]bool, len(to))
+	for _, image := range to {
+		shared[image.Filename] = true
+	}
+
+	var keys []string
+	for _, image := range from {
+		if !shared[image.Filename] {
+			keys = append(keys, image.Keys()...)
+		}
+	}
+	return keys
+}
+
+// reservedStickerNames are the /sticker subcommands. A sticker named after
+// one could not be sent with /sticker [name], since the subcommand runs
+// instead.
+var reservedStickerNames = map[string]bool{
+	"list":    true,
+	"add":     true,
+	"delete":  true,
+	"trash":   true,
+	"pending": true,
+	"restore": true,
+	"rename":  true,
+	"pack":    true,
+	"admin":   true,
+	"help":    true,
+}
+
+// ErrNameReserved is returned when a sticker name or alias is a /sticker
+// subcommand
+var ErrNameReserved = errors.New("reserved for a /sticker subcommand")
+
+// checkStickerName rejects a sticker name or alias that is reserved
+func checkStickerName(name string) error {
+	if reservedStickerNames[normalizeName(name)] {
+		return fmt.Errorf("'%s' is %w", strings.TrimSpace(name), ErrNameReserved)
+	}
+	return nil
+}
+
+// normalizeName lowercases and trims a sticker name for lookups
+func normalizeName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// NormalizeTerms lowercases and trims tags or aliases, dropping empty values
+// and duplicates while keeping the original order
+func NormalizeTerms(terms []string) []string {
+	seen := make(map[string]bool, len(terms))
+	result := make([]string, 0, len(terms))
+	for _, term := range terms {
+		term = normalizeName(term)
+		if term == "" || seen[term] {
+			continue
+		}
+		seen[term] = true
+		result = append(result, term)
+	}
+	return result
+}
+
+// SplitTerms parses a comma-separated list of tags or aliases
+func SplitTerms(value string) []string {
+	if strings.TrimSpace(value) == "" {
+		return []string{}
+	}
+	return NormalizeTerms(strings.Split(value, ","))
+}
+
+// HasTag reports whether the sticker carries the normalized tag
+func (s *Sticker) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesQuery reports whether the normalized query is a substring of the
+// sticker's name, one of its aliases or one of its tags
+func (s *Sticker) MatchesQuery(query string) bool {
+	if strings.Contains(strings.ToLower(s.Name), query) {
+		return true
+	}
+	for _, alias := range s.Aliases {
+		if strings.Contains(alias, query) {
+			return true
+		}
+	}
+	for _, tag := range s.Tags {
+		if strings.Contains(tag, query) {
+			return true
+		}
+	}
+	return false
+}
+
+// SendSticker posts a sticker to a channel on behalf of a user. Every entry
+// point uses this so sticker posts always have the same shape: a custom post
+// type rendered by the webapp, with a markdown image as fallback for clients
+// without the plugin such as mobile.
+func (p *Plugin) SendSticker(userID, channelID, rootID string, sticker *Sticker) (*model.Post, error) {
+	if _, appErr := p.API.GetChannelMember(channelID, userID); appErr != nil {
+		return nil, ErrNoChannelAccess
+	}
+	if err := p.checkStickerSendable(userID, channelID, sticker); err != nil {
 		return nil, err
 	}
 
-	// Use file_ids for mobile compatibility
 	post := &model.Post{
 		UserId:    userID,
 		ChannelId: channelID,
 		RootId:    rootID,
-		FileIds:   []string{sticker.FileID},
+		Type:      stickerPostType,
+		Message:   "![" + sticker.Name + "](" + p.GetStickerPublicURL(sticker, channelID) + ")",
+	}
+	post.AddProp("sticker_id", sticker.ID)
+	post.AddProp("sticker_name", sticker.Name)
+
+	createdPost, appErr := p.API.CreatePost(post)
+	if appErr != nil {
+		return nil, fmt.Errorf("failed to create post: %w", appErr)
 	}
 
-	return p.API.CreatePost(post)
+	p.RecordStickerUsage(sticker.ID, createdPost.CreateAt)
+
+	return createdPost, nil
 }
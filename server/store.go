@@ -1,43 +1,47 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
+	"net/url"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
 )
 
 const (
-	stickersKey     = "stickers"
+	stickersKey      = "stickers"
 	stickerKeyPrefix = "sticker_"
-)
+	indexMutexKey    = "stickers_index"
 
-func (p *Plugin) GetAllStickers() (*StickerList, error) {
-	data, appErr := p.API.KVGet(stickersKey)
-	if appErr != nil {
-		return nil, fmt.Errorf("failed to get stickers: %w", appErr)
-	}
-
-	if data == nil {
-		return &StickerList{Stickers: []*Sticker{}, Total: 0}, nil
-	}
+	indexUpdateMaxAttempts = 10
+	indexUpdateBackoff     = 20 * time.Millisecond
+	indexLockTimeout       = 10 * time.Second
+)
 
-	var ids []string
-	if err := json.Unmarshal(data, &ids); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal sticker IDs: %w", err)
+// GetAllStickers returns the stickers visible to the viewer, or every
+// sticker outside the trash for a nil viewer
+func (p *Plugin) GetAllStickers(viewer *Viewer) (*StickerList, error) {
+	stickers, err := p.stickerCache.load(p.API)
+	if err != nil {
+		return nil, err
 	}
 
-	stickers := make([]*Sticker, 0, len(ids))
-	for _, id := range ids {
-		sticker, err := p.GetSticker(id)
-		if err != nil {
-			continue
+	if viewer != nil {
+		visible := make([]*Sticker, 0, len(stickers))
+		for _, s := range stickers {
+			if viewer.CanSeeSticker(s) {
+				visible = append(visible, s)
+			}
 		}
-		stickers = append(stickers, sticker)
+		stickers = visible
 	}
+	stickers = withUsage(stickers, p.stickerUsageCounts())
 
 	return &StickerList{
 		Stickers: stickers,
@@ -46,7 +50,20 @@ func (p *Plugin) GetAllStickers() (*StickerList, error) {
 }
 
 func (p *Plugin) GetSticker(id string) (*Sticker, error) {
-	data, appErr := p.API.KVGet(stickerKeyPrefix + id)
+	if sticker, ok := p.stickerCache.get(id); ok {
+		return p.applyStickerUsage(sticker), nil
+	}
+
+	sticker, err := fetchSticker(p.API, id)
+	if err != nil {
+		return nil, err
+	}
+	return p.applyStickerUsage(sticker), nil
+}
+
+// fetchSticker reads a sticker record from the KV store, bypassing the cache
+func fetchSticker(api plugin.API, id string) (*Sticker, error) {
+	data, appErr := api.KVGet(stickerKeyPrefix + id)
 	if appErr != nil {
 		return nil, fmt.Errorf("failed to get sticker: %w", appErr)
 	}
@@ -58,17 +75,40 @@ func (p *Plugin) GetSticker(id string) (*Sticker, error) {
 	return StickerFromJSON(data)
 }
 
-func (p *Plugin) GetStickerByName(name string) (*Sticker, error) {
-	list, err := p.GetAllStickers()
+// GetStickerByName resolves a sticker visible to the viewer by name or alias.
+// A tag is accepted as well when exactly one visible sticker carries it.
+// Names and aliases are unique across all scopes.
+func (p *Plugin) GetStickerByName(name string, viewer *Viewer) (*Sticker, error) {
+	normalizedName := normalizeName(name)
+	s, err := p.stickerCache.lookup(p.API, normalizedName)
 	if err != nil {
 		return nil, err
 	}
+	if s != nil {
+		if !viewer.CanSeeSticker(s) {
+			return nil, fmt.Errorf("sticker '%s' not found", name)
+		}
+		return p.applyStickerUsage(s), nil
+	}
 
-	normalizedName := strings.ToLower(strings.TrimSpace(name))
+	// Only tags need the visible stickers
+	list, err := p.GetAllStickers(viewer)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged *Sticker
 	for _, s := range list.Stickers {
-		if strings.ToLower(s.Name) == normalizedName {
-			return s, nil
+		if !s.HasTag(normalizedName) {
+			continue
+		}
+		if tagged != nil {
+			return nil, fmt.Errorf("sticker '%s' is ambiguous: several stickers are tagged with it", name)
 		}
+		tagged = s
+	}
+	if tagged != nil {
+		return tagged, nil
 	}
 
 	return nil, fmt.Errorf("sticker '%s' not found", name)
@@ -83,131 +123,274 @@ func (p *Plugin) SaveSticker(sticker *Sticker) error {
 	if appErr := p.API.KVSet(stickerKeyPrefix+sticker.ID, data); appErr != nil {
 		return fmt.Errorf("failed to save sticker: %w", appErr)
 	}
+	p.recordStickerCreated(sticker)
 
-	return p.addStickerToIndex(sticker.ID)
+	err = p.addStickerToIndex(sticker.ID)
+	p.notifyStickerChanged(sticker.ID)
+	return err
 }
 
-func (p *Plugin) DeleteSticker(id string) error {
-	if appErr := p.API.KVDelete(stickerKeyPrefix + id); appErr != nil {
-		return fmt.Errorf("failed to delete sticker: %w", appErr)
-	}
-
-	return p.removeStickerFromIndex(id)
-}
+// UpdateSticker applies mutate to the stored sticker with compare-and-set so
+// that concurrent edits are not lost
+func (p *Plugin) UpdateSticker(id string, mutate func(sticker *Sticker) error) (*Sticker, error) {
+	var updated *Sticker
+	err := p.compareAndSetWithRetry(stickerKeyPrefix+id, func(oldData []byte) ([]byte, bool, error) {
+		if oldData == nil {
+			return nil, false, fmt.Errorf("sticker not found")
+		}
 
-func (p *Plugin) addStickerToIndex(id string) error {
-	data, appErr := p.API.KVGet(stickersKey)
-	if appErr != nil {
-		return fmt.Errorf("failed to get sticker index: %w", appErr)
-	}
+		sticker, err := StickerFromJSON(oldData)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to unmarshal sticker: %w", err)
+		}
 
-	var ids []string
-	if data != nil {
-		if err := json.Unmarshal(data, &ids); err != nil {
-			return fmt.Errorf("failed to unmarshal sticker index: %w", err)
+		if err := mutate(sticker); err != nil {
+			return nil, false, err
 		}
-	}
 
-	for _, existingID := range ids {
-		if existingID == id {
-			return nil
+		newData, err := sticker.ToJSON()
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal sticker: %w", err)
 		}
+
+		updated = sticker
+		return newData, true, nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	ids = append(ids, id)
+	p.notifyStickerChanged(id)
+	return updated, nil
+}
 
-	newData, err := json.Marshal(ids)
+// ReplaceStickerImage makes a prepared image the sticker's image, keeping ID,
+// name and usage, and retains the current image as a previous image. Stickers
+// created before the image store existed have no stored image to retain. The
+// prepared image is released if the sticker cannot be updated.
+func (p *Plugin) ReplaceStickerImage(id, userID string, stored *StickerImage) (*Sticker, error) {
+	sticker, err := p.EditSticker(id, userID, versionActionReplaceImage, func(sticker *Sticker) error {
+		if sticker.Filename != "" {
+			sticker.PreviousImages = append(sticker.PreviousImages, PreviousImage{
+				StickerImage: sticker.StickerImage,
+				ReplacedAt:   time.Now().UnixMilli(),
+				ReplacedBy:   userID,
+			})
+		}
+		sticker.StickerImage = *stored
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("failed to marshal sticker index: %w", err)
+		p.ReleaseStickerImage(stored)
+		return nil, err
 	}
 
-	if appErr := p.API.KVSet(stickersKey, newData); appErr != nil {
-		return fmt.Errorf("failed to save sticker index: %w", appErr)
-	}
+	return sticker, nil
+}
 
-	return nil
+// AddStickerAlias adds an alias to a sticker, failing if another sticker
+// already uses it as a name or alias
+func (p *Plugin) AddStickerAlias(id, userID, alias string) (*Sticker, error) {
+	return p.EditSticker(id, userID, versionActionUpdate, func(sticker *Sticker) error {
+		aliases, err := p.validateAliases(NormalizeTerms(append(append([]string{}, sticker.Aliases...), alias)), sticker.Name, sticker.ID)
+		if err != nil {
+			return err
+		}
+		sticker.Aliases = aliases
+		return nil
+	})
 }
 
-func (p *Plugin) removeStickerFromIndex(id string) error {
-	data, appErr := p.API.KVGet(stickersKey)
-	if appErr != nil {
-		return fmt.Errorf("failed to get sticker index: %w", appErr)
+// DeleteSticker permanently removes the sticker record, its index or trash
+// entry, its pack memberships, its history and its references to its images.
+// Users delete stickers with TrashSticker; this is what purging does.
+// A failure to delete the image is only logged since the record is already
+// gone; the image garbage collector removes such leftovers later.
+func (p *Plugin) DeleteSticker(id string) error {
+	sticker, err := p.GetSticker(id)
+	if err != nil {
+		return err
 	}
 
-	if data == nil {
-		return nil
+	if appErr := p.API.KVDelete(stickerKeyPrefix + id); appErr != nil {
+		return fmt.Errorf("failed to delete sticker: %w", appErr)
 	}
 
-	var ids []string
-	if err := json.Unmarshal(data, &ids); err != nil {
-		return fmt.Errorf("failed to unmarshal sticker index: %w", err)
+	if sticker.IsTrashed() {
+		err = p.removeFromIndex(trashKey, id)
+	} else {
+		err = p.removeStickerFromIndex(id)
+	}
+	p.notifyStickerChanged(id)
+	if err != nil {
+		return err
 	}
 
-	newIDs := make([]string, 0, len(ids))
-	for _, existingID := range ids {
-		if existingID != id {
-			newIDs = append(newIDs, existingID)
-		}
+	if err := p.RemoveStickerFromPacks(id); err != nil {
+		p.API.LogWarn("Failed to remove sticker from packs", "sticker_id", id, "error", err.Error())
 	}
 
-	newData, err := json.Marshal(newIDs)
-	if err != nil {
-		return fmt.Errorf("failed to marshal sticker index: %w", err)
+	if err := p.deleteStickerVersions(id); err != nil {
+		p.API.LogWarn("Failed to delete sticker versions", "sticker_id", id, "error", err.Error())
 	}
+	p.forgetStickerUsage(id)
 
-	if appErr := p.API.KVSet(stickersKey, newData); appErr != nil {
-		return fmt.Errorf("failed to save sticker index: %w", appErr)
+	if err := p.ReleaseImages(sticker.ImageKeys()); err != nil {
+		p.API.LogWarn("Failed to delete sticker images", "sticker_id", id, "error", err.Error())
 	}
 
 	return nil
 }
 
-func (p *Plugin) CanDeleteSticker(userID, stickerID string) (bool, error) {
-	user, appErr := p.API.GetUser(userID)
-	if appErr != nil {
-		return false, fmt.Errorf("failed to get user: %w", appErr)
-	}
+func (p *Plugin) addStickerToIndex(id string) error {
+	return p.addToIndex(stickersKey, id)
+}
 
-	if user.IsSystemAdmin() {
-		return true, nil
-	}
+func (p *Plugin) removeStickerFromIndex(id string) error {
+	return p.removeFromIndex(stickersKey, id)
+}
 
-	sticker, err := p.GetSticker(stickerID)
-	if err != nil {
-		return false, err
-	}
+func (p *Plugin) addToIndex(key, id string) error {
+	return p.updateIndex(key, func(ids []string) ([]string, bool) {
+		for _, existingID := range ids {
+			if existingID == id {
+				return ids, false
+			}
+		}
+		return append(ids, id), true
+	})
+}
 
-	return sticker.CreatorID == userID, nil
+func (p *Plugin) removeFromIndex(key, id string) error {
+	return p.updateIndex(key, func(ids []string) ([]string, bool) {
+		newIDs := make([]string, 0, len(ids))
+		for _, existingID := range ids {
+			if existingID != id {
+				newIDs = append(newIDs, existingID)
+			}
+		}
+		return newIDs, len(newIDs) != len(ids)
+	})
 }
 
-func (p *Plugin) SearchStickers(query string) (*StickerList, error) {
-	list, err := p.GetAllStickers()
-	if err != nil {
-		return nil, err
+// updateIndex applies mutate to the ID list stored under key. The cluster
+// mutex keeps app nodes from contending; the compare-and-set in
+// compareAndSetWithRetry guarantees no update is lost even if the lock
+// expires. mutate reports whether it changed the index. Changes to the main
+// index are published to every node's cache.
+func (p *Plugin) updateIndex(key string, mutate func(ids []string) ([]string, bool)) error {
+	if p.indexMutex != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), indexLockTimeout)
+		defer cancel()
+
+		if err := p.indexMutex.LockWithContext(ctx); err != nil {
+			return fmt.Errorf("failed to lock index: %w", err)
+		}
+		defer p.indexMutex.Unlock()
 	}
 
-	if query == "" {
-		return list, nil
+	var changed bool
+	err := p.compareAndSetWithRetry(key, func(oldData []byte) ([]byte, bool, error) {
+		var ids []string
+		if oldData != nil {
+			if err := json.Unmarshal(oldData, &ids); err != nil {
+				return nil, false, fmt.Errorf("failed to unmarshal index: %w", err)
+			}
+		}
+
+		var newIDs []string
+		newIDs, changed = mutate(ids)
+		if !changed {
+			return nil, false, nil
+		}
+
+		newData, err := json.Marshal(newIDs)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal index: %w", err)
+		}
+		return newData, true, nil
+	})
+	if err == nil && changed && key == stickersKey {
+		p.notifyIndexChanged()
 	}
+	return err
+}
 
-	normalizedQuery := strings.ToLower(strings.TrimSpace(query))
-	filtered := make([]*Sticker, 0)
+// compareAndSetWithRetry applies mutate to the value stored under key and
+// writes it back with compare-and-set, retrying when another writer changed
+// the value in between. mutate reports whether it changed the value.
+func (p *Plugin) compareAndSetWithRetry(key string, mutate func(oldData []byte) ([]byte, bool, error)) error {
+	for attempt := 0; attempt < indexUpdateMaxAttempts; attempt++ {
+		if attempt > 0 {
+			atomic.AddInt64(&p.indexMetrics.Retries, 1)
+			time.Sleep(time.Duration(attempt) * indexUpdateBackoff)
+		}
 
-	for _, s := range list.Stickers {
-		if strings.Contains(strings.ToLower(s.Name), normalizedQuery) {
-			filtered = append(filtered, s)
+		oldData, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return fmt.Errorf("failed to get %s: %w", key, appErr)
 		}
+
+		newData, changed, err := mutate(oldData)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			return nil
+		}
+
+		ok, appErr := p.API.KVCompareAndSet(key, oldData, newData)
+		if appErr != nil {
+			return fmt.Errorf("failed to save %s: %w", key, appErr)
+		}
+		if ok {
+			return nil
+		}
+
+		atomic.AddInt64(&p.indexMetrics.Conflicts, 1)
 	}
 
-	return &StickerList{
-		Stickers: filtered,
-		Total:    len(filtered),
-	}, nil
+	atomic.AddInt64(&p.indexMetrics.Failures, 1)
+	p.API.LogWarn("Giving up on KV update after repeated conflicts", "key", key, "attempts", indexUpdateMaxAttempts)
+
+	return fmt.Errorf("failed to save %s: too many concurrent updates", key)
+}
+
+// IndexMetrics counts compare-and-set outcomes for index and record updates
+type IndexMetrics struct {
+	Conflicts int64 `json:"conflicts"`
+	Retries   int64 `json:"retries"`
+	Failures  int64 `json:"failures"`
 }
 
+// GetIndexMetrics returns a snapshot of the compare-and-set counters
+func (p *Plugin) GetIndexMetrics() IndexMetrics {
+	return IndexMetrics{
+		Conflicts: atomic.LoadInt64(&p.indexMetrics.Conflicts),
+		Retries:   atomic.LoadInt64(&p.indexMetrics.Retries),
+		Failures:  atomic.LoadInt64(&p.indexMetrics.Failures),
+	}
+}
+
+func (p *Plugin) SearchStickers(query string, viewer *Viewer) (*StickerList, error) {
+	return p.QueryStickers(&StickerQuery{Search: query, SortBy: sortByCreatedAt, Viewer: viewer})
+}
+
+// IsStickerNameTaken reports whether name is already used as the name or an
+// alias of a sticker. Tags are shared and never make a name taken.
 func (p *Plugin) IsStickerNameTaken(name string) bool {
-	_, err := p.GetStickerByName(name)
-	return err == nil
+	return p.isStickerNameTakenBy(name, "")
+}
+
+// isStickerNameTakenBy is IsStickerNameTaken ignoring the sticker excludeID,
+// so a sticker can keep its own name and aliases when it is edited
+func (p *Plugin) isStickerNameTakenBy(name, excludeID string) bool {
+	s, err := p.stickerCache.lookup(p.API, normalizeName(name))
+	if err != nil {
+		return false
+	}
+
+	return s != nil && s.ID != excludeID
 }
 
 func (p *Plugin) UploadStickerImage(fileData []byte, filename, userID, channelID string) (*model.FileInfo, error) {
@@ -219,49 +402,74 @@ func (p *Plugin) UploadStickerImage(fileData []byte, filename, userID, channelID
 	return fileInfo, nil
 }
 
-// SaveStickerImageToLocal saves sticker image to local filesystem and returns the filename
-func (p *Plugin) SaveStickerImageToLocal(fileData []byte, originalFilename string) (string, error) {
-	cfg := p.getConfiguration()
-	if cfg.StickerStoragePath == "" {
-		return "", fmt.Errorf("sticker storage path not configured")
+// SaveStickerImage saves sticker image to the configured image store under key
+// and returns the key it was stored under
+func (p *Plugin) SaveStickerImage(key string, fileData []byte) (string, error) {
+	store, err := p.getImageStore()
+	if err != nil {
+		return "", err
 	}
 
-	// Generate unique filename
-	ext := filepath.Ext(originalFilename)
-	filename := model.NewId() + ext
+	return store.Save(key, fileData)
+}
+
+// ReadStickerImage reads sticker image bytes from the configured image store
+func (p *Plugin) ReadStickerImage(filename string) ([]byte, error) {
+	store, err := p.getImageStore()
+	if err != nil {
+		return nil, err
+	}
 
-	fullPath := filepath.Join(cfg.StickerStoragePath, filename)
+	return store.Read(filename)
+}
 
-	// Ensure directory exists
-	if err := os.MkdirAll(cfg.StickerStoragePath, 0755); err != nil {
-		return "", fmt.Errorf("failed to create storage directory: %w", err)
+// DeleteStickerImage deletes sticker image from the configured image store.
+// Stores that cannot delete leave the file for image GC and fsck to report.
+func (p *Plugin) DeleteStickerImage(filename string) error {
+	if filename == "" {
+		return nil
 	}
 
-	// Write file
-	if err := os.WriteFile(fullPath, fileData, 0644); err != nil {
-		return "", fmt.Errorf("failed to write sticker file: %w", err)
+	store, err := p.getImageStore()
+	if err != nil {
+		return err
 	}
 
-	return filename, nil
+	if err := store.Delete(filename); err != nil && !errors.Is(err, ErrImageDeleteUnsupported) {
+		return err
+	}
+	return nil
 }
 
-// DeleteStickerImageFromLocal deletes sticker image from local filesystem
-func (p *Plugin) DeleteStickerImageFromLocal(filename string) error {
-	cfg := p.getConfiguration()
-	if cfg.StickerStoragePath == "" || filename == "" {
-		return nil
+// GetStickerPublicURL returns the public URL for a sticker image. When an
+// external sticker server is configured for local storage it is used directly,
+// otherwise the image is served by the plugin itself, which checks that the
+// user can see the sticker from channelID when it is given.
+func (p *Plugin) GetStickerPublicURL(sticker *Sticker, channelID string) string {
+	query := url.Values{}
+	if channelID != "" {
+		query.Set("channel_id", channelID)
 	}
-
-	fullPath := filepath.Join(cfg.StickerStoragePath, filename)
-	return os.Remove(fullPath)
+	return p.stickerImageURL(sticker, query)
 }
 
-// GetStickerPublicURL returns the public URL for a sticker
-func (p *Plugin) GetStickerPublicURL(filename string) string {
+// stickerImageURL returns the URL of the sticker's image on the external
+// sticker server, or of the plugin's image endpoint with the query
+func (p *Plugin) stickerImageURL(sticker *Sticker, query url.Values) string {
 	cfg := p.getConfiguration()
-	if cfg.StickerServerURL == "" || filename == "" {
-		return ""
+	if cfg.StickerServerURL != "" && sticker.Filename != "" &&
+		(cfg.StorageBackend == "" || cfg.StorageBackend == storageBackendLocal) {
+		return strings.TrimSuffix(cfg.StickerServerURL, "/") + "/" + sticker.Filename
+	}
+
+	siteURL := ""
+	if config := p.API.GetConfig(); config != nil && config.ServiceSettings.SiteURL != nil {
+		siteURL = strings.TrimSuffix(*config.ServiceSettings.SiteURL, "/")
 	}
 
-	return strings.TrimSuffix(cfg.StickerServerURL, "/") + "/" + filename
+	imageURL := siteURL + "/plugins/" + pluginID + "/api/v1/stickers/" + sticker.ID + "/image"
+	if len(query) > 0 {
+		imageURL += "?" + query.Encode()
+	}
+	return imageURL
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// racingAPI lets another writer change a key just before each of the first
+// compare-and-sets on it, so that they fail
+type racingAPI struct {
+	*fakeAPI
+
+	races int
+	write func()
+}
+
+func (r *racingAPI) KVCompareAndSet(key string, oldValue, newValue []byte) (bool, *model.AppError) {
+	if r.races > 0 {
+		r.races--
+		r.write()
+	}
+	return r.fakeAPI.KVCompareAndSet(key, oldValue, newValue)
+}
+
+func readIndex(t *testing.T, api *fakeAPI, key string) []string {
+	t.Helper()
+
+	var ids []string
+	if data := api.kv[key]; data != nil {
+		if err := json.Unmarshal(data, &ids); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return ids
+}
+
+func TestConcurrentIndexUpdatesAreNotLost(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{})
+
+	const writers = 8
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := p.addToIndex(trashKey, fmt.Sprintf("sticker%d", i)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ids := readIndex(t, api, trashKey)
+	sort.Strings(ids)
+	if len(ids) != writers {
+		t.Fatalf("index holds %q, want %d entries", ids, writers)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] == ids[i-1] {
+			t.Errorf("duplicate entry %q", ids[i])
+		}
+	}
+}
+
+func TestIndexUpdateRetries(t *testing.T) {
+	// Every attempt loses against another writer
+	var outraced []string
+	for i := 1; i <= indexUpdateMaxAttempts; i++ {
+		outraced = append(outraced, fmt.Sprintf("theirs%d", i))
+	}
+
+	tests := []struct {
+		name        string
+		races       int
+		wantErr     bool
+		wantIDs     []string
+		wantMetrics IndexMetrics
+	}{
+		{
+			name:    "no conflict",
+			wantIDs: []string{"mine"},
+		},
+		{
+			name:        "one conflict",
+			races:       1,
+			wantIDs:     []string{"theirs1", "mine"},
+			wantMetrics: IndexMetrics{Conflicts: 1, Retries: 1},
+		},
+		{
+			name:        "gives up",
+			races:       indexUpdateMaxAttempts,
+			wantErr:     true,
+			wantIDs:     outraced,
+			wantMetrics: IndexMetrics{Conflicts: indexUpdateMaxAttempts, Retries: indexUpdateMaxAttempts - 1, Failures: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newFakeAPI()
+			p := newTestPlugin(api, &configuration{})
+
+			written := 0
+			p.SetAPI(&racingAPI{fakeAPI: api, races: tt.races, write: func() {
+				written++
+				ids := append(readIndex(t, api, trashKey), fmt.Sprintf("theirs%d", written))
+				data, _ := json.Marshal(ids)
+				api.kv[trashKey] = data
+			}})
+
+			err := p.addToIndex(trashKey, "mine")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if ids := readIndex(t, api, trashKey); !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("index %q, want %q", ids, tt.wantIDs)
+			}
+			if got := p.GetIndexMetrics(); got != tt.wantMetrics {
+				t.Errorf("metrics %+v, want %+v", got, tt.wantMetrics)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"sort"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// thumbnailSizes are the bounding boxes, in pixels, generated for each sticker
+var thumbnailSizes = []int{64, 128, 256}
+
+// fitSize scales width and height down to fit a square box, keeping the
+// aspect ratio. Images that already fit are left at their size.
+func fitSize(width, height, box int) (int, int) {
+	if width <= box && height <= box {
+		return width, height
+	}
+
+	if width >= height {
+		return box, max(1, height*box/width)
+	}
+	return max(1, width*box/height), box
+}
+
+// scaleImage resizes img to the given size into an RGBA image so that
+// transparency is preserved
+func scaleImage(img image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+	return dst
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// generateStickerPreviews stores PNG thumbnails of the decoded first frame
+// and, for animated images, a full-size still of it. It fills in the image's
+// Thumbnails and Preview keys. On failure the files stored so far are
+// released and the image is left without previews.
+func (p *Plugin) generateStickerPreviews(stored *StickerImage, img image.Image) error {
+	generated := &StickerImage{Thumbnails: make(map[string]string, len(thumbnailSizes))}
+	fail := func(err error) error {
+		p.ReleaseStickerImage(generated)
+		return err
+	}
+
+	bounds := img.Bounds()
+	for _, size := range thumbnailSizes {
+		width, height := fitSize(bounds.Dx(), bounds.Dy(), size)
+		thumbnail, err := encodePNG(scaleImage(img, width, height))
+		if err != nil {
+			return fail(fmt.Errorf("failed to encode thumbnail: %w", err))
+		}
+
+		key, err := p.StoreImage(thumbnail, "thumbnail.png")
+		if err != nil {
+			return fail(err)
+		}
+		generated.Thumbnails[strconv.Itoa(size)] = key
+	}
+
+	if stored.FrameCount > 1 {
+		still, err := encodePNG(img)
+		if err != nil {
+			return fail(fmt.Errorf("failed to encode preview: %w", err))
+		}
+
+		generated.Preview, err = p.StoreImage(still, "preview.png")
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	stored.Thumbnails = generated.Thumbnails
+	stored.Preview = generated.Preview
+
+	return nil
+}
+
+// ThumbnailKey returns the key of the smallest thumbnail at least size pixels
+// wide, or the largest one when none is big enough. It returns "" for
+// stickers without thumbnails.
+func (i *StickerImage) ThumbnailKey(size int) string {
+	sizes := make([]int, 0, len(i.Thumbnails))
+	for k := range i.Thumbnails {
+		if n, err := strconv.Atoi(k); err == nil {
+			sizes = append(sizes, n)
+		}
+	}
+	if len(sizes) == 0 {
+		return ""
+	}
+
+	sort.Ints(sizes)
+	for _, n := range sizes {
+		if n >= size {
+			return i.Thumbnails[strconv.Itoa(n)]
+		}
+	}
+	return i.Thumbnails[strconv.Itoa(sizes[len(sizes)-1])]
+}
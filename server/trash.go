@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// trashKey indexes the stickers in the trash. They are kept out of the
+	// main index so that listing, search and name lookups never see them.
+	trashKey = "stickers_trash"
+
+	trashPurgeJobKey   = "trash_purge"
+	trashPurgeInterval = time.Hour
+
+	defaultTrashRetentionDays = 30
+)
+
+var (
+	ErrStickerTrashed    = errors.New("sticker is in the trash")
+	ErrStickerNotTrashed = errors.New("sticker is not in the trash")
+
+	// ErrRestoreNameTaken is returned when a sticker cannot leave the trash
+	// under its name because another sticker has taken it
+	ErrRestoreNameTaken = errors.New("the name is now used by another sticker")
+)
+
+// TrashList is the content of the trash visible to a user, most recently
+// deleted first
+type TrashList struct {
+	Stickers      []*Sticker `json:"stickers"`
+	Total         int        `json:"total"`
+	RetentionDays int        `json:"retention_days"`
+}
+
+func (p *Plugin) getTrashRetentionDays() int {
+	days := p.getConfiguration().TrashRetentionDays
+	if days <= 0 {
+		return defaultTrashRetentionDays
+	}
+	return days
+}
+
+// GetLiveSticker is GetSticker for stickers that can be sent and edited,
+// treating a sticker in the trash as missing
+func (p *Plugin) GetLiveSticker(id string) (*Sticker, error) {
+	sticker, err := p.GetSticker(id)
+	if err != nil {
+		return nil, err
+	}
+	if sticker.IsTrashed() {
+		return nil, fmt.Errorf("sticker not found")
+	}
+	return sticker, nil
+}
+
+// TrashSticker moves a sticker to the trash. It disappears from listings,
+// search and its packs and frees its name, but keeps its images so that
+// existing posts still render until it is purged.
+func (p *Plugin) TrashSticker(id, userID string) (*Sticker, error) {
+	packs, err := p.GetAllPacks(nil)
+	if err != nil {
+		return nil, err
+	}
+	var packIDs []string
+	for _, pack := range packs.Packs {
+		if pack.HasSticker(id) {
+			packIDs = append(packIDs, pack.ID)
+		}
+	}
+
+	sticker, err := p.EditSticker(id, userID, versionActionTrash, func(sticker *Sticker) error {
+		if sticker.IsTrashed() {
+			return ErrStickerTrashed
+		}
+		sticker.DeletedAt = time.Now().UnixMilli()
+		sticker.DeletedBy = userID
+		sticker.TrashedPackIDs = packIDs
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.addToIndex(trashKey, id); err != nil {
+		return nil, err
+	}
+	err = p.removeStickerFromIndex(id)
+	p.notifyStickerChanged(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.RemoveStickerFromPacks(id); err != nil {
+		p.API.LogWarn("Failed to remove sticker from packs", "sticker_id", id, "error", err.Error())
+	}
+
+	return sticker, nil
+}
+
+// RestoreSticker takes a sticker out of the trash, renamed to name if it is
+// not empty, and puts it back in the packs it was in. Aliases taken by other
+// stickers in the meantime are dropped. The restore is never held for
+// review, since holding a rename back would restore the sticker under a name
+// that is now taken.
+func (p *Plugin) RestoreSticker(id, userID, name string) (*Sticker, error) {
+	var packIDs []string
+	sticker, err := p.editSticker(id, userID, versionActionRestore, false, func(sticker *Sticker) error {
+		if !sticker.IsTrashed() {
+			return ErrStickerNotTrashed
+		}
+
+		if name != "" {
+			if err := checkStickerName(name); err != nil {
+				return err
+			}
+			sticker.Name = name
+		}
+		if p.isStickerNameTakenBy(sticker.Name, sticker.ID) {
+			return ErrRestoreNameTaken
+		}
+
+		aliases := make([]string, 0, len(sticker.Aliases))
+		for _, alias := range sticker.Aliases {
+			if alias != normalizeName(sticker.Name) && !p.isStickerNameTakenBy(alias, sticker.ID) {
+				aliases = append(aliases, alias)
+			}
+		}
+		sticker.Aliases = aliases
+
+		packIDs = sticker.TrashedPackIDs
+		sticker.DeletedAt = 0
+		sticker.DeletedBy = ""
+		sticker.TrashedPackIDs = nil
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := p.addStickerToIndex(id); err != nil {
+		return nil, err
+	}
+	err = p.removeFromIndex(trashKey, id)
+	p.notifyStickerChanged(id)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, packID := range packIDs {
+		if _, err := p.UpdatePack(packID, func(pack *StickerPack) error {
+			if !pack.HasSticker(id) {
+				pack.StickerIDs = append(pack.StickerIDs, id)
+			}
+			return nil
+		}); err != nil {
+			// The pack may have been deleted while the sticker was in the trash
+			p.API.LogDebug("Failed to return restored sticker to pack", "sticker_id", id, "pack_id", packID, "error", err.Error())
+		}
+	}
+
+	return sticker, nil
+}
+
+// PurgeSticker permanently deletes a sticker that is in the trash
+func (p *Plugin) PurgeSticker(id string) error {
+	sticker, err := p.GetSticker(id)
+	if err != nil {
+		return err
+	}
+	if !sticker.IsTrashed() {
+		return ErrStickerNotTrashed
+	}
+
+	return p.DeleteSticker(id)
+}
+
+// GetTrashedStickers returns the stickers in the trash that the user created,
+// deleted or may delete, most recently deleted first
+func (p *Plugin) GetTrashedStickers(userID string) (*TrashList, error) {
+	ids, err := p.getIndex(trashKey)
+	if err != nil {
+		return nil, err
+	}
+
+	stickers := make([]*Sticker, 0, len(ids))
+	for _, id := range ids {
+		sticker, err := p.GetSticker(id)
+		if err != nil || !sticker.IsTrashed() {
+			continue
+		}
+		if sticker.DeletedBy != userID && p.Authorize(userID, ActionDelete, stickerTarget(sticker)) != nil {
+			continue
+		}
+		stickers = append(stickers, sticker)
+	}
+
+	sort.SliceStable(stickers, func(i, j int) bool {
+		return stickers[i].DeletedAt > stickers[j].DeletedAt
+	})
+
+	return &TrashList{
+		Stickers:      stickers,
+		Total:         len(stickers),
+		RetentionDays: p.getTrashRetentionDays(),
+	}, nil
+}
+
+// PurgeExpiredTrash permanently deletes the stickers that have been in the
+// trash for longer than the retention period and returns how many it deleted
+func (p *Plugin) PurgeExpiredTrash() (int, error) {
+	ids, err := p.getIndex(trashKey)
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := time.Now().AddDate(0, 0, -p.getTrashRetentionDays()).UnixMilli()
+	purged := 0
+	for _, id := range ids {
+		sticker, err := p.GetSticker(id)
+		if err != nil || !sticker.IsTrashed() || sticker.DeletedAt > cutoff {
+			continue
+		}
+		if err := p.DeleteSticker(id); err != nil {
+			p.API.LogWarn("Failed to purge sticker from the trash", "sticker_id", id, "error", err.Error())
+			continue
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// runTrashPurge is the scheduled job callback. It runs on a single node at a
+// time thanks to the cluster job scheduler.
+func (p *Plugin) runTrashPurge() {
+	purged, err := p.PurgeExpiredTrash()
+	if err != nil {
+		p.API.LogError("Sticker trash purge failed", "error", err.Error())
+		return
+	}
+
+	if purged > 0 {
+		p.API.LogInfo("Purged expired stickers from the trash", "purged", purged)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// usageKey holds the usage counts of all stickers. It is kept apart
+	// from the sticker records so that sending a sticker neither rewrites
+	// its record nor invalidates it in every node's cache.
+	usageKey = "usage_counts"
+
+	// Sends are counted in memory and written to usageKey in batches, and
+	// the counts written by other nodes are reloaded as often
+	usageFlushInterval   = 30 * time.Second
+	usageRefreshInterval = 30 * time.Second
+)
+
+// stickerUsage is how often and when a sticker was last sent, on top of the
+// UsageCount and LastUsedAt its record kept from before usage moved here
+type stickerUsage struct {
+	Count      int64 `json:"count"`
+	LastUsedAt int64 `json:"last_used_at"`
+}
+
+func (u stickerUsage) add(other stickerUsage) stickerUsage {
+	return stickerUsage{
+		Count:      u.Count + other.Count,
+		LastUsedAt: max(u.LastUsedAt, other.LastUsedAt),
+	}
+}
+
+// usageTracker counts sends on this node until they are flushed, and caches
+// the stored counts
+type usageTracker struct {
+	mu       sync.Mutex
+	pending  map[string]stickerUsage
+	stored   map[string]stickerUsage
+	loadedAt time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{pending: map[string]stickerUsage{}}
+}
+
+// RecordStickerUsage counts a send of the sticker at the given time
+func (p *Plugin) RecordStickerUsage(id string, at int64) {
+	t := p.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.pending[id] = t.pending[id].add(stickerUsage{Count: 1, LastUsedAt: at})
+}
+
+// startUsageFlusher writes the counted sends every usageFlushInterval until
+// stopUsageFlusher is called
+func (p *Plugin) startUsageFlusher() {
+	t := p.usage
+	t.stop = make(chan struct{})
+	t.done = make(chan struct{})
+
+	go func() {
+		defer close(t.done)
+
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.flushStickerUsage()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopUsageFlusher stops the background flush and writes what is left
+func (p *Plugin) stopUsageFlusher() {
+	t := p.usage
+	if t.stop == nil {
+		return
+	}
+	close(t.stop)
+	<-t.done
+	t.stop = nil
+
+	p.flushStickerUsage()
+}
+
+// flushStickerUsage adds the sends counted on this node to usageKey. Counts
+// that cannot be written are kept for the next flush.
+func (p *Plugin) flushStickerUsage() {
+	t := p.usage
+	t.mu.Lock()
+	pending := t.pending
+	t.pending = map[string]stickerUsage{}
+	t.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	var stored map[string]stickerUsage
+	err := p.compareAndSetWithRetry(usageKey, func(oldData []byte) ([]byte, bool, error) {
+		counts, err := usageFromJSON(oldData)
+		if err != nil {
+			return nil, false, err
+		}
+		for id, usage := range pending {
+			counts[id] = counts[id].add(usage)
+		}
+
+		newData, err := json.Marshal(counts)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal usage counts: %w", err)
+		}
+		stored = counts
+		return newData, true, nil
+	})
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil {
+		p.API.LogWarn("Failed to record sticker usage", "error", err.Error())
+		for id, usage := range pending {
+			t.pending[id] = t.pending[id].add(usage)
+		}
+		return
+	}
+
+	t.stored = stored
+	t.loadedAt = time.Now()
+}
+
+// forgetStickerUsage drops the usage of a permanently deleted sticker
+func (p *Plugin) forgetStickerUsage(id string) {
+	t := p.usage
+	t.mu.Lock()
+	delete(t.pending, id)
+	t.mu.Unlock()
+
+	if err := p.compareAndSetWithRetry(usageKey, func(oldData []byte) ([]byte, bool, error) {
+		counts, err := usageFromJSON(oldData)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, ok := counts[id]; !ok {
+			return nil, false, nil
+		}
+		delete(counts, id)
+
+		newData, err := json.Marshal(counts)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to marshal usage counts: %w", err)
+		}
+		return newData, true, nil
+	}); err != nil {
+		p.API.LogWarn("Failed to delete sticker usage", "sticker_id", id, "error", err.Error())
+	}
+}
+
+func usageFromJSON(data []byte) (map[string]stickerUsage, error) {
+	counts := map[string]stickerUsage{}
+	if data == nil {
+		return counts, nil
+	}
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal usage counts: %w", err)
+	}
+	return counts, nil
+}
+
+// refreshStoredUsage reloads the stored usage when it is older than
+// usageRefreshInterval. The KV store is read without the tracker's lock, so
+// that sends are never counted behind the read.
+func (p *Plugin) refreshStoredUsage() {
+	t := p.usage
+	t.mu.Lock()
+	loadedAt := t.loadedAt
+	t.mu.Unlock()
+
+	if time.Since(loadedAt) <= usageRefreshInterval {
+		return
+	}
+
+	data, appErr := p.API.KVGet(usageKey)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get sticker usage", "error", appErr.Error())
+		return
+	}
+	counts, err := usageFromJSON(data)
+	if err != nil {
+		p.API.LogWarn("Failed to read sticker usage", "error", err.Error())
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// A flush or another refresh in the meantime stored newer counts
+	if !t.loadedAt.Equal(loadedAt) {
+		return
+	}
+	t.stored = counts
+	t.loadedAt = time.Now()
+}
+
+// stickerUsageCounts returns the stored usage together with the sends not
+// yet flushed
+func (p *Plugin) stickerUsageCounts() map[string]stickerUsage {
+	p.refreshStoredUsage()
+
+	t := p.usage
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	counts := make(map[string]stickerUsage, len(t.stored)+len(t.pending))
+	for id, usage := range t.stored {
+		counts[id] = usage
+	}
+	for id, usage := range t.pending {
+		counts[id] = counts[id].add(usage)
+	}
+	return counts
+}
+
+// applyStickerUsage returns a copy of the sticker with its current usage
+func (p *Plugin) applyStickerUsage(sticker *Sticker) *Sticker {
+	p.refreshStoredUsage()
+
+	t := p.usage
+	t.mu.Lock()
+	usage, ok := t.stored[sticker.ID]
+	if pending, found := t.pending[sticker.ID]; found {
+		usage = usage.add(pending)
+		ok = true
+	}
+	t.mu.Unlock()
+
+	if !ok {
+		return sticker
+	}
+	return stickerWithUsage(sticker, map[string]stickerUsage{sticker.ID: usage})
+}
+
+// withUsage returns copies of the stickers with their current usage. The
+// records themselves are never changed, since the cache shares them.
+func withUsage(stickers []*Sticker, counts map[string]stickerUsage) []*Sticker {
+	result := make([]*Sticker, len(stickers))
+	for i, sticker := range stickers {
+		result[i] = stickerWithUsage(sticker, counts)
+	}
+	return result
+}
+
+func stickerWithUsage(sticker *Sticker, counts map[string]stickerUsage) *Sticker {
+	usage, ok := counts[sticker.ID]
+	if !ok {
+		return sticker
+	}
+
+	s := *sticker
+	s.UsageCount += usage.Count
+	s.LastUsedAt = max(s.LastUsedAt, usage.LastUsedAt)
+	return &s
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// slowUsageAPI holds reads of usageKey until released
+type slowUsageAPI struct {
+	*fakeAPI
+
+	reading chan struct{}
+	release chan struct{}
+}
+
+func (s *slowUsageAPI) KVGet(key string) ([]byte, *model.AppError) {
+	if key == usageKey {
+		close(s.reading)
+		<-s.release
+	}
+	return s.fakeAPI.KVGet(key)
+}
+
+func TestStickerUsageIsKeptApartFromRecords(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{})
+
+	sticker := NewSticker("wave", "", "wave.png", "creator")
+	// Counted before usage moved to its own key
+	sticker.UsageCount = 2
+	saveTestSticker(t, p, sticker)
+	record := string(api.kv[stickerKeyPrefix+sticker.ID])
+
+	p.RecordStickerUsage(sticker.ID, 100)
+	p.RecordStickerUsage(sticker.ID, 300)
+
+	got, err := p.GetSticker(sticker.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UsageCount != 4 || got.LastUsedAt != 300 {
+		t.Errorf("before flush: usage %d at %d, want 4 at 300", got.UsageCount, got.LastUsedAt)
+	}
+
+	p.flushStickerUsage()
+	if string(api.kv[stickerKeyPrefix+sticker.ID]) != record {
+		t.Error("sending a sticker rewrote its record")
+	}
+
+	// Another node sees the flushed counts once it reloads them
+	other := newTestPlugin(api, &configuration{})
+	list, err := other.GetAllStickers(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Stickers) != 1 || list.Stickers[0].UsageCount != 4 {
+		t.Fatalf("other node sees %+v", list.Stickers)
+	}
+
+	p.forgetStickerUsage(sticker.ID)
+	if counts, _ := usageFromJSON(api.kv[usageKey]); len(counts) != 0 {
+		t.Errorf("usage of a deleted sticker kept: %v", counts)
+	}
+}
+
+func TestRecordingUsageDoesNotWaitForRefresh(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{})
+	slow := &slowUsageAPI{fakeAPI: api, reading: make(chan struct{}), release: make(chan struct{})}
+	p.SetAPI(slow)
+
+	refreshed := make(chan map[string]stickerUsage)
+	go func() { refreshed <- p.stickerUsageCounts() }()
+	<-slow.reading
+
+	recorded := make(chan struct{})
+	go func() {
+		p.RecordStickerUsage("wave", 100)
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		t.Fatal("recording a send waited for the usage read")
+	}
+
+	close(slow.release)
+	if counts := <-refreshed; counts["wave"].Count != 1 {
+		t.Errorf("counts %v, want the pending send", counts)
+	}
+}
+
+func TestQueryStickersPaging(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{})
+	for _, name := range []string{"a", "b", "c"} {
+		saveTestSticker(t, p, NewSticker(name, "", name+".png", "creator"))
+	}
+
+	tests := []struct {
+		name    string
+		page    int
+		perPage int
+		want    []string
+	}{
+		{name: "first page", page: 0, perPage: 2, want: []string{"a", "b"}},
+		{name: "last page", page: 1, perPage: 2, want: []string{"c"}},
+		{name: "past the end", page: 5, perPage: 2, want: []string{}},
+		{name: "overflowing page", page: math.MaxInt / 2, perPage: 200, want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := p.QueryStickers(&StickerQuery{SortBy: sortByName, Page: tt.page, PerPage: tt.perPage})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			names := []string{}
+			for _, s := range list.Stickers {
+				names = append(names, s.Name)
+			}
+			if len(names) != len(tt.want) {
+				t.Fatalf("got %v, want %v", names, tt.want)
+			}
+			for i := range names {
+				if names[i] != tt.want[i] {
+					t.Fatalf("got %v, want %v", names, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryStickersByPackHidesUnseenPacks(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{})
+
+	sticker := NewSticker("wave", "", "wave.png", "creator")
+	saveTestSticker(t, p, sticker)
+
+	pack := NewStickerPack("team greetings", "", "creator")
+	pack.Scope = Scope{Type: ScopeTeam, ID: "team1"}
+	pack.StickerIDs = []string{sticker.ID}
+	if err := p.SavePack(pack); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		viewer *Viewer
+		want   int
+	}{
+		{name: "team member", viewer: &Viewer{UserID: "member", TeamID: "team1"}, want: 1},
+		{name: "outsider", viewer: &Viewer{UserID: "outsider", TeamID: "team2"}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := p.QueryStickers(&StickerQuery{Viewer: tt.viewer, PackID: pack.ID, PerPage: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list.Stickers) != tt.want {
+				t.Errorf("got %d stickers, want %d", len(list.Stickers), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+const (
+	// stickerVersionsKeyPrefix records hold the version history of a sticker.
+	// It must not start with stickerKeyPrefix, which fsck scans for stickers.
+	stickerVersionsKeyPrefix = "versions_"
+
+	// maxStickerVersions bounds the history kept per sticker; the oldest
+	// versions are dropped first
+	maxStickerVersions = 100
+)
+
+// Actions recorded in the version history
+const (
+	versionActionInitial      = "initial"
+	versionActionCreate       = "create"
+	versionActionUpdate       = "update"
+	versionActionReplaceImage = "replace_image"
+	versionActionRollback     = "rollback"
+	versionActionTrash        = "trash"
+	versionActionRestore      = "restore"
+	versionActionApprove      = "approve"
+)
+
+var (
+	// ErrVersionNotFound is returned when rolling back to a version that is
+	// not in a sticker's history
+	ErrVersionNotFound = errors.New("version not found")
+
+	// ErrCannotRollback is returned when a version cannot be restored, such
+	// as when its name has since been taken by another sticker
+	ErrCannotRollback = errors.New("cannot roll back")
+)
+
+// StickerSnapshot is the editable state of a sticker at one version
+type StickerSnapshot struct {
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Tags        []string     `json:"tags"`
+	Aliases     []string     `json:"aliases"`
+	Scope       Scope        `json:"scope"`
+	Visibility  string       `json:"visibility,omitempty"`
+	Image       StickerImage `json:"image"`
+	Trashed     bool         `json:"trashed,omitempty"`
+}
+
+// StickerVersion records one change to a sticker: who made it, when, which
+// fields it changed and the sticker as it was afterwards. The history of a
+// sticker created before versions were recorded starts with an "initial"
+// version holding the sticker as it was before its first recorded change.
+type StickerVersion struct {
+	Version   int      `json:"version"`
+	Action    string   `json:"action"`
+	UserID    string   `json:"user_id,omitempty"`
+	CreatedAt int64    `json:"created_at"`
+	Changes   []string `json:"changes"`
+	// PreviousFilename is the image the sticker showed before this version
+	// when the version changed the image
+	PreviousFilename string          `json:"previous_filename,omitempty"`
+	Sticker          StickerSnapshot `json:"sticker"`
+}
+
+// StickerVersionList is the version history of a sticker, oldest first
+type StickerVersionList struct {
+	StickerID string            `json:"sticker_id"`
+	Versions  []*StickerVersion `json:"versions"`
+	Total     int               `json:"total"`
+}
+
+func snapshotSticker(sticker *Sticker) StickerSnapshot {
+	return StickerSnapshot{
+		Name:        sticker.Name,
+		Description: sticker.Description,
+		Tags:        slices.Clone(sticker.Tags),
+		Aliases:     slices.Clone(sticker.Aliases),
+		Scope:       sticker.Scope,
+		Visibility:  sticker.Visibility,
+		Image:       sticker.StickerImage,
+		Trashed:     sticker.IsTrashed(),
+	}
+}
+
+// changedFields lists the fields that differ between two snapshots
+func changedFields(before, after StickerSnapshot) []string {
+	var changes []string
+	if before.Name != after.Name {
+		changes = append(changes, "name")
+	}
+	if before.Description != after.Description {
+		changes = append(changes, "description")
+	}
+	if !slices.Equal(before.Tags, after.Tags) {
+		changes = append(changes, "tags")
+	}
+	if !slices.Equal(before.Aliases, after.Aliases) {
+		changes = append(changes, "aliases")
+	}
+	if before.Scope != after.Scope {
+		changes = append(changes, "scope")
+	}
+	if before.Visibility != after.Visibility {
+		changes = append(changes, "visibility")
+	}
+	if before.Image.Filename != after.Image.Filename {
+		changes = append(changes, "image")
+	}
+	if before.Trashed != after.Trashed {
+		changes = append(changes, "trashed")
+	}
+	return changes
+}
+
+// GetStickerVersions returns the recorded history of a sticker
+func (p *Plugin) GetStickerVersions(id string) ([]*StickerVersion, error) {
+	data, appErr := p.API.KVGet(stickerVersionsKeyPrefix + id)
+	if appErr != nil {
+		return nil, fmt.Errorf("failed to get sticker versions: %w", appErr)
+	}
+	if data == nil {
+		return []*StickerVersion{}, nil
+	}
+
+	var versions []*StickerVersion
+	if err := json.Unmarshal(data, &versions); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sticker versions: %w", err)
+	}
+	return versions, nil
+}
+
+// recordStickerVersion appends a version to a sticker's history and returns
+// the versions kept. before is the state ahead of the change and is recorded
+// as the initial version when the sticker has no history yet.
+func (p *Plugin) recordStickerVersion(id string, version *StickerVersion, before *StickerSnapshot) ([]*StickerVersion, error) {
+	var kept []*StickerVersion
+	err := p.compareAndSetWithRetry(stickerVersionsKeyPrefix+id, func(oldData []byte) ([]byte, bool, error) {
+		var versions []*StickerVersion
+		if oldData != nil {
+			if err := json.Unmarshal(oldData, &versions); err != nil {
+				return nil, false, fmt.Errorf("failed to unmarshal sticker versions: %w", err)
+			}
+		}
+
+		if len(versions) == 0 && before != nil {
+			versions = append(versions, &StickerVersion{
+				Version: 1,
+				Action:  versionActionInitial,
+				Changes: []string{},
+				Sticker: *before,
+			})
+		}
+
+		next := *version
+		next.Version = 1
+		if len(versions) > 0 {
+			next.Version = versions[len(versions)-1].Version + 1
+		}
+		versions = append(versions, &next)
+
+		if len(versions) > maxStickerVersions {
+			versions = versions[len(versions)-maxStickerVersions:]
+		}
+
+		kept = versions
+		newData, err := json.Marshal(versions)
+		return newData, true, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kept, nil
+}
+
+// recordStickerCreated starts the history of a new sticker
+func (p *Plugin) recordStickerCreated(sticker *Sticker) {
+	version := &StickerVersion{
+		Action:    versionActionCreate,
+		UserID:    sticker.CreatorID,
+		CreatedAt: sticker.CreatedAt,
+		Changes:   []string{},
+		Sticker:   snapshotSticker(sticker),
+	}
+	if _, err := p.recordStickerVersion(sticker.ID, version, nil); err != nil {
+		p.API.LogWarn("Failed to record sticker version", "sticker_id", sticker.ID, "error", err.Error())
+	}
+}
+
+// EditSticker applies a user's change to a sticker like UpdateSticker and
+// records it in the sticker's history if it changed anything. Every edit
+// except usage bookkeeping goes through here. In moderated mode, changes to
+// what others see of an approved sticker are held as its pending revision
+// unless the user is a moderator.
+func (p *Plugin) EditSticker(id, userID, action string, mutate func(sticker *Sticker) error) (*Sticker, error) {
+	return p.editSticker(id, userID, action, p.needsReview(userID), mutate)
+}
+
+// editSticker is EditSticker with the choice of holding the change for
+// review left to the caller
+func (p *Plugin) editSticker(id, userID, action string, review bool, mutate func(sticker *Sticker) error) (*Sticker, error) {
+	var before StickerSnapshot
+	var started bool
+	var released, withdrawn []string
+	sticker, err := p.UpdateSticker(id, func(sticker *Sticker) error {
+		before = snapshotSticker(sticker)
+		started, released, withdrawn = false, nil, nil
+		if !review || !sticker.IsApproved() {
+			return mutate(sticker)
+		}
+
+		// The edit builds on the revision already awaiting approval
+		edited := sticker.withPendingRevision()
+		if err := mutate(edited); err != nil {
+			return err
+		}
+		started, released = holdForReview(edited, sticker, userID)
+		if sticker.PendingRevision != nil && edited.PendingRevision == nil {
+			withdrawn = edited.ModerationPostIDs
+			edited.ModerationPostIDs = nil
+		}
+		*sticker = *edited
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if started {
+		p.notifyModerators(sticker, "changed")
+	}
+	p.closeModerationPosts(withdrawn, ":leftwards_arrow_with_hook: The change was undone.")
+	if err := p.ReleaseImages(released); err != nil {
+		p.API.LogWarn("Failed to delete images of an undone revision", "sticker_id", id, "error", err.Error())
+	}
+
+	after := snapshotSticker(sticker)
+	changes := changedFields(before, after)
+	if len(changes) == 0 {
+		return sticker, nil
+	}
+
+	version := &StickerVersion{
+		Action:    action,
+		UserID:    userID,
+		CreatedAt: time.Now().UnixMilli(),
+		Changes:   changes,
+		Sticker:   after,
+	}
+	if before.Image.Filename != after.Image.Filename {
+		version.PreviousFilename = before.Image.Filename
+	}
+
+	// The change itself is already saved, so a lost history entry is only
+	// logged
+	versions, err := p.recordStickerVersion(id, version, &before)
+	if err != nil {
+		p.API.LogWarn("Failed to record sticker version", "sticker_id", id, "error", err.Error())
+		return sticker, nil
+	}
+
+	// Old versions are only dropped once the history is full
+	if len(versions) >= maxStickerVersions {
+		if pruned := p.prunePreviousImages(sticker, versions); pruned != nil {
+			sticker = pruned
+		}
+	}
+	return sticker, nil
+}
+
+// prunePreviousImages drops the previous images that no kept version shows,
+// since nothing can be rolled back to them any more, and releases them. It
+// returns the updated sticker, or nil when nothing was dropped.
+func (p *Plugin) prunePreviousImages(sticker *Sticker, versions []*StickerVersion) *Sticker {
+	shown := make(map[string]bool, len(versions))
+	for _, v := range versions {
+		shown[v.Sticker.Image.Filename] = true
+	}
+	unused := func(previous PreviousImage) bool {
+		return !shown[previous.Filename]
+	}
+	// A pending revision may still show or keep any of them
+	if sticker.PendingRevision != nil || !slices.ContainsFunc(sticker.PreviousImages, unused) {
+		return nil
+	}
+
+	var dropped []string
+	updated, err := p.UpdateSticker(sticker.ID, func(s *Sticker) error {
+		dropped = nil
+		if s.PendingRevision != nil {
+			return nil
+		}
+		for _, previous := range s.PreviousImages {
+			if unused(previous) {
+				dropped = append(dropped, previous.Keys()...)
+			}
+		}
+		s.PreviousImages = slices.DeleteFunc(s.PreviousImages, unused)
+		return nil
+	})
+	if err != nil {
+		p.API.LogWarn("Failed to prune previous sticker images", "sticker_id", sticker.ID, "error", err.Error())
+		return nil
+	}
+
+	if err := p.ReleaseImages(dropped); err != nil {
+		p.API.LogWarn("Failed to delete previous sticker images", "sticker_id", sticker.ID, "error", err.Error())
+	}
+	return updated
+}
+
+// RollbackSticker restores a sticker to the state of one of its versions,
+// recording the rollback as a new version. The image is restored from the
+// sticker's previous images and the current one is kept in its place, so
+// the rollback can itself be undone.
+func (p *Plugin) RollbackSticker(id, userID string, version int) (*Sticker, error) {
+	versions, err := p.GetStickerVersions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var target *StickerVersion
+	for _, v := range versions {
+		if v.Version == version {
+			target = v
+			break
+		}
+	}
+	if target == nil {
+		return nil, ErrVersionNotFound
+	}
+
+	// Restoring an old scope moves the sticker, which needs the same
+	// permission as creating it there
+	current, err := p.GetLiveSticker(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.AuthorizeScopeChange(userID, current.Scope, target.Sticker.Scope); err != nil {
+		return nil, err
+	}
+
+	// Visibility is left as it is, since a published sticker cannot be made
+	// private again
+	snapshot := target.Sticker
+	req := &stickerRequest{
+		Name:        &snapshot.Name,
+		Description: &snapshot.Description,
+		Tags:        &snapshot.Tags,
+		Aliases:     &snapshot.Aliases,
+		Scope:       &snapshot.Scope,
+	}
+
+	return p.EditSticker(id, userID, versionActionRollback, func(sticker *Sticker) error {
+		if err := p.applyStickerRequest(sticker, req); err != nil {
+			return fmt.Errorf("%w: %w", ErrCannotRollback, err)
+		}
+
+		if snapshot.Image.Filename == sticker.Filename {
+			return nil
+		}
+
+		restored := snapshot.Image
+		if restored.Filename != "" {
+			// Each stored image holds one reference, so it moves out of the
+			// previous images rather than being shared with them
+			i := slices.IndexFunc(sticker.PreviousImages, func(previous PreviousImage) bool {
+				return previous.Filename == restored.Filename
+			})
+			if i < 0 {
+				return fmt.Errorf("%w: the image of version %d is no longer stored", ErrCannotRollback, version)
+			}
+			restored = sticker.PreviousImages[i].StickerImage
+			sticker.PreviousImages = slices.Delete(sticker.PreviousImages, i, i+1)
+		}
+
+		if sticker.Filename != "" {
+			sticker.PreviousImages = append(sticker.PreviousImages, PreviousImage{
+				StickerImage: sticker.StickerImage,
+				ReplacedAt:   time.Now().UnixMilli(),
+				ReplacedBy:   userID,
+			})
+		}
+		sticker.StickerImage = restored
+		return nil
+	})
+}
+
+// deleteStickerVersions removes the history of a deleted sticker
+func (p *Plugin) deleteStickerVersions(id string) error {
+	if appErr := p.API.KVDelete(stickerVersionsKeyPrefix + id); appErr != nil {
+		return fmt.Errorf("failed to delete sticker versions: %w", appErr)
+	}
+	return nil
+}
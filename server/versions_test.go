@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreviousImagesArePrunedWithTheirVersions(t *testing.T) {
+	dir := t.TempDir()
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{StickerStoragePath: dir})
+
+	storeImage := func(i int) *StickerImage {
+		key, err := p.StoreImage([]byte(fmt.Sprintf("image %d", i)), "sticker.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &StickerImage{Filename: key, Format: "png"}
+	}
+
+	sticker := NewSticker("wave", "", "", "creator")
+	sticker.StickerImage = *storeImage(0)
+	saveTestSticker(t, p, sticker)
+	first := sticker.Filename
+
+	// One more replacement than the history holds, so the version showing
+	// the first image is dropped
+	var err error
+	for i := 1; i <= maxStickerVersions; i++ {
+		sticker, err = p.ReplaceStickerImage(sticker.ID, "creator", storeImage(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := p.GetStickerVersions(sticker.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != maxStickerVersions {
+		t.Fatalf("%d versions kept, want %d", len(versions), maxStickerVersions)
+	}
+
+	if len(sticker.PreviousImages) != maxStickerVersions-1 {
+		t.Errorf("%d previous images kept, want %d", len(sticker.PreviousImages), maxStickerVersions-1)
+	}
+	for _, previous := range sticker.PreviousImages {
+		if previous.Filename == first {
+			t.Error("image of a dropped version kept")
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, first)); !os.IsNotExist(err) {
+		t.Errorf("image of a dropped version still stored: %v", err)
+	}
+}
+
+func TestTrashAndRestoreAreRecorded(t *testing.T) {
+	api := newFakeAPI()
+	p := newTestPlugin(api, &configuration{})
+
+	sticker := NewSticker("wave", "", "wave.png", "creator")
+	saveTestSticker(t, p, sticker)
+
+	if _, err := p.TrashSticker(sticker.ID, "creator"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.RestoreSticker(sticker.ID, "creator", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := p.GetStickerVersions(sticker.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) < 2 {
+		t.Fatalf("recorded %d versions", len(versions))
+	}
+	trashed, restored := versions[len(versions)-2], versions[len(versions)-1]
+	if trashed.Action != versionActionTrash || !trashed.Sticker.Trashed {
+		t.Errorf("trash recorded as %s, trashed %v", trashed.Action, trashed.Sticker.Trashed)
+	}
+	if restored.Action != versionActionRestore || restored.Sticker.Trashed {
+		t.Errorf("restore recorded as %s, trashed %v", restored.Action, restored.Sticker.Trashed)
+	}
+}
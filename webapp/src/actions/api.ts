@@ -1,4 +1,17 @@
-import { Sticker, StickerList } from '../types';
+import {
+    DuplicatePolicy,
+    PendingList,
+    Scope,
+    Visibility,
+    Sticker,
+    StickerList,
+    StickerPatch,
+    StickerPack,
+    StickerPackList,
+    StickerPackWithStickers,
+    StickerVersionList,
+    TrashList,
+} from '../types';
 
 const PLUGIN_ID = 'com.example.sticker';
 
@@ -112,6 +125,36 @@ export const doPost = async <T>(url: string, body?: any): Promise<T> => {
     return response.json();
 };
 
+export const doPut = async <T>(url: string, body: any): Promise<T> => {
+    const response = await fetch(url, getOptions({
+        method: 'PUT',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body),
+    }));
+
+    if (!response.ok) {
+        const error = await response.text();
+        throw new Error(error || `Request failed: ${response.status}`);
+    }
+
+    return response.json();
+};
+
+export const doPatch = async <T>(url: string, body: any): Promise<T> => {
+    const response = await fetch(url, getOptions({
+        method: 'PATCH',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify(body),
+    }));
+
+    if (!response.ok) {
+        const error = await response.text();
+        throw new Error(error || `Request failed: ${response.status}`);
+    }
+
+    return response.json();
+};
+
 export const doDelete = async (url: string): Promise<void> => {
     const response = await fetch(url, getOptions({
         method: 'DELETE',
@@ -123,18 +166,37 @@ export const doDelete = async (url: string): Promise<void> => {
     }
 };
 
-export const getStickers = async (): Promise<StickerList> => {
-    return doGet(`${getPluginServerRoute()}/api/v1/stickers`);
+// Team- and channel-scoped stickers are only listed when the channel they
+// are viewed from is passed
+export const getStickers = async (channelId?: string): Promise<StickerList> => {
+    const params = channelId ? `?channel_id=${encodeURIComponent(channelId)}` : '';
+    return doGet(`${getPluginServerRoute()}/api/v1/stickers${params}`);
 };
 
-export const searchStickers = async (query: string): Promise<StickerList> => {
-    return doGet(`${getPluginServerRoute()}/api/v1/stickers/search?q=${encodeURIComponent(query)}`);
+export const searchStickers = async (query: string, channelId?: string): Promise<StickerList> => {
+    const params = channelId ? `&channel_id=${encodeURIComponent(channelId)}` : '';
+    return doGet(`${getPluginServerRoute()}/api/v1/stickers/search?q=${encodeURIComponent(query)}${params}`);
+};
+
+const appendScope = (formData: FormData, scope?: Scope, visibility?: Visibility) => {
+    if (scope) {
+        formData.append('scope', scope.type);
+        if (scope.id) {
+            formData.append('scope_id', scope.id);
+        }
+    }
+    if (visibility) {
+        formData.append('visibility', visibility);
+    }
 };
 
 export const uploadSticker = async (
     name: string,
     file: File,
-    channelId?: string
+    channelId?: string,
+    onDuplicate?: DuplicatePolicy,
+    scope?: Scope,
+    visibility?: Visibility
 ): Promise<Sticker> => {
     const formData = new FormData();
     formData.append('name', name);
@@ -142,22 +204,107 @@ export const uploadSticker = async (
     if (channelId) {
         formData.append('channel_id', channelId);
     }
+    if (onDuplicate) {
+        formData.append('on_duplicate', onDuplicate);
+    }
+    appendScope(formData, scope, visibility);
 
     return doPost(`${getPluginServerRoute()}/api/v1/stickers`, formData);
 };
 
+export const setStickerTags = async (id: string, tags: string[]): Promise<Sticker> => {
+    return doPut(`${getPluginServerRoute()}/api/v1/stickers/${id}/tags`, { tags });
+};
+
+export const setStickerAliases = async (id: string, aliases: string[]): Promise<Sticker> => {
+    return doPut(`${getPluginServerRoute()}/api/v1/stickers/${id}/aliases`, { aliases });
+};
+
+export const updateSticker = async (id: string, patch: StickerPatch): Promise<Sticker> => {
+    return doPatch(`${getPluginServerRoute()}/api/v1/stickers/${id}`, patch);
+};
+
+// Publishes a private sticker; a public sticker cannot be made private
+export const publishSticker = async (id: string): Promise<Sticker> => {
+    return updateSticker(id, { visibility: 'public' });
+};
+
+export const replaceStickerImage = async (id: string, file: File): Promise<Sticker> => {
+    const formData = new FormData();
+    formData.append('image', file);
+
+    const response = await fetch(`${getPluginServerRoute()}/api/v1/stickers/${id}/image`, getOptions({
+        method: 'PUT',
+        body: formData,
+    }));
+
+    if (!response.ok) {
+        const error = await response.text();
+        throw new Error(error || `Request failed: ${response.status}`);
+    }
+
+    return response.json();
+};
+
+export const getStickerVersions = async (id: string): Promise<StickerVersionList> => {
+    return doGet(`${getPluginServerRoute()}/api/v1/stickers/${id}/versions`);
+};
+
+export const rollbackSticker = async (id: string, version: number): Promise<Sticker> => {
+    return doPost(`${getPluginServerRoute()}/api/v1/stickers/${id}/versions/${version}/rollback`);
+};
+
 export const deleteSticker = async (id: string): Promise<void> => {
     return doDelete(`${getPluginServerRoute()}/api/v1/stickers/${id}`);
 };
 
+export const getTrash = async (): Promise<TrashList> => {
+    return doGet(`${getPluginServerRoute()}/api/v1/stickers/trash`);
+};
+
+export const restoreSticker = async (id: string, name?: string): Promise<Sticker> => {
+    return doPost(`${getPluginServerRoute()}/api/v1/stickers/trash/${id}/restore`, name ? { name } : undefined);
+};
+
+export const purgeSticker = async (id: string): Promise<void> => {
+    return doDelete(`${getPluginServerRoute()}/api/v1/stickers/trash/${id}`);
+};
+
+// Moderators get every pending sticker, other users their own uploads
+export const getPendingStickers = async (): Promise<PendingList> => {
+    return doGet(`${getPluginServerRoute()}/api/v1/stickers/pending`);
+};
+
+export const approveSticker = async (id: string): Promise<Sticker> => {
+    return doPost(`${getPluginServerRoute()}/api/v1/stickers/${id}/approve`);
+};
+
+// Rejecting deletes the sticker, so the response has no body
+export const rejectSticker = async (id: string, reason?: string): Promise<void> => {
+    const response = await fetch(`${getPluginServerRoute()}/api/v1/stickers/${id}/reject`, getOptions({
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ reason }),
+    }));
+
+    if (!response.ok) {
+        const error = await response.text();
+        throw new Error(error || `Request failed: ${response.status}`);
+    }
+};
+
 export interface BulkUploadResult {
     success: string[];
     failed: Record<string, string>;
+    warnings?: Record<string, string>;
 }
 
 export const bulkUploadStickers = async (
     files: FileList,
-    channelId?: string
+    channelId?: string,
+    onDuplicate?: DuplicatePolicy,
+    scope?: Scope,
+    visibility?: Visibility
 ): Promise<BulkUploadResult> => {
     const formData = new FormData();
     for (let i = 0; i < files.length; i++) {
@@ -166,6 +313,10 @@ export const bulkUploadStickers = async (
     if (channelId) {
         formData.append('channel_id', channelId);
     }
+    if (onDuplicate) {
+        formData.append('on_duplicate', onDuplicate);
+    }
+    appendScope(formData, scope, visibility);
 
     return doPost(`${getPluginServerRoute()}/api/v1/stickers/bulk`, formData);
 };
@@ -173,17 +324,31 @@ export const bulkUploadStickers = async (
 export const uploadStickerFromURL = async (
     name: string,
     url: string,
-    channelId?: string
+    channelId?: string,
+    onDuplicate?: DuplicatePolicy,
+    scope?: Scope,
+    visibility?: Visibility
 ): Promise<Sticker> => {
     return doPost(`${getPluginServerRoute()}/api/v1/stickers/from-url`, {
         name,
         url,
         channel_id: channelId,
+        on_duplicate: onDuplicate,
+        scope,
+        visibility,
     });
 };
 
-export const getStickerImageUrl = (stickerId: string): string => {
-    return `${getPluginServerRoute()}/api/v1/stickers/${stickerId}/image`;
+// Images are only served where the sticker is visible, so the channel they
+// are shown in is passed along. Private stickers are also shown in the posts
+// their creator sent them in, which are named by postId.
+export const getStickerImageUrl = (stickerId: string, channelId: string, postId?: string): string => {
+    const params = postId ? `&post_id=${encodeURIComponent(postId)}` : '';
+    return `${getPluginServerRoute()}/api/v1/stickers/${stickerId}/image?channel_id=${encodeURIComponent(channelId)}${params}`;
+};
+
+export const getStickerThumbnailUrl = (stickerId: string, size: number, channelId: string): string => {
+    return `${getPluginServerRoute()}/api/v1/stickers/${stickerId}/thumbnail?size=${size}&channel_id=${encodeURIComponent(channelId)}`;
 };
 
 export const getFileUrl = (fileId: string): string => {
@@ -201,3 +366,37 @@ export const sendSticker = async (
         root_id: rootId,
     });
 };
+
+export const getPacks = async (channelId?: string): Promise<StickerPackList> => {
+    const params = channelId ? `?channel_id=${encodeURIComponent(channelId)}` : '';
+    return doGet(`${getPluginServerRoute()}/api/v1/packs${params}`);
+};
+
+export const getPack = async (packId: string, channelId?: string): Promise<StickerPackWithStickers> => {
+    const params = channelId ? `?channel_id=${encodeURIComponent(channelId)}` : '';
+    return doGet(`${getPluginServerRoute()}/api/v1/packs/${packId}${params}`);
+};
+
+export const createPack = async (
+    name: string,
+    description?: string,
+    stickerIds?: string[],
+    scope?: Scope
+): Promise<StickerPack> => {
+    return doPost(`${getPluginServerRoute()}/api/v1/packs`, {
+        name,
+        description,
+        sticker_ids: stickerIds,
+        scope,
+    });
+};
+
+export const addStickerToPack = async (packId: string, stickerId: string): Promise<StickerPack> => {
+    return doPost(`${getPluginServerRoute()}/api/v1/packs/${packId}/stickers`, {
+        sticker_id: stickerId,
+    });
+};
+
+export const deletePack = async (packId: string): Promise<void> => {
+    return doDelete(`${getPluginServerRoute()}/api/v1/packs/${packId}`);
+};
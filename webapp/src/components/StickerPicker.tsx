@@ -1,6 +1,6 @@
 import React, { useState, useEffect, useCallback } from 'react';
 import { Sticker } from '../types';
-import { getStickers, searchStickers, uploadSticker, uploadStickerFromURL, deleteSticker, getStickerImageUrl, bulkUploadStickers, BulkUploadResult } from '../actions/api';
+import { getStickers, searchStickers, uploadSticker, uploadStickerFromURL, deleteSticker, getStickerThumbnailUrl, bulkUploadStickers, BulkUploadResult } from '../actions/api';
 
 interface StickerPickerProps {
     channelId: string;
@@ -33,15 +33,15 @@ const StickerPicker: React.FC<StickerPickerProps> = ({
             setLoading(true);
             setError(null);
             const result = searchQuery
-                ? await searchStickers(searchQuery)
-                : await getStickers();
+                ? await searchStickers(searchQuery, channelId)
+                : await getStickers(channelId);
             setStickers(result.stickers);
         } catch (err) {
             setError('Failed to load stickers');
         } finally {
             setLoading(false);
         }
-    }, [searchQuery]);
+    }, [searchQuery, channelId]);
 
     useEffect(() => {
         loadStickers();
@@ -79,15 +79,19 @@ const StickerPicker: React.FC<StickerPickerProps> = ({
             setUploading(true);
             setError(null);
 
+            let created: Sticker | undefined;
             if (uploadMode === 'file' && uploadFile) {
                 console.log('[Sticker] Uploading file...', uploadName, uploadFile.name);
-                await uploadSticker(uploadName.trim(), uploadFile, channelId);
+                created = await uploadSticker(uploadName.trim(), uploadFile, channelId);
             } else if (uploadMode === 'url') {
                 console.log('[Sticker] Uploading from URL...', uploadName, uploadUrl);
-                await uploadStickerFromURL(uploadName.trim(), uploadUrl.trim(), channelId);
+                created = await uploadStickerFromURL(uploadName.trim(), uploadUrl.trim(), channelId);
             }
 
             console.log('[Sticker] Upload success');
+            if (created?.status === 'pending') {
+                window.alert(`Sticker "${created.name}" was submitted and will be available once a moderator approves it.`);
+            }
             setUploadName('');
             setUploadFile(null);
             setUploadUrl('');
@@ -132,7 +136,7 @@ const StickerPicker: React.FC<StickerPickerProps> = ({
     };
 
     const handleDelete = async (sticker: Sticker) => {
-        if (!window.confirm(`Delete sticker "${sticker.name}"?`)) {
+        if (!window.confirm(`Move sticker "${sticker.name}" to the trash?`)) {
             return;
         }
 
@@ -229,6 +233,16 @@ const StickerPicker: React.FC<StickerPickerProps> = ({
                                                 Added: {bulkResult.success.join(', ')}
                                             </div>
                                         )}
+                                        {bulkResult.warnings && Object.keys(bulkResult.warnings).length > 0 && (
+                                            <div style={styles.bulkFailed}>
+                                                Possible duplicates:
+                                                {Object.entries(bulkResult.warnings).map(([file, warning]) => (
+                                                    <div key={file} style={styles.bulkFailedItem}>
+                                                        {file}: {warning}
+                                                    </div>
+                                                ))}
+                                            </div>
+                                        )}
                                         {Object.keys(bulkResult.failed).length > 0 && (
                                             <div style={styles.bulkFailed}>
                                                 Failed:
@@ -329,7 +343,7 @@ const StickerPicker: React.FC<StickerPickerProps> = ({
                                 title={sticker.name}
                             >
                                 <img
-                                    src={getStickerImageUrl(sticker.id)}
+                                    src={getStickerThumbnailUrl(sticker.id, 128, channelId)}
                                     alt={sticker.name}
                                     style={styles.stickerImage}
                                     loading="lazy"
@@ -24,7 +24,7 @@ const StickerPost: React.FC<StickerPostProps> = ({ post }) => {
         return null;
     }
 
-    const imageUrl = getStickerImageUrl(stickerId);
+    const imageUrl = getStickerImageUrl(stickerId, post.channel_id, post.id);
 
     return (
         <div ref={containerRef} className="sticker-post" style={styles.container}>
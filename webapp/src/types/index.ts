@@ -4,13 +4,170 @@ export interface Sticker {
     file_id: string;
     creator_id: string;
     created_at: number;
+    tags: string[];
+    aliases: string[];
+    description?: string;
+    scope: Scope;
+    visibility: Visibility;
+    format: string;
+    width: number;
+    height: number;
+    frame_count: number;
+    sanitized: boolean;
+    perceptual_hash?: string;
+    thumbnails?: Record<string, string>;
+    preview?: string;
+    uploaded_at?: number;
+    previous_images?: PreviousImage[];
+    usage_count: number;
+    last_used_at: number;
+    deleted_at?: number;
+    deleted_by?: string;
+
+    // 'pending' while the sticker awaits a moderator's approval
+    status: StickerStatus;
+    moderated_by?: string;
+    moderated_at?: number;
+
+    // An edit of an approved sticker awaiting approval; until then the
+    // sticker keeps showing its approved state
+    pending_revision?: StickerRevision;
+}
+
+export type StickerStatus = 'approved' | 'pending';
+
+// The name, description, tags, aliases and image of a sticker as edited
+export interface StickerRevision {
+    name: string;
+    description?: string;
+    tags: string[];
+    aliases: string[];
+    filename: string;
+    format: string;
+    width: number;
+    height: number;
+    frame_count: number;
+    previous_images?: PreviousImage[];
+    user_id: string;
+    created_at: number;
+}
+
+// Where a sticker or pack can be seen and sent: everywhere, in one team or in
+// one channel. id is the team or channel ID.
+export interface Scope {
+    type: 'server' | 'team' | 'channel';
+    id?: string;
+}
+
+// A private sticker is only listed for and sendable by its creator
+export type Visibility = 'public' | 'private';
+
+// An image a sticker showed before it was replaced
+export interface PreviousImage {
+    filename: string;
+    uploaded_at?: number;
+    format: string;
+    width: number;
+    height: number;
+    frame_count: number;
+    replaced_at: number;
+    replaced_by: string;
+}
+
+// Fields of a sticker update; omitted fields are left unchanged
+export interface StickerPatch {
+    name?: string;
+    description?: string;
+    tags?: string[];
+    aliases?: string[];
+    scope?: Scope;
+
+    // Only 'public' can be set on a private sticker; public stickers stay public
+    visibility?: Visibility;
+    pack_ids?: string[];
+}
+
+// The editable state of a sticker at one version
+export interface StickerSnapshot {
+    name: string;
+    description?: string;
+    tags: string[];
+    aliases: string[];
+    scope: Scope;
+    visibility?: Visibility;
+    image: {
+        filename: string;
+        format: string;
+        width: number;
+        height: number;
+        frame_count: number;
+    };
+    trashed?: boolean;
+}
+
+// One recorded change to a sticker and the sticker as it was afterwards
+export interface StickerVersion {
+    version: number;
+    action: 'initial' | 'create' | 'update' | 'replace_image' | 'rollback' | 'trash' | 'restore' | 'approve';
+    user_id?: string;
+    created_at: number;
+    changes: string[];
+    previous_filename?: string;
+    sticker: StickerSnapshot;
+}
+
+export interface StickerVersionList {
+    sticker_id: string;
+    versions: StickerVersion[];
+    total: number;
 }
 
 export interface StickerList {
     stickers: Sticker[];
     total: number;
+    page?: number;
+    per_page?: number;
+    next_cursor?: string;
+}
+
+// Deleted stickers that can still be restored, most recently deleted first
+export interface TrashList {
+    stickers: Sticker[];
+    total: number;
+    retention_days: number;
+}
+
+// Stickers awaiting approval, oldest first
+export interface PendingList {
+    stickers: Sticker[];
+    total: number;
+}
+
+export interface StickerPack {
+    id: string;
+    name: string;
+    description: string;
+    cover_sticker_id: string;
+    owner_id: string;
+    scope: Scope;
+    sticker_ids: string[];
+    created_at: number;
+    updated_at: number;
+}
+
+export interface StickerPackList {
+    packs: StickerPack[];
+    total: number;
 }
 
+export interface StickerPackWithStickers extends StickerPack {
+    stickers: Sticker[];
+}
+
+// What to do when an uploaded image is identical to an existing sticker's:
+// reject it, add the new name as an alias of that sticker, or create it anyway
+export type DuplicatePolicy = 'reject' | 'alias' | 'allow';
+
 export interface PluginRegistry {
     registerPostTypeComponent(type: string, component: React.ComponentType<any>): void;
     registerChannelHeaderButtonAction(
@@ -31,6 +188,7 @@ export interface Store {
 export interface StickerPostProps {
     post: {
         id: string;
+        channel_id: string;
         file_ids?: string[];
         props?: {
             sticker_id?: string;